@@ -0,0 +1,179 @@
+// Package accesslog structured access log of jsonrpc server calls
+package accesslog
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libs4go/jsonrpc/server"
+	"github.com/libs4go/slf4go"
+)
+
+// Redacted replacement of redacted param fields
+const Redacted = "[REDACTED]"
+
+// Config access log settings, records are written to Logger, or to Writer as JSON lines if Writer is set
+//
+// Redact only matches object fields, positional params are redacted by method and index with RedactParams.
+type Config struct {
+	Logger       slf4go.Logger    // default slf4go logger JSONRPC-ACCESS
+	Writer       io.Writer        // write JSON lines instead of Logger
+	SampleRate   float64          // fraction of succeeded calls logged, zero means all, failed calls are always logged
+	Params       bool             // log call params
+	Redact       []string         // param field names replaced by Redacted, case insensitive, e.g. "password", "privateKey"
+	RedactParams map[string][]int // positional param indexes replaced by Redacted by method, e.g. {"Unlock": {1}}
+}
+
+// Record access log record of one call
+type Record struct {
+	Time         time.Time   `json:"time"`
+	Method       string      `json:"method"`
+	ID           *uint       `json:"id,omitempty"`
+	Principal    string      `json:"principal,omitempty"` // recorded by server.SetPrincipal, e.g. by auth.Interceptor
+	Transport    string      `json:"transport,omitempty"`
+	RemoteAddr   string      `json:"remoteAddr,omitempty"`
+	Duration     float64     `json:"durationMs"`
+	Code         int         `json:"code"` // jsonrpc error code, zero if succeeded
+	Error        string      `json:"error,omitempty"`
+	RequestSize  int         `json:"requestSize"`
+	ResponseSize int         `json:"responseSize"`
+	Params       interface{} `json:"params,omitempty"`
+}
+
+type accessLog struct {
+	sync.Mutex
+	config Config
+	redact map[string]bool
+	rand   *rand.Rand
+}
+
+// New create server observer writing one access log record for each call
+func New(config Config) server.Observer {
+	if config.Logger == nil {
+		config.Logger = slf4go.Get("JSONRPC-ACCESS")
+	}
+
+	log := &accessLog{
+		config: config,
+		redact: make(map[string]bool),
+		rand:   rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+
+	for _, name := range config.Redact {
+		log.redact[strings.ToLower(name)] = true
+	}
+
+	return log.observe
+}
+
+func (log *accessLog) observe(ctx context.Context, info *server.CallInfo) {
+	if info.Error == nil && !log.sample() {
+		return
+	}
+
+	record := &Record{
+		Time:         info.Start,
+		Method:       info.Method,
+		ID:           info.ID,
+		Principal:    info.Principal,
+		Transport:    info.Transport,
+		RemoteAddr:   info.RemoteAddr,
+		Duration:     float64(info.Duration) / float64(time.Millisecond),
+		RequestSize:  info.RequestSize,
+		ResponseSize: info.ResponseSize,
+	}
+
+	if info.Error != nil {
+		record.Code = int(info.Error.Code)
+		record.Error = info.Error.Message
+	}
+
+	if log.config.Params {
+		record.Params = log.redactParams(info.Method, info.Params)
+	}
+
+	if log.config.Writer == nil {
+		log.config.Logger.I("access {@record}", record)
+		return
+	}
+
+	buff, err := json.Marshal(record)
+
+	if err != nil {
+		log.config.Logger.E("marshal access record of {@method} error {@err}", info.Method, err)
+		return
+	}
+
+	log.Lock()
+	defer log.Unlock()
+
+	if _, err := log.config.Writer.Write(append(buff, '\n')); err != nil {
+		log.config.Logger.E("write access record error {@err}", err)
+	}
+}
+
+func (log *accessLog) sample() bool {
+	if log.config.SampleRate <= 0 || log.config.SampleRate >= 1 {
+		return true
+	}
+
+	log.Lock()
+	defer log.Unlock()
+
+	return log.rand.Float64() < log.config.SampleRate
+}
+
+// redactParams copy params with redacted fields and positions, params are normalized through json
+func (log *accessLog) redactParams(method string, params interface{}) interface{} {
+	indexes := log.config.RedactParams[method]
+
+	if (len(log.redact) == 0 && len(indexes) == 0) || params == nil {
+		return params
+	}
+
+	buff, err := json.Marshal(params)
+
+	if err != nil {
+		return nil
+	}
+
+	var value interface{}
+
+	if err := json.Unmarshal(buff, &value); err != nil {
+		return nil
+	}
+
+	if positional, ok := value.([]interface{}); ok {
+		for _, i := range indexes {
+			if i >= 0 && i < len(positional) {
+				positional[i] = Redacted
+			}
+		}
+	}
+
+	return log.redactValue(value)
+}
+
+func (log *accessLog) redactValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, field := range v {
+			if log.redact[strings.ToLower(key)] {
+				v[key] = Redacted
+			} else {
+				v[key] = log.redactValue(field)
+			}
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = log.redactValue(item)
+		}
+	}
+
+	return value
+}
@@ -0,0 +1,184 @@
+package accesslog
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/libs4go/jsonrpc"
+	"github.com/libs4go/jsonrpc/auth"
+	"github.com/libs4go/jsonrpc/client"
+	"github.com/libs4go/jsonrpc/server"
+	"github.com/libs4go/jsonrpc/transport"
+	"github.com/libs4go/slf4go"
+	"github.com/stretchr/testify/require"
+)
+
+type credentials struct {
+	User       string `json:"user"`
+	Password   string `json:"password"`
+	PrivateKey string `json:"privateKey"`
+}
+
+type walletServer struct {
+}
+
+func (s *walletServer) Import(cred credentials) (bool, error) {
+	return true, nil
+}
+
+func (s *walletServer) Unlock(address string, password string) (bool, error) {
+	return true, nil
+}
+
+func (s *walletServer) Fail() (bool, error) {
+	return false, errors.New("failed")
+}
+
+func readRecords(t *testing.T, buff *bytes.Buffer) []*Record {
+	var records []*Record
+
+	scanner := bufio.NewScanner(buff)
+
+	for scanner.Scan() {
+		var record *Record
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &record))
+		records = append(records, record)
+	}
+
+	return records
+}
+
+func TestAccessLog(t *testing.T) {
+
+	defer slf4go.Sync()
+
+	var buff bytes.Buffer
+
+	rpcServer, err := server.New(&walletServer{},
+		server.ServerInterceptor(auth.Interceptor(auth.BearerTokens(map[string]*auth.Principal{"token": {Subject: "alice"}}), nil)),
+		server.ServerObserver(New(Config{
+			Writer: &buff,
+			Params: true,
+			Redact: []string{"password", "privatekey"},
+		})))
+
+	require.NoError(t, err)
+
+	httpServer := httptest.NewServer(transport.ServeHTTP(rpcServer))
+
+	defer httpServer.Close()
+
+	c, err := client.HTTPConnect(httpServer.URL, client.HTTPTransportOps(transport.HTTPBearerToken("token")))
+
+	require.NoError(t, err)
+
+	var ok bool
+
+	require.NoError(t, c.Call(context.Background(), "Import", &credentials{User: "alice", Password: "secret", PrivateKey: "0x01"}).Join(&ok))
+
+	require.Error(t, c.Call(context.Background(), "Fail").Join(&ok))
+
+	records := readRecords(t, &buff)
+
+	require.Len(t, records, 2)
+
+	record := records[0]
+
+	require.Equal(t, "Import", record.Method)
+	require.NotNil(t, record.ID)
+	require.Equal(t, "alice", record.Principal)
+	require.Equal(t, "http", record.Transport)
+	require.NotEmpty(t, record.RemoteAddr)
+	require.Equal(t, 0, record.Code)
+	require.Greater(t, record.RequestSize, 0)
+	require.Greater(t, record.ResponseSize, 0)
+
+	params, err := json.Marshal(record.Params)
+
+	require.NoError(t, err)
+
+	require.JSONEq(t, `[{"user":"alice","password":"[REDACTED]","privateKey":"[REDACTED]"}]`, string(params))
+
+	require.Equal(t, int(jsonrpc.RPCInternalError), records[1].Code)
+	require.Equal(t, "failed", records[1].Error)
+}
+
+func TestAccessLogPositional(t *testing.T) {
+
+	defer slf4go.Sync()
+
+	var buff bytes.Buffer
+
+	rpcServer, err := server.New(&walletServer{},
+		server.ServerObserver(New(Config{
+			Writer:       &buff,
+			Params:       true,
+			RedactParams: map[string][]int{"Unlock": {1}},
+		})))
+
+	require.NoError(t, err)
+
+	httpServer := httptest.NewServer(transport.ServeHTTP(rpcServer))
+
+	defer httpServer.Close()
+
+	c, err := client.HTTPConnect(httpServer.URL)
+
+	require.NoError(t, err)
+
+	var ok bool
+
+	require.NoError(t, c.Call(context.Background(), "Unlock", "0x01", "secret").Join(&ok))
+
+	records := readRecords(t, &buff)
+
+	require.Len(t, records, 1)
+
+	params, err := json.Marshal(records[0].Params)
+
+	require.NoError(t, err)
+
+	require.JSONEq(t, `["0x01","[REDACTED]"]`, string(params))
+}
+
+func TestAccessLogSampling(t *testing.T) {
+
+	defer slf4go.Sync()
+
+	var buff bytes.Buffer
+
+	rpcServer, err := server.New(&walletServer{}, server.ServerObserver(New(Config{
+		Writer:     &buff,
+		SampleRate: 0.000001,
+	})))
+
+	require.NoError(t, err)
+
+	pipe := transport.NewPipe(rpcServer)
+
+	defer pipe.Close()
+
+	c, err := client.New(client.ClientTrans(pipe))
+
+	require.NoError(t, err)
+
+	var ok bool
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, c.Call(context.Background(), "Import", &credentials{}).Join(&ok))
+	}
+
+	require.Error(t, c.Call(context.Background(), "Fail").Join(&ok))
+
+	records := readRecords(t, &buff)
+
+	require.Len(t, records, 1)
+
+	require.Equal(t, "Fail", records[0].Method)
+	require.Equal(t, "pipe", records[0].Transport)
+}
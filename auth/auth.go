@@ -0,0 +1,89 @@
+// Package auth jsonrpc server authentication and per-method authorization
+package auth
+
+import (
+	"context"
+	"time"
+
+	"github.com/libs4go/jsonrpc/transport"
+)
+
+// Principal authenticated identity of the caller
+type Principal struct {
+	Subject   string                 // caller identity, e.g. jwt sub or certificate common name
+	Scheme    string                 // authentication scheme, e.g. "bearer", "apikey", "jwt", "mtls"
+	Roles     []string               // granted roles
+	Scopes    []string               // granted scopes
+	Claims    map[string]interface{} // jwt claims, nil for other schemes
+	ExpiresAt time.Time              // credential expiry, zero means never expires
+	leeway    time.Duration          // clock skew tolerance of ExpiresAt, e.g. JWTConfig.Leeway
+}
+
+// HasRole check if principal has role
+func (principal *Principal) HasRole(role string) bool {
+	return contains(principal.Roles, role)
+}
+
+// HasScope check if principal has scope
+func (principal *Principal) HasScope(scope string) bool {
+	return contains(principal.Scopes, scope)
+}
+
+func (principal *Principal) expired(now time.Time) bool {
+	return !principal.ExpiresAt.IsZero() && now.After(principal.ExpiresAt.Add(principal.leeway))
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Authenticator authenticate caller from transport peer information.
+//
+// Authenticate returns nil principal and nil error if the peer carries no credentials of its scheme,
+// and returns error if the credentials are present but invalid.
+type Authenticator interface {
+	Authenticate(ctx context.Context, peer *transport.Peer) (*Principal, error)
+}
+
+// AuthenticatorFunc function adapter of Authenticator
+type AuthenticatorFunc func(ctx context.Context, peer *transport.Peer) (*Principal, error)
+
+// Authenticate implement Authenticator
+func (f AuthenticatorFunc) Authenticate(ctx context.Context, peer *transport.Peer) (*Principal, error) {
+	return f(ctx, peer)
+}
+
+// Chain try authenticators in order, the first principal or error wins
+func Chain(authenticators ...Authenticator) Authenticator {
+	return AuthenticatorFunc(func(ctx context.Context, peer *transport.Peer) (*Principal, error) {
+		for _, authenticator := range authenticators {
+			principal, err := authenticator.Authenticate(ctx, peer)
+
+			if err != nil || principal != nil {
+				return principal, err
+			}
+		}
+
+		return nil, nil
+	})
+}
+
+type principalKey struct{}
+
+// WithPrincipal bind principal to context
+func WithPrincipal(ctx context.Context, principal *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// PrincipalFromContext get principal of authenticated caller, returns false for anonymous caller
+func PrincipalFromContext(ctx context.Context) (*Principal, bool) {
+	principal, ok := ctx.Value(principalKey{}).(*Principal)
+
+	return principal, ok && principal != nil
+}
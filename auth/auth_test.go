@@ -0,0 +1,309 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/libs4go/errors"
+	"github.com/libs4go/jsonrpc"
+	"github.com/libs4go/jsonrpc/client"
+	"github.com/libs4go/jsonrpc/server"
+	"github.com/libs4go/jsonrpc/transport"
+	"github.com/libs4go/slf4go"
+	"github.com/stretchr/testify/require"
+)
+
+type bankServer struct {
+}
+
+func (s *bankServer) PublicVersion() (string, error) {
+	return "1.0", nil
+}
+
+func (s *bankServer) GetBalance(ctx context.Context) (string, error) {
+	principal, _ := PrincipalFromContext(ctx)
+
+	return principal.Subject, nil
+}
+
+func (s *bankServer) AdminShutdown() (bool, error) {
+	return true, nil
+}
+
+func (s *bankServer) WriteLedger() (bool, error) {
+	return true, nil
+}
+
+func signJWT(t *testing.T, alg string, kid string, key interface{}, claims map[string]interface{}) string {
+	header, err := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+
+	require.NoError(t, err)
+
+	payload, err := json.Marshal(claims)
+
+	require.NoError(t, err)
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		signature, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+		require.NoError(t, err)
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		require.NoError(t, err)
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func rpcCode(err error) jsonrpc.RPCErrorCode {
+	var rpcErr *jsonrpc.RPCError
+
+	if errors.As(err, &rpcErr) {
+		return rpcErr.Code
+	}
+
+	return 0
+}
+
+func TestAuth(t *testing.T) {
+
+	defer slf4go.Sync()
+
+	hsKey := []byte("secret")
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+
+	require.NoError(t, err)
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	require.NoError(t, err)
+
+	jwtAuth, err := JWT(JWTConfig{
+		Keys: map[string]interface{}{
+			"hs": hsKey,
+			"rs": &rsaKey.PublicKey,
+			"es": &ecKey.PublicKey,
+		},
+		Issuer: "test",
+	})
+
+	require.NoError(t, err)
+
+	authenticator := Chain(
+		BearerTokens(map[string]*Principal{"alice-token": {Subject: "alice", Roles: []string{"user"}}}),
+		APIKeys("", map[string]*Principal{"admin-key": {Subject: "root", Roles: []string{"admin"}}}),
+		jwtAuth,
+	)
+
+	policy := Policy{
+		{Methods: []string{"Public*"}, Public: true},
+		{Methods: []string{"Admin*"}, Roles: []string{"admin"}},
+		{Methods: []string{"Write*"}, Scopes: []string{"ledger:write"}},
+	}
+
+	principals := make(chan string, 100)
+
+	rpcServer, err := server.New(&bankServer{}, server.ServerInterceptor(Interceptor(authenticator, policy)), server.ServerObserver(func(ctx context.Context, info *server.CallInfo) {
+		principals <- info.Principal
+	}))
+
+	require.NoError(t, err)
+
+	httpServer := httptest.NewServer(transport.ServeHTTP(rpcServer))
+
+	defer httpServer.Close()
+
+	connect := func(headers map[string]string) jsonrpc.Client {
+		c, err := client.HTTPConnect(httpServer.URL, client.HTTPTransportOps(transport.HTTPHeaders(headers)))
+
+		require.NoError(t, err)
+
+		return c
+	}
+
+	var version, subject string
+	var ok bool
+
+	anonymous := connect(nil)
+
+	require.NoError(t, anonymous.Call(context.Background(), "PublicVersion").Join(&version))
+
+	require.Equal(t, jsonrpc.RPCUnauthorized, rpcCode(anonymous.Call(context.Background(), "GetBalance").Join(&subject)))
+
+	alice := connect(map[string]string{"Authorization": "Bearer alice-token"})
+
+	// principal is recorded for observers, anonymous calls record none
+	require.Equal(t, "", <-principals)
+	require.Equal(t, "", <-principals)
+
+	require.NoError(t, alice.Call(context.Background(), "GetBalance").Join(&subject))
+
+	require.Equal(t, "alice", subject)
+
+	require.Equal(t, "alice", <-principals)
+
+	require.Equal(t, jsonrpc.RPCForbidden, rpcCode(alice.Call(context.Background(), "AdminShutdown").Join(&ok)))
+
+	admin := connect(map[string]string{"X-API-Key": "admin-key"})
+
+	require.NoError(t, admin.Call(context.Background(), "AdminShutdown").Join(&ok))
+
+	for _, key := range []struct {
+		alg, kid string
+		key      interface{}
+	}{{"HS256", "hs", hsKey}, {"RS256", "rs", rsaKey}, {"ES256", "es", ecKey}} {
+		token := signJWT(t, key.alg, key.kid, key.key, map[string]interface{}{
+			"sub":   "bob",
+			"iss":   "test",
+			"exp":   time.Now().Add(time.Minute).Unix(),
+			"scope": "ledger:read ledger:write",
+		})
+
+		bob := connect(map[string]string{"Authorization": "Bearer " + token})
+
+		require.NoError(t, bob.Call(context.Background(), "WriteLedger").Join(&ok), key.alg)
+
+		require.NoError(t, bob.Call(context.Background(), "GetBalance").Join(&subject))
+
+		require.Equal(t, "bob", subject)
+	}
+
+	expired := signJWT(t, "HS256", "hs", hsKey, map[string]interface{}{
+		"sub": "bob",
+		"iss": "test",
+		"exp": time.Now().Add(-time.Minute).Unix(),
+	})
+
+	require.Equal(t, jsonrpc.RPCUnauthorized, rpcCode(connect(map[string]string{"Authorization": "Bearer " + expired}).Call(context.Background(), "GetBalance").Join(&subject)))
+
+	// hs key of rs kid must be rejected
+	confused := signJWT(t, "HS256", "rs", hsKey, map[string]interface{}{"sub": "mallory", "iss": "test"})
+
+	require.Equal(t, jsonrpc.RPCUnauthorized, rpcCode(connect(map[string]string{"Authorization": "Bearer " + confused}).Call(context.Background(), "GetBalance").Join(&subject)))
+
+	// authentication errors are matchable by sentinel errors
+	_, err = jwtAuth.Authenticate(context.Background(), &transport.Peer{Header: http.Header{"Authorization": {"Bearer " + expired}}})
+
+	require.True(t, errors.Is(err, ErrExpired))
+
+	_, err = jwtAuth.Authenticate(context.Background(), &transport.Peer{Header: http.Header{"Authorization": {"Bearer " + confused}}})
+
+	require.True(t, errors.Is(err, ErrInvalidCredentials))
+
+	_, err = JWT(JWTConfig{})
+
+	require.True(t, errors.Is(err, ErrConfig))
+
+	noScope := signJWT(t, "HS256", "hs", hsKey, map[string]interface{}{"sub": "bob", "iss": "test"})
+
+	require.Equal(t, jsonrpc.RPCForbidden, rpcCode(connect(map[string]string{"Authorization": "Bearer " + noScope}).Call(context.Background(), "WriteLedger").Join(&ok)))
+
+	wsServer := httptest.NewServer(transport.ServeWebSocket(rpcServer))
+
+	defer wsServer.Close()
+
+	wsClient, err := client.WebSocketConnect("ws" + strings.TrimPrefix(wsServer.URL, "http") + "?access_token=alice-token")
+
+	require.NoError(t, err)
+
+	require.NoError(t, wsClient.Call(context.Background(), "GetBalance").Join(&subject))
+
+	require.Equal(t, "alice", subject)
+}
+
+func TestAuthExpiry(t *testing.T) {
+
+	defer slf4go.Sync()
+
+	hsKey := []byte("secret")
+
+	jwtAuth, err := JWT(JWTConfig{
+		Keys:   map[string]interface{}{"hs": hsKey},
+		Leeway: time.Minute,
+	})
+
+	require.NoError(t, err)
+
+	authenticator := Chain(
+		BearerTokens(map[string]*Principal{"stale-token": {Subject: "alice", ExpiresAt: time.Now().Add(-time.Second)}}),
+		APIKeys("", map[string]*Principal{"stale-key": {Subject: "root", ExpiresAt: time.Now().Add(-time.Second)}}),
+		jwtAuth,
+	)
+
+	rpcServer, err := server.New(&bankServer{}, server.ServerInterceptor(Interceptor(authenticator, nil)))
+
+	require.NoError(t, err)
+
+	httpServer := httptest.NewServer(transport.ServeHTTP(rpcServer))
+
+	defer httpServer.Close()
+
+	var subject string
+
+	// expired static credentials are rejected on every http call
+	for _, headers := range []map[string]string{{"Authorization": "Bearer stale-token"}, {"X-API-Key": "stale-key"}} {
+		c, err := client.HTTPConnect(httpServer.URL, client.HTTPTransportOps(transport.HTTPHeaders(headers)))
+
+		require.NoError(t, err)
+
+		for i := 0; i < 2; i++ {
+			require.Equal(t, jsonrpc.RPCUnauthorized, rpcCode(c.Call(context.Background(), "GetBalance").Join(&subject)))
+		}
+	}
+
+	wsServer := httptest.NewServer(transport.ServeWebSocket(rpcServer))
+
+	defer wsServer.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(wsServer.URL, "http")
+
+	stale, err := client.WebSocketConnect(wsURL + "?access_token=stale-token")
+
+	require.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		require.Equal(t, jsonrpc.RPCUnauthorized, rpcCode(stale.Call(context.Background(), "GetBalance").Join(&subject)))
+	}
+
+	// jwt accepted within leeway stays accepted on the same connection
+	token := signJWT(t, "HS256", "hs", hsKey, map[string]interface{}{
+		"sub": "bob",
+		"exp": time.Now().Add(-time.Second).Unix(),
+	})
+
+	lenient, err := client.WebSocketConnect(wsURL + "?access_token=" + token)
+
+	require.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		require.NoError(t, lenient.Call(context.Background(), "GetBalance").Join(&subject))
+		require.Equal(t, "bob", subject)
+	}
+}
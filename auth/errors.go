@@ -0,0 +1,12 @@
+package auth
+
+import "github.com/libs4go/errors"
+
+const errVendor = "jsonrpc-auth"
+
+// errors
+var (
+	ErrConfig             = errors.New("invalid authenticator config", errors.WithVendor(errVendor), errors.WithCode(-1))
+	ErrInvalidCredentials = errors.New("invalid credentials", errors.WithVendor(errVendor), errors.WithCode(-2))
+	ErrExpired            = errors.New("credentials expired", errors.WithVendor(errVendor), errors.WithCode(-3))
+)
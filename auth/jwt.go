@@ -0,0 +1,278 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/libs4go/errors"
+)
+
+// JWTConfig jwt bearer token verification settings
+type JWTConfig struct {
+	// Keys verification keys indexed by kid, the key with empty kid verifies tokens without kid.
+	// Key type must be []byte for HS256/HS384/HS512, *rsa.PublicKey for RS256/RS384/RS512
+	// and *ecdsa.PublicKey for ES256/ES384/ES512
+	Keys        map[string]interface{}
+	Issuer      string        // expected iss claim, empty means not checked
+	Audience    string        // expected aud claim, empty means not checked
+	Leeway      time.Duration // clock skew tolerance of exp and nbf
+	RolesClaim  string        // claim of roles, default "roles"
+	ScopesClaim string        // claim of scopes, space separated string or string array, default "scope"
+}
+
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+}
+
+// JWT authenticate jwt bearer tokens signed by local keys
+func JWT(config JWTConfig) (Authenticator, error) {
+	if len(config.Keys) == 0 {
+		return nil, errors.Wrap(ErrConfig, "jwt authenticator expect verification keys")
+	}
+
+	for kid, key := range config.Keys {
+		switch key.(type) {
+		case []byte, *rsa.PublicKey, *ecdsa.PublicKey:
+		default:
+			return nil, errors.Wrap(ErrConfig, "unsupported jwt key %s type %T", kid, key)
+		}
+	}
+
+	if config.RolesClaim == "" {
+		config.RolesClaim = "roles"
+	}
+
+	if config.ScopesClaim == "" {
+		config.ScopesClaim = "scope"
+	}
+
+	return BearerValidator(func(ctx context.Context, token string) (*Principal, error) {
+		if strings.Count(token, ".") != 2 {
+			// opaque bearer token, left to other authenticators
+			return nil, nil
+		}
+
+		return config.verify(token, time.Now())
+	}), nil
+}
+
+func (config *JWTConfig) verify(token string, now time.Time) (*Principal, error) {
+	parts := strings.Split(token, ".")
+
+	var header jwtHeader
+
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, errors.Wrap(ErrInvalidCredentials, "invalid jwt header, %s", err)
+	}
+
+	key, ok := config.Keys[header.KeyID]
+
+	if !ok {
+		return nil, errors.Wrap(ErrInvalidCredentials, "unknown jwt key %s", header.KeyID)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+
+	if err != nil {
+		return nil, errors.Wrap(ErrInvalidCredentials, "invalid jwt signature encoding, %s", err)
+	}
+
+	if err := verifySignature(header.Algorithm, key, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]interface{}
+
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, errors.Wrap(ErrInvalidCredentials, "invalid jwt claims, %s", err)
+	}
+
+	principal := &Principal{
+		Scheme: "jwt",
+		Claims: claims,
+		leeway: config.Leeway,
+	}
+
+	principal.Subject, _ = claims["sub"].(string)
+
+	if exp, ok := claims["exp"].(float64); ok {
+		principal.ExpiresAt = time.Unix(int64(exp), 0)
+
+		if principal.expired(now) {
+			return nil, errors.Wrap(ErrExpired, "jwt expired")
+		}
+	}
+
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(config.Leeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, errors.Wrap(ErrInvalidCredentials, "jwt not valid yet")
+	}
+
+	if config.Issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != config.Issuer {
+			return nil, errors.Wrap(ErrInvalidCredentials, "unexpected jwt issuer %s", iss)
+		}
+	}
+
+	if config.Audience != "" && !contains(stringsClaim(claims["aud"]), config.Audience) {
+		return nil, errors.Wrap(ErrInvalidCredentials, "unexpected jwt audience")
+	}
+
+	principal.Roles = stringsClaim(claims[config.RolesClaim])
+	principal.Scopes = stringsClaim(claims[config.ScopesClaim])
+
+	return principal, nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	buff, err := base64.RawURLEncoding.DecodeString(segment)
+
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(buff, v)
+}
+
+// stringsClaim decode claim of space separated string or string array
+func stringsClaim(claim interface{}) []string {
+	switch value := claim.(type) {
+	case string:
+		return strings.Fields(value)
+	case []interface{}:
+		var values []string
+
+		for _, v := range value {
+			if s, ok := v.(string); ok {
+				values = append(values, s)
+			}
+		}
+
+		return values
+	}
+
+	return nil
+}
+
+// verifySignature verify jws signature, the algorithm must match key type to prevent algorithm confusion
+func verifySignature(algorithm string, key interface{}, signed []byte, signature []byte) error {
+	var hash crypto.Hash
+	var curveBits int // ecdsa curve size of ES algorithms
+
+	switch algorithm {
+	case "HS256", "RS256", "ES256":
+		hash, curveBits = crypto.SHA256, 256
+	case "HS384", "RS384", "ES384":
+		hash, curveBits = crypto.SHA384, 384
+	case "HS512", "RS512", "ES512":
+		hash, curveBits = crypto.SHA512, 521
+	default:
+		return errors.Wrap(ErrInvalidCredentials, "unsupported jwt algorithm %s", algorithm)
+	}
+
+	hasher := hash.New()
+	hasher.Write(signed)
+	digest := hasher.Sum(nil)
+
+	switch k := key.(type) {
+	case []byte:
+		if !strings.HasPrefix(algorithm, "HS") {
+			break
+		}
+
+		mac := hmac.New(hash.New, k)
+		mac.Write(signed)
+
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return errors.Wrap(ErrInvalidCredentials, "invalid jwt signature")
+		}
+
+		return nil
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(algorithm, "RS") {
+			break
+		}
+
+		if err := rsa.VerifyPKCS1v15(k, hash, digest, signature); err != nil {
+			return errors.Wrap(ErrInvalidCredentials, "invalid jwt signature")
+		}
+
+		return nil
+	case *ecdsa.PublicKey:
+		if !strings.HasPrefix(algorithm, "ES") || k.Curve.Params().BitSize != curveBits {
+			break
+		}
+
+		size := (k.Curve.Params().BitSize + 7) / 8
+
+		if len(signature) != 2*size {
+			return errors.Wrap(ErrInvalidCredentials, "invalid jwt signature")
+		}
+
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+
+		if !ecdsa.Verify(k, digest, r, s) {
+			return errors.Wrap(ErrInvalidCredentials, "invalid jwt signature")
+		}
+
+		return nil
+	}
+
+	return errors.Wrap(ErrInvalidCredentials, "jwt algorithm %s doesn't match key type %T", algorithm, key)
+}
+
+// LoadJWTKeyFile load PEM encoded public key or certificate used to verify RS and ES jwt
+func LoadJWTKeyFile(file string) (interface{}, error) {
+	buff, err := os.ReadFile(file)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "read jwt key %s error", file)
+	}
+
+	block, _ := pem.Decode(buff)
+
+	if block == nil {
+		return nil, errors.Wrap(ErrConfig, "invalid PEM file %s", file)
+	}
+
+	switch block.Type {
+	case "PUBLIC KEY":
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+
+		if err != nil {
+			return nil, errors.Wrap(err, "parse public key %s error", file)
+		}
+
+		return key, nil
+	case "RSA PUBLIC KEY":
+		key, err := x509.ParsePKCS1PublicKey(block.Bytes)
+
+		if err != nil {
+			return nil, errors.Wrap(err, "parse rsa public key %s error", file)
+		}
+
+		return key, nil
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+
+		if err != nil {
+			return nil, errors.Wrap(err, "parse certificate %s error", file)
+		}
+
+		return cert.PublicKey, nil
+	}
+
+	return nil, errors.Wrap(ErrConfig, "unsupported PEM block %s of %s", block.Type, file)
+}
@@ -0,0 +1,46 @@
+package auth
+
+import (
+	"context"
+	"crypto/x509"
+
+	"github.com/libs4go/jsonrpc/transport"
+)
+
+// CertMapper map verified client certificate to principal
+type CertMapper func(cert *x509.Certificate) (*Principal, error)
+
+// MTLS authenticate verified tls client certificate, the transport tls config must require and verify
+// client certificates. By default the subject common name is the principal subject and the subject
+// organizational units are the principal roles.
+func MTLS(mapper CertMapper) Authenticator {
+	if mapper == nil {
+		mapper = defaultCertMapper
+	}
+
+	return AuthenticatorFunc(func(ctx context.Context, peer *transport.Peer) (*Principal, error) {
+		if peer.TLS == nil || len(peer.TLS.VerifiedChains) == 0 {
+			return nil, nil
+		}
+
+		principal, err := mapper(peer.TLS.VerifiedChains[0][0])
+
+		if err != nil || principal == nil {
+			return principal, err
+		}
+
+		if principal.Scheme == "" {
+			principal.Scheme = "mtls"
+		}
+
+		return principal, nil
+	})
+}
+
+func defaultCertMapper(cert *x509.Certificate) (*Principal, error) {
+	return &Principal{
+		Subject:   cert.Subject.CommonName,
+		Roles:     cert.Subject.OrganizationalUnit,
+		ExpiresAt: cert.NotAfter,
+	}, nil
+}
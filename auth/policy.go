@@ -0,0 +1,162 @@
+package auth
+
+import (
+	"context"
+	"path"
+	"time"
+
+	"github.com/libs4go/errors"
+	"github.com/libs4go/jsonrpc"
+	"github.com/libs4go/jsonrpc/server"
+	"github.com/libs4go/jsonrpc/transport"
+	"github.com/libs4go/slf4go"
+)
+
+// Rule authorization rule of methods
+type Rule struct {
+	Methods []string // method names or glob patterns of namespace, e.g. "Admin*"
+	Public  bool     // allow anonymous calls
+	Roles   []string // principal must have any of roles, empty means any authenticated principal
+	Scopes  []string // principal must have all of scopes
+}
+
+func (rule *Rule) match(method string) bool {
+	for _, pattern := range rule.Methods {
+		if pattern == method {
+			return true
+		}
+
+		if matched, err := path.Match(pattern, method); err == nil && matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Policy ordered authorization rules, the first rule matching the method applies,
+// methods not matched by any rule require authenticated principal
+type Policy []Rule
+
+func (policy Policy) authorize(method string, principal *Principal) *jsonrpc.RPCError {
+	rule := &Rule{}
+
+	for i := range policy {
+		if policy[i].match(method) {
+			rule = &policy[i]
+			break
+		}
+	}
+
+	if rule.Public {
+		return nil
+	}
+
+	if principal == nil {
+		return &jsonrpc.RPCError{Code: jsonrpc.RPCUnauthorized, Message: "unauthorized"}
+	}
+
+	if len(rule.Roles) != 0 {
+		granted := false
+
+		for _, role := range rule.Roles {
+			if principal.HasRole(role) {
+				granted = true
+				break
+			}
+		}
+
+		if !granted {
+			return &jsonrpc.RPCError{Code: jsonrpc.RPCForbidden, Message: "forbidden, method " + method + " requires role"}
+		}
+	}
+
+	for _, scope := range rule.Scopes {
+		if !principal.HasScope(scope) {
+			return &jsonrpc.RPCError{Code: jsonrpc.RPCForbidden, Message: "forbidden, method " + method + " requires scope " + scope}
+		}
+	}
+
+	return nil
+}
+
+// cacheKey session value key of authentication result, unique for each interceptor
+type cacheKey struct {
+	id *int
+}
+
+type authResult struct {
+	principal *Principal
+	err       error
+}
+
+// Interceptor create server interceptor which authenticates caller and authorizes calls by policy,
+// the principal of authenticated caller is bound to handler context (see PrincipalFromContext),
+// and its subject is recorded for server observers such as access log (see server.SetPrincipal).
+//
+// Stream transports authenticate once for each connection, calls are rejected with jsonrpc.RPCUnauthorized error
+// after the credentials expired, the connection is kept open, clients reconnect to present fresh credentials.
+func Interceptor(authenticator Authenticator, policy Policy) server.Interceptor {
+	logger := slf4go.Get("JSONRPC-AUTH")
+
+	key := cacheKey{id: new(int)}
+
+	return func(ctx context.Context, req *jsonrpc.RPCRequest, next server.Invoker) *jsonrpc.RPCError {
+		principal, err := authenticate(ctx, key, authenticator)
+
+		if err != nil {
+			logger.D("authenticate call {@method} error {@err}", req.Method, err)
+			return &jsonrpc.RPCError{Code: jsonrpc.RPCUnauthorized, Message: "unauthorized"}
+		}
+
+		if principal != nil {
+			server.SetPrincipal(ctx, principal.Subject)
+		}
+
+		if rpcErr := policy.authorize(req.Method, principal); rpcErr != nil {
+			logger.D("reject call {@method}, {@err}", req.Method, rpcErr.Error())
+			return rpcErr
+		}
+
+		if principal != nil {
+			ctx = WithPrincipal(ctx, principal)
+		}
+
+		return next(ctx)
+	}
+}
+
+func authenticate(ctx context.Context, key cacheKey, authenticator Authenticator) (*Principal, error) {
+	peer, ok := transport.PeerFromContext(ctx)
+
+	if !ok {
+		return nil, nil
+	}
+
+	session, hasSession := transport.SessionFromContext(ctx)
+
+	if hasSession {
+		if cached, ok := session.Get(key); ok {
+			result := cached.(*authResult)
+
+			if result.principal != nil && result.principal.expired(time.Now()) {
+				return nil, errors.Wrap(ErrExpired, "credentials of %s expired", result.principal.Subject)
+			}
+
+			return result.principal, result.err
+		}
+	}
+
+	principal, err := authenticator.Authenticate(ctx, peer)
+
+	if hasSession {
+		session.Set(key, &authResult{principal: principal, err: err})
+	}
+
+	// static credentials carry no expiry check of their own
+	if err == nil && principal != nil && principal.expired(time.Now()) {
+		return nil, errors.Wrap(ErrExpired, "credentials of %s expired", principal.Subject)
+	}
+
+	return principal, err
+}
@@ -0,0 +1,103 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"strings"
+
+	"github.com/libs4go/jsonrpc/transport"
+)
+
+// bearerToken get token from Authorization header, or from access_token query parameter
+// for browser websocket clients which can't set headers
+func bearerToken(peer *transport.Peer) string {
+	if peer.Header != nil {
+		authorization := peer.Header.Get("Authorization")
+
+		if len(authorization) > 7 && strings.EqualFold(authorization[:7], "Bearer ") {
+			return strings.TrimSpace(authorization[7:])
+		}
+	}
+
+	if peer.URL != nil {
+		return peer.URL.Query().Get("access_token")
+	}
+
+	return ""
+}
+
+// BearerValidator authenticate bearer token by validate, validate returns nil principal for unknown token
+func BearerValidator(validate func(ctx context.Context, token string) (*Principal, error)) Authenticator {
+	return AuthenticatorFunc(func(ctx context.Context, peer *transport.Peer) (*Principal, error) {
+		token := bearerToken(peer)
+
+		if token == "" {
+			return nil, nil
+		}
+
+		return validate(ctx, token)
+	})
+}
+
+// BearerTokens authenticate static bearer tokens
+func BearerTokens(tokens map[string]*Principal) Authenticator {
+	lookup := newTokenTable("bearer", tokens)
+
+	return BearerValidator(func(ctx context.Context, token string) (*Principal, error) {
+		return lookup.get(token), nil
+	})
+}
+
+// APIKeys authenticate static api keys carried by header, default header X-API-Key
+func APIKeys(header string, keys map[string]*Principal) Authenticator {
+	if header == "" {
+		header = "X-API-Key"
+	}
+
+	lookup := newTokenTable("apikey", keys)
+
+	return AuthenticatorFunc(func(ctx context.Context, peer *transport.Peer) (*Principal, error) {
+		if peer.Header == nil {
+			return nil, nil
+		}
+
+		key := peer.Header.Get(header)
+
+		if key == "" {
+			return nil, nil
+		}
+
+		return lookup.get(key), nil
+	})
+}
+
+// tokenTable static credentials indexed by sha256 digest, so lookup time doesn't depend on common prefix
+type tokenTable map[[sha256.Size]byte]*Principal
+
+func newTokenTable(scheme string, tokens map[string]*Principal) tokenTable {
+	table := make(tokenTable)
+
+	for token, principal := range tokens {
+		p := *principal
+
+		if p.Scheme == "" {
+			p.Scheme = scheme
+		}
+
+		table[sha256.Sum256([]byte(token))] = &p
+	}
+
+	return table
+}
+
+func (table tokenTable) get(token string) *Principal {
+	principal, ok := table[sha256.Sum256([]byte(token))]
+
+	if !ok {
+		return nil
+	}
+
+	p := *principal
+
+	return &p
+}
@@ -0,0 +1,315 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/libs4go/errors"
+	"github.com/libs4go/jsonrpc"
+)
+
+// BreakerState circuit breaker state
+type BreakerState int
+
+const (
+	BreakerClosed   BreakerState = iota // calls pass, outcomes are tracked
+	BreakerOpen                         // calls fail fast with jsonrpc.ErrCircuitOpen
+	BreakerHalfOpen                     // limited trial calls decide whether to close or re-open
+)
+
+func (state BreakerState) String() string {
+	switch state {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+
+	return fmt.Sprintf("BreakerState(%d)", int(state))
+}
+
+// BreakerPerMethod track one circuit for each method, the default
+func BreakerPerMethod(method string) string {
+	return method
+}
+
+// BreakerPerEndpoint track one circuit for all methods of the client. The circuit is keyed on the client,
+// not on the endpoint serving each call, so it isolates an endpoint only if the client has a single one.
+// Endpoints of a Pool share this circuit, their individual health is tracked by pool ejection
+// (see PoolConfig.MaxFailures), use one client per endpoint to break each endpoint separately
+func BreakerPerEndpoint(method string) string {
+	return ""
+}
+
+// BreakerConfig circuit breaker settings
+type BreakerConfig struct {
+	Key           func(method string) string              // circuit key of method, default BreakerPerMethod
+	Window        time.Duration                           // rolling window of failure rate, default 10s
+	MinCalls      int                                     // min calls in window before the circuit may open, default 20
+	FailureRate   float64                                 // failure rate in (0, 1] opening the circuit, default 0.5
+	SlowCall      time.Duration                           // calls slower than duration count as failures, zero disables
+	OpenDuration  time.Duration                           // duration before open circuit turns half-open, default 5s
+	HalfOpenCalls int                                     // trial calls of half-open circuit, all must succeed to close it, default 1
+	FailOn        func(err error) bool                    // failed calls counted as failures, default caller ctx deadline exceeded and DefaultRetryOn errors
+	OnStateChange func(key string, from, to BreakerState) // state change callback
+}
+
+// breakerBuckets buckets of rolling window
+const breakerBuckets = 10
+
+type breakerBucket struct {
+	start    time.Time
+	calls    int
+	failures int
+}
+
+type circuit struct {
+	state    BreakerState
+	buckets  [breakerBuckets]breakerBucket
+	openedAt time.Time
+	trials   int    // in-flight trial calls of half-open circuit
+	passed   int    // succeeded trial calls of half-open circuit
+	gen      uint64 // bumped by each state change, outcomes of calls admitted in former states are ignored
+}
+
+type breaker struct {
+	sync.Mutex
+	config   BreakerConfig
+	circuits map[string]*circuit
+}
+
+// ClientBreaker track failure rate and latency of calls, calls fail fast with jsonrpc.ErrCircuitOpen while circuit is open
+func ClientBreaker(config BreakerConfig) ClientOpt {
+	return func(client *Client) {
+		if config.Key == nil {
+			config.Key = BreakerPerMethod
+		}
+
+		if config.Window <= 0 {
+			config.Window = 10 * time.Second
+		}
+
+		if config.MinCalls <= 0 {
+			config.MinCalls = 20
+		}
+
+		if config.FailureRate <= 0 || config.FailureRate > 1 {
+			config.FailureRate = 0.5
+		}
+
+		if config.OpenDuration <= 0 {
+			config.OpenDuration = 5 * time.Second
+		}
+
+		if config.HalfOpenCalls <= 0 {
+			config.HalfOpenCalls = 1
+		}
+
+		if config.FailOn == nil {
+			config.FailOn = func(err error) bool {
+				if errors.Is(err, context.DeadlineExceeded) {
+					return true
+				}
+
+				for _, predicate := range DefaultRetryOn {
+					if predicate(err) {
+						return true
+					}
+				}
+
+				return false
+			}
+		}
+
+		client.breaker = &breaker{
+			config:   config,
+			circuits: make(map[string]*circuit),
+		}
+	}
+}
+
+// BreakerState get circuit state of method, BreakerClosed if breaker is not set
+func (client *Client) BreakerState(method string) BreakerState {
+	if client.breaker == nil {
+		return BreakerClosed
+	}
+
+	b := client.breaker
+
+	b.Lock()
+	defer b.Unlock()
+
+	c, ok := b.circuits[b.config.Key(method)]
+
+	if !ok {
+		return BreakerClosed
+	}
+
+	// report open circuit due for trial as half-open
+	if c.state == BreakerOpen && time.Since(c.openedAt) >= b.config.OpenDuration {
+		return BreakerHalfOpen
+	}
+
+	return c.state
+}
+
+type stateChange struct {
+	key      string
+	from, to BreakerState
+}
+
+// allow check circuit of method, the returned function records the call outcome
+func (b *breaker) allow(method string) (func(err error, duration time.Duration), error) {
+	key := b.config.Key(method)
+
+	b.Lock()
+
+	c, ok := b.circuits[key]
+
+	if !ok {
+		c = &circuit{}
+		b.circuits[key] = c
+	}
+
+	var changes []stateChange
+
+	if c.state == BreakerOpen && time.Since(c.openedAt) >= b.config.OpenDuration {
+		changes = append(changes, b.transit(key, c, BreakerHalfOpen))
+	}
+
+	var err error
+
+	switch {
+	case c.state == BreakerOpen:
+		err = errors.Wrap(jsonrpc.ErrCircuitOpen, "circuit of %s open", method)
+	case c.state == BreakerHalfOpen && c.trials+c.passed >= b.config.HalfOpenCalls:
+		err = errors.Wrap(jsonrpc.ErrCircuitOpen, "circuit of %s half-open, trial calls in-flight", method)
+	case c.state == BreakerHalfOpen:
+		c.trials++
+	}
+
+	trial := c.state == BreakerHalfOpen && err == nil
+
+	gen := c.gen
+
+	b.Unlock()
+
+	b.notify(changes)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return func(callErr error, duration time.Duration) {
+		b.record(key, c, gen, trial, callErr, duration)
+	}, nil
+}
+
+func (b *breaker) record(key string, c *circuit, gen uint64, trial bool, err error, duration time.Duration) {
+	// calls canceled by caller say nothing about the endpoint
+	canceled := errors.Is(err, context.Canceled)
+
+	failed := !canceled && ((err != nil && b.config.FailOn(err)) || (b.config.SlowCall > 0 && duration > b.config.SlowCall))
+
+	b.Lock()
+
+	// call admitted before the last state change, e.g. late trial of former half-open period
+	if gen != c.gen {
+		b.Unlock()
+		return
+	}
+
+	var changes []stateChange
+
+	if trial {
+		c.trials--
+	}
+
+	switch {
+	case canceled:
+	case c.state == BreakerHalfOpen && trial:
+		if failed {
+			changes = append(changes, b.transit(key, c, BreakerOpen))
+		} else if c.passed++; c.passed >= b.config.HalfOpenCalls {
+			changes = append(changes, b.transit(key, c, BreakerClosed))
+		}
+	case c.state == BreakerClosed:
+		bucket := c.bucket(time.Now(), b.config.Window)
+
+		bucket.calls++
+
+		if failed {
+			bucket.failures++
+		}
+
+		calls, failures := c.count(time.Now(), b.config.Window)
+
+		if calls >= b.config.MinCalls && float64(failures) >= b.config.FailureRate*float64(calls) {
+			changes = append(changes, b.transit(key, c, BreakerOpen))
+		}
+	}
+
+	b.Unlock()
+
+	b.notify(changes)
+}
+
+// transit change circuit state, must be called with lock held
+func (b *breaker) transit(key string, c *circuit, state BreakerState) stateChange {
+	change := stateChange{key: key, from: c.state, to: state}
+
+	c.state = state
+	c.trials = 0
+	c.passed = 0
+	c.gen++
+
+	switch state {
+	case BreakerOpen:
+		c.openedAt = time.Now()
+	case BreakerClosed:
+		c.buckets = [breakerBuckets]breakerBucket{}
+	}
+
+	return change
+}
+
+func (b *breaker) notify(changes []stateChange) {
+	if b.config.OnStateChange == nil {
+		return
+	}
+
+	for _, change := range changes {
+		b.config.OnStateChange(change.key, change.from, change.to)
+	}
+}
+
+// bucket get bucket of now in rolling window, stale bucket is reset
+func (c *circuit) bucket(now time.Time, window time.Duration) *breakerBucket {
+	width := window / breakerBuckets
+
+	start := now.Truncate(width)
+
+	bucket := &c.buckets[(start.UnixNano()/int64(width))%breakerBuckets]
+
+	if !bucket.start.Equal(start) {
+		*bucket = breakerBucket{start: start}
+	}
+
+	return bucket
+}
+
+// count calls and failures in rolling window
+func (c *circuit) count(now time.Time, window time.Duration) (calls int, failures int) {
+	for _, bucket := range c.buckets {
+		if now.Sub(bucket.start) < window {
+			calls += bucket.calls
+			failures += bucket.failures
+		}
+	}
+
+	return calls, failures
+}
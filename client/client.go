@@ -3,11 +3,14 @@ package client
 import (
 	"context"
 	"encoding/json"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/libs4go/errors"
 	"github.com/libs4go/jsonrpc"
+	"github.com/libs4go/jsonrpc/metrics"
+	"github.com/libs4go/jsonrpc/trace"
 	"github.com/libs4go/jsonrpc/transport"
 	"github.com/libs4go/slf4go"
 )
@@ -23,7 +26,7 @@ func (result *Result) Cancel() {
 }
 
 func (result *Result) Join(resultObject interface{}) error {
-	resp, err := result.client.send(result.ctx, result.req)
+	resp, err := result.client.call(result.ctx, result.req)
 
 	if err != nil {
 		return err
@@ -47,16 +50,32 @@ func (result *Result) Join(resultObject interface{}) error {
 	return nil
 }
 
+// NotificationHandler handle notification pushed by server
+type NotificationHandler func(method string, params json.RawMessage)
+
 // Client jsonrpc client object
 type Client struct {
 	sync.Mutex
 	slf4go.Logger
-	Transport jsonrpc.ClientTransport            // Client transport
-	seq       uint                               // request seq
-	waitQ     map[uint]chan *jsonrpc.RPCResponse // waitQ
-	timeout   time.Duration                      // rpc global timeout
+	Transport jsonrpc.ClientTransport   // Client transport
+	seq       uint                      // request seq
+	waitQ     map[uint]chan *callResult // waitQ
+	timeout   time.Duration             // rpc global timeout
 	ctx       context.Context
 	cancelF   context.CancelFunc
+	notify    NotificationHandler // server push handler
+	closeErr  error               // reason of transport closing
+	subs      map[string]*Subscription
+	orphans   map[string][]json.RawMessage // notifications arrived before subscription registered
+	httpOps   []transport.HTTPClientOps
+	wsOps     []transport.WebSocketOps
+	unixOps   []transport.UnixClientOps
+	metrics   metrics.Sink
+	transport string // transport name of metrics label
+	tracer    trace.Tracer
+	meta      bool // send request meta over transports without headers
+	retries   []*RetryPolicy
+	breaker   *breaker
 }
 
 // ClientOpt .
@@ -83,6 +102,65 @@ func ClientTimeout(duration time.Duration) ClientOpt {
 	}
 }
 
+// ClientNotification set server push notification handler
+func ClientNotification(handler NotificationHandler) ClientOpt {
+	return func(client *Client) {
+		client.notify = handler
+	}
+}
+
+// HTTPTransportOps set http transport options used by HTTPConnect
+func HTTPTransportOps(ops ...transport.HTTPClientOps) ClientOpt {
+	return func(client *Client) {
+		client.httpOps = append(client.httpOps, ops...)
+	}
+}
+
+// WebSocketTransportOps set websocket transport options used by WebSocketConnect
+func WebSocketTransportOps(ops ...transport.WebSocketOps) ClientOpt {
+	return func(client *Client) {
+		client.wsOps = append(client.wsOps, ops...)
+	}
+}
+
+// UnixTransportOps set unix transport options used by UnixConnect
+func UnixTransportOps(ops ...transport.UnixClientOps) ClientOpt {
+	return func(client *Client) {
+		client.unixOps = append(client.unixOps, ops...)
+	}
+}
+
+// ClientMetrics record call metrics to sink
+func ClientMetrics(sink metrics.Sink) ClientOpt {
+	return func(client *Client) {
+		client.metrics = sink
+	}
+}
+
+// ClientTracer create client span of each call, trace context of call ctx is propagated
+// to server whether the tracer is set or not, see ClientMeta for transports without headers
+func ClientTracer(tracer trace.Tracer) ClientOpt {
+	return func(client *Client) {
+		client.tracer = tracer
+	}
+}
+
+// ClientMeta propagate trace context and caller remaining timeout over transports without headers
+// (websocket, unix, pipe) by the meta member of request, which strict JSON-RPC 2.0 peers may reject.
+// Http transport always sends them as headers
+func ClientMeta() ClientOpt {
+	return func(client *Client) {
+		client.meta = true
+	}
+}
+
+// transportName set transport name of metrics label
+func transportName(name string) ClientOpt {
+	return func(client *Client) {
+		client.transport = name
+	}
+}
+
 func clientNullCheck(client *Client) error {
 	if client.Transport == nil {
 		return errors.Wrap(jsonrpc.ErrTransport, "expect transport ops")
@@ -96,18 +174,29 @@ func clientNullCheck(client *Client) error {
 }
 
 func New(options ...ClientOpt) (jsonrpc.Client, error) {
+	return newClient(options...).start()
+}
 
+func newClient(options ...ClientOpt) *Client {
 	client := &Client{
-		Logger:  slf4go.Get("JSONRPC-CLIENT"),
-		waitQ:   make(map[uint]chan *jsonrpc.RPCResponse),
-		timeout: time.Second * 60,
-		seq:     1,
+		Logger:    slf4go.Get("JSONRPC-CLIENT"),
+		waitQ:     make(map[uint]chan *callResult),
+		timeout:   time.Second * 60,
+		seq:       1,
+		subs:      make(map[string]*Subscription),
+		orphans:   make(map[string][]json.RawMessage),
+		metrics:   metrics.Discard,
+		transport: "custom",
 	}
 
 	for _, opt := range options {
 		opt(client)
 	}
 
+	return client
+}
+
+func (client *Client) start() (jsonrpc.Client, error) {
 	if err := clientNullCheck(client); err != nil {
 		return nil, err
 	}
@@ -117,6 +206,14 @@ func New(options ...ClientOpt) (jsonrpc.Client, error) {
 	client.ctx = newCtx
 	client.cancelF = cancelF
 
+	if notifier, ok := client.Transport.(jsonrpc.ConnStateNotifier); ok {
+		notifier.AddConnStateListener(client.onConnState)
+	}
+
+	if notifier, ok := client.Transport.(jsonrpc.CallErrorNotifier); ok {
+		notifier.AddCallErrorListener(client.failCall)
+	}
+
 	go client.runLoop()
 
 	return client, nil
@@ -131,6 +228,10 @@ func (client *Client) runLoop() {
 		case buff, ok := <-client.Transport.Recv():
 
 			if !ok {
+				client.Lock()
+				client.closeErr = errors.Wrap(jsonrpc.ErrDisconnect, "transport closed")
+				client.Unlock()
+				client.cancelF()
 				client.clear()
 				return
 			}
@@ -139,9 +240,18 @@ func (client *Client) runLoop() {
 				continue
 			}
 
+			var notification *pushMessage
+
+			err := json.Unmarshal(buff, &notification)
+
+			if err == nil && notification != nil && notification.Method != "" {
+				client.handleNotification(notification)
+				continue
+			}
+
 			var resp *jsonrpc.RPCResponse
 
-			err := json.Unmarshal(buff, &resp)
+			err = json.Unmarshal(buff, &resp)
 
 			if err != nil {
 				client.E("unmarshal resp {@buff} err {@err}", buff, err)
@@ -157,20 +267,78 @@ func (client *Client) runLoop() {
 				continue
 			}
 
-			client.sendResult(result, resp)
+			client.sendResult(result, &callResult{resp: resp})
 		}
 	}
 
 }
 
-func (client *Client) sendResult(result chan *jsonrpc.RPCResponse, resp *jsonrpc.RPCResponse) {
+// callResult response or transport error of pending call
+type callResult struct {
+	resp *jsonrpc.RPCResponse
+	err  error
+}
+
+func (client *Client) onConnState(state jsonrpc.ConnState, err error) {
+	switch state {
+	case jsonrpc.ConnDisconnected:
+		client.failPending(errors.Wrap(jsonrpc.ErrDisconnect, "connection lost, %v", err))
+	case jsonrpc.ConnConnected:
+		go client.resubscribe()
+	}
+}
+
+// failPending fail all in-flight calls with err
+func (client *Client) failPending(err error) {
+	client.Lock()
+	waitQ := client.waitQ
+	client.waitQ = make(map[uint]chan *callResult)
+	client.Unlock()
+
+	client.metrics.AddGauge(metrics.ClientPending, metrics.Labels{"transport": client.transport}, -float64(len(waitQ)))
+
+	for _, result := range waitQ {
+		client.sendResult(result, &callResult{err: err})
+	}
+}
+
+// failCall fail in-flight call with err
+func (client *Client) failCall(id uint, err error) {
+	if result, ok := client.tryGetWait(id); ok {
+		client.sendResult(result, &callResult{err: err})
+	}
+}
+
+// pushMessage server push notification
+type pushMessage struct {
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+func (client *Client) handleNotification(notification *pushMessage) {
+	client.D("recv remote notification {@method}", notification.Method)
+
+	if notification.Method == jsonrpc.SubscriptionMethod {
+		client.handleSubscription(notification.Params)
+		return
+	}
+
+	if client.notify == nil {
+		client.W("drop notification {@method}, handler not set", notification.Method)
+		return
+	}
+
+	client.notify(notification.Method, notification.Params)
+}
+
+func (client *Client) sendResult(result chan *callResult, r *callResult) {
 	defer func() {
 		if err := recover(); err != nil {
-			client.E("send resp {@resp} error {@err}", resp, err)
+			client.E("send resp {@resp} error {@err}", r.resp, err)
 		}
 	}()
 
-	result <- resp
+	result <- r
 }
 
 func (client *Client) clear() {
@@ -227,15 +395,67 @@ func (client *Client) Notification(ctx context.Context, method string, args ...i
 	return client.Transport.Send(ctx, buff)
 }
 
-func (client *Client) send(ctx context.Context, req *jsonrpc.RPCRequest) (*jsonrpc.RPCResponse, error) {
+// closedError returns the reason of client closing
+func (client *Client) closedError() error {
+	client.Lock()
+	defer client.Unlock()
+
+	if client.closeErr != nil {
+		return client.closeErr
+	}
+
+	return jsonrpc.ErrClose
+}
+
+func (client *Client) send(ctx context.Context, req *jsonrpc.RPCRequest) (resp *jsonrpc.RPCResponse, err error) {
+
+	if client.ctx.Err() != nil {
+		return nil, errors.Wrap(client.closedError(), "client closed")
+	}
+
+	start := time.Now()
+
+	ctx, endSpan := client.startSpan(ctx, req.Method)
+
+	defer func() {
+		endSpan(resp, err)
+		client.observe(req.Method, start, resp, err)
+	}()
+
+	req.Meta = nil
+
+	// server applies the smaller of caller remaining timeout and its own timeout
+	deadline := start.Add(client.timeout)
+
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+
+	if headerTransport, ok := client.Transport.(jsonrpc.HeaderTransport); ok && headerTransport.HeaderMeta() {
+		ctx = jsonrpc.WithCallDeadline(ctx, deadline)
+	} else if client.meta {
+		setMeta := func(key, value string) {
+			if req.Meta == nil {
+				req.Meta = make(map[string]string)
+			}
+
+			req.Meta[key] = value
+		}
+
+		trace.Inject(ctx, setMeta)
+
+		setMeta(jsonrpc.TimeoutMeta, jsonrpc.FormatTimeout(time.Until(deadline)))
+	}
 
-	result := make(chan *jsonrpc.RPCResponse)
+	result := make(chan *callResult, 1)
 	client.Lock()
 	seq := client.seq
 	client.waitQ[client.seq] = result
 	client.seq = seq + 1
 	client.Unlock()
 
+	client.metrics.AddGauge(metrics.ClientPending, metrics.Labels{"transport": client.transport}, 1)
+
 	req.ID = &seq
 
 	client.D("jsonrpc call {@request}", req)
@@ -243,6 +463,7 @@ func (client *Client) send(ctx context.Context, req *jsonrpc.RPCRequest) (*jsonr
 	buff, err := json.Marshal(req)
 
 	if err != nil {
+		client.tryGetWait(seq)
 		return nil, errors.Wrap(err, "marshal request error")
 	}
 
@@ -259,20 +480,20 @@ func (client *Client) send(ctx context.Context, req *jsonrpc.RPCRequest) (*jsonr
 	select {
 	case <-client.ctx.Done():
 		client.tryGetWait(seq)
-		return nil, errors.Wrap(jsonrpc.ErrClose, "cancel RPC %d by closing client", seq)
+		return nil, errors.Wrap(client.closedError(), "cancel RPC %d by closing client", seq)
 	case <-timer.C:
 		client.tryGetWait(seq)
 		return nil, errors.Wrap(jsonrpc.ErrTimeout, "RPC %d timeout", seq)
 	case <-ctx.Done():
 		client.tryGetWait(seq)
 		return nil, errors.Wrap(ctx.Err(), "RPC %d canceled", seq)
-	case resp := <-result:
+	case r := <-result:
 		client.tryGetWait(seq)
-		return resp, nil
+		return r.resp, r.err
 	}
 }
 
-func (client *Client) tryGetWait(seq uint) (chan *jsonrpc.RPCResponse, bool) {
+func (client *Client) tryGetWait(seq uint) (chan *callResult, bool) {
 	client.Lock()
 	defer client.Unlock()
 
@@ -280,29 +501,100 @@ func (client *Client) tryGetWait(seq uint) (chan *jsonrpc.RPCResponse, bool) {
 
 	if ok {
 		delete(client.waitQ, seq)
+		client.metrics.AddGauge(metrics.ClientPending, metrics.Labels{"transport": client.transport}, -1)
 	}
 
 	return result, ok
 }
 
+// startSpan start client span of call, the returned function ends the span
+func (client *Client) startSpan(ctx context.Context, method string) (context.Context, func(resp *jsonrpc.RPCResponse, err error)) {
+	if client.tracer == nil {
+		return ctx, func(resp *jsonrpc.RPCResponse, err error) {}
+	}
+
+	ctx, span := client.tracer.Start(ctx, method, trace.SpanKindClient)
+
+	span.SetAttribute("rpc.system", "jsonrpc")
+	span.SetAttribute("rpc.method", method)
+	span.SetAttribute("rpc.transport", client.transport)
+
+	return ctx, func(resp *jsonrpc.RPCResponse, err error) {
+		if err == nil && resp != nil && resp.Error != nil {
+			span.SetAttribute("rpc.jsonrpc.error_code", int(resp.Error.Code))
+			err = resp.Error
+		}
+
+		span.End(err)
+	}
+}
+
+// observe record metrics of finished call
+func (client *Client) observe(method string, start time.Time, resp *jsonrpc.RPCResponse, err error) {
+	code := "ok"
+
+	switch {
+	case errors.Is(err, jsonrpc.ErrTimeout):
+		code = "timeout"
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		code = "canceled"
+	case err != nil:
+		code = "error"
+	case resp != nil && resp.Error != nil:
+		code = strconv.Itoa(int(resp.Error.Code))
+	}
+
+	client.metrics.AddCounter(metrics.ClientRequests, metrics.Labels{"method": method, "code": code, "transport": client.transport}, 1)
+	client.metrics.Observe(metrics.ClientRequestDuration, metrics.Labels{"method": method, "transport": client.transport}, time.Since(start).Seconds())
+}
+
 // NewHTTPClient create jsonrpc client over http/https
 func HTTPConnect(serviceURL string, opts ...ClientOpt) (jsonrpc.Client, error) {
-	transport, err := transport.NewHTTPClientTransport(serviceURL)
+	client := newClient(opts...)
+
+	client.transport = "http"
+
+	transport, err := transport.NewHTTPClientTransport(serviceURL, client.httpOps...)
 
 	if err != nil {
 		return nil, err
 	}
 
-	return New(append(opts, ClientTrans(transport))...)
+	client.Transport = transport
+
+	return client.start()
 }
 
 // NewWebSocket create jsonrpc client over websocket
 func WebSocketConnect(serviceURL string, opts ...ClientOpt) (jsonrpc.Client, error) {
-	transport, err := transport.NewWebSocketClientTransport(serviceURL)
+	client := newClient(opts...)
+
+	client.transport = "ws"
+
+	transport, err := transport.NewWebSocketClientTransport(serviceURL, client.wsOps...)
 
 	if err != nil {
 		return nil, err
 	}
 
-	return New(append(opts, ClientTrans(transport))...)
+	client.Transport = transport
+
+	return client.start()
+}
+
+// UnixConnect create jsonrpc client over unix domain socket
+func UnixConnect(path string, opts ...ClientOpt) (jsonrpc.Client, error) {
+	client := newClient(opts...)
+
+	client.transport = "unix"
+
+	transport, err := transport.NewUnixClientTransport(path, client.unixOps...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	client.Transport = transport
+
+	return client.start()
 }
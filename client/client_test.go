@@ -0,0 +1,731 @@
+package client_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libs4go/errors"
+	"github.com/libs4go/jsonrpc"
+	"github.com/libs4go/jsonrpc/client"
+	"github.com/libs4go/jsonrpc/server"
+	"github.com/libs4go/jsonrpc/transport"
+	"github.com/libs4go/slf4go"
+	"github.com/stretchr/testify/require"
+)
+
+type rpcServer struct {
+}
+
+func (s *rpcServer) SayHello(msg string, code int) (string, error) {
+	return msg, nil
+}
+
+func (s *rpcServer) Tick(ctx context.Context) (string, error) {
+	sub, err := server.NewSubscription(ctx)
+
+	if err != nil {
+		return "", err
+	}
+
+	go func() {
+		ticker := time.NewTicker(10 * time.Millisecond)
+		defer ticker.Stop()
+
+		for i := 0; ; i++ {
+			select {
+			case <-sub.Done():
+				return
+			case <-ticker.C:
+				if err := sub.Notify(context.Background(), i); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	return sub.ID, nil
+}
+
+// trackListener record accepted connections, so test can drop them
+type trackListener struct {
+	net.Listener
+	sync.Mutex
+	conns []net.Conn
+}
+
+func (listener *trackListener) Accept() (net.Conn, error) {
+	conn, err := listener.Listener.Accept()
+
+	if err == nil {
+		listener.Lock()
+		listener.conns = append(listener.conns, conn)
+		listener.Unlock()
+	}
+
+	return conn, err
+}
+
+func (listener *trackListener) dropAll() {
+	listener.Lock()
+	defer listener.Unlock()
+
+	for _, conn := range listener.conns {
+		conn.Close()
+	}
+
+	listener.conns = nil
+}
+
+type replicaServer struct {
+	name    string
+	release chan struct{}
+}
+
+func (s *replicaServer) Name() (string, error) {
+	return s.name, nil
+}
+
+func (s *replicaServer) Owner(key string) (string, error) {
+	return s.name, nil
+}
+
+func (s *replicaServer) Hold() (string, error) {
+	<-s.release
+	return s.name, nil
+}
+
+type flakyServer struct {
+	sync.Mutex
+	attempts  int
+	failUntil int
+}
+
+func (s *flakyServer) attempt() int {
+	s.Lock()
+	defer s.Unlock()
+
+	s.attempts++
+
+	return s.attempts
+}
+
+func (s *flakyServer) count() int {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.attempts
+}
+
+func (s *flakyServer) reset(failUntil int) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.attempts = 0
+	s.failUntil = failUntil
+}
+
+// Flaky hangs until server timeout before the failUntil attempt
+func (s *flakyServer) Flaky(ctx context.Context) (int, error) {
+	s.Lock()
+	failUntil := s.failUntil
+	s.Unlock()
+
+	attempt := s.attempt()
+
+	if attempt <= failUntil {
+		<-ctx.Done()
+		return 0, ctx.Err()
+	}
+
+	return attempt, nil
+}
+
+func (s *flakyServer) Unsafe(ctx context.Context) (int, error) {
+	return s.Flaky(ctx)
+}
+
+type trialServer struct {
+	started chan struct{}
+}
+
+func (s *trialServer) Trial(ctx context.Context, fail bool, delay int) (bool, error) {
+	s.started <- struct{}{}
+
+	time.Sleep(time.Duration(delay) * time.Millisecond)
+
+	if fail {
+		return false, fmt.Errorf("trial failed")
+	}
+
+	return true, nil
+}
+
+func TestWebsocketReconnect(t *testing.T) {
+
+	defer slf4go.Sync()
+
+	handler, err := server.ServeWebSocket(&rpcServer{})
+
+	require.NoError(t, err)
+
+	httpServer := httptest.NewUnstartedServer(handler)
+
+	listener := &trackListener{Listener: httpServer.Listener}
+
+	httpServer.Listener = listener
+
+	httpServer.Start()
+
+	defer httpServer.Close()
+
+	states := make(chan jsonrpc.ConnState, 10)
+
+	c, err := client.WebSocketConnect("ws"+strings.TrimPrefix(httpServer.URL, "http"), client.WebSocketTransportOps(
+		transport.WebSocketReconnect(transport.ReconnectPolicy{MinBackoff: 10 * time.Millisecond, Offline: transport.OfflineQueue}),
+		transport.WebSocketOnStateChange(func(state jsonrpc.ConnState, err error) {
+			states <- state
+		}),
+	))
+
+	require.NoError(t, err)
+
+	ticks := make(chan int, 100)
+
+	sub, err := c.(*client.Client).Subscribe(context.Background(), "Tick", func(result json.RawMessage) {
+		var tick int
+
+		json.Unmarshal(result, &tick)
+
+		select {
+		case ticks <- tick:
+		default:
+		}
+	})
+
+	require.NoError(t, err)
+
+	<-ticks
+
+	oldID := sub.ID()
+
+	listener.dropAll()
+
+	require.Equal(t, jsonrpc.ConnDisconnected, <-states)
+	require.Equal(t, jsonrpc.ConnConnecting, <-states)
+	require.Equal(t, jsonrpc.ConnConnected, <-states)
+
+	for tick := range ticks {
+		if tick == 0 {
+			break
+		}
+	}
+
+	require.NotEqual(t, oldID, sub.ID())
+
+	var echo string
+
+	err = c.Call(context.Background(), "SayHello", "Hello", 1).Join(&echo)
+
+	require.NoError(t, err)
+
+	require.Equal(t, "Hello", echo)
+
+	require.NoError(t, sub.Unsubscribe(context.Background()))
+}
+
+func TestPool(t *testing.T) {
+
+	defer slf4go.Sync()
+
+	release := make(chan struct{})
+
+	var httpServers []*transport.HTTPServer
+	var urls, wsURLs []string
+
+	for _, name := range []string{"a", "b", "c"} {
+		rpcServer, err := server.New(&replicaServer{name: name, release: release})
+
+		require.NoError(t, err)
+
+		httpServer := transport.ServeHTTP(rpcServer)
+
+		httpServers = append(httpServers, httpServer)
+
+		testServer := httptest.NewServer(httpServer)
+
+		defer testServer.Close()
+
+		urls = append(urls, testServer.URL)
+
+		wsServer := httptest.NewServer(transport.ServeWebSocket(rpcServer))
+
+		defer wsServer.Close()
+
+		wsURLs = append(wsURLs, "ws"+strings.TrimPrefix(wsServer.URL, "http"))
+	}
+
+	call := func(c jsonrpc.Client, method string, args ...interface{}) string {
+		var name string
+		require.NoError(t, c.Call(context.Background(), method, args...).Join(&name))
+		return name
+	}
+
+	// round robin
+	rr, err := client.HTTPPoolConnect(urls, client.PoolConfig{})
+
+	require.NoError(t, err)
+
+	counts := make(map[string]int)
+
+	for i := 0; i < 6; i++ {
+		counts[call(rr, "Name")]++
+	}
+
+	require.Equal(t, map[string]int{"a": 2, "b": 2, "c": 2}, counts)
+
+	// consistent hash
+	hash, err := client.HTTPPoolConnect(urls, client.PoolConfig{Balancer: client.BalanceConsistentHash})
+
+	require.NoError(t, err)
+
+	owners := make(map[string]string)
+
+	for _, key := range []string{"alice", "bob", "carol", "dave"} {
+		owners[key] = call(hash, "Owner", key)
+	}
+
+	for i := 0; i < 3; i++ {
+		for key, owner := range owners {
+			require.Equal(t, owner, call(hash, "Owner", key))
+		}
+	}
+
+	// least pending
+	lp, err := client.WebSocketPoolConnect(wsURLs, client.PoolConfig{Balancer: client.BalanceLeastPending})
+
+	require.NoError(t, err)
+
+	defer lp.(*client.Client).Close()
+
+	held := make(chan string, 2)
+
+	for i := 0; i < 2; i++ {
+		go func() {
+			held <- call(lp, "Hold")
+		}()
+	}
+
+	require.Eventually(t, func() bool {
+		pending := 0
+
+		for _, status := range lp.(*client.Client).Transport.(*client.Pool).Endpoints() {
+			pending += status.Pending
+		}
+
+		return pending == 2
+	}, time.Second, 10*time.Millisecond)
+
+	idle := ""
+
+	for _, status := range lp.(*client.Client).Transport.(*client.Pool).Endpoints() {
+		if status.Pending == 0 {
+			idle = status.Name
+		}
+	}
+
+	require.NotEmpty(t, idle)
+
+	for i := 0; i < 3; i++ {
+		require.Equal(t, idle, wsURLs[strings.Index("abc", call(lp, "Name"))])
+	}
+
+	close(release)
+
+	require.NotEqual(t, <-held, <-held)
+
+	// failover of shutting down and unreachable endpoints, then ejection
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+
+	defer cancel()
+
+	require.NoError(t, httpServers[0].Shutdown(ctx))
+
+	failover, err := client.HTTPPoolConnect(append(urls, "http://127.0.0.1:1"), client.PoolConfig{MaxFailures: 2})
+
+	require.NoError(t, err)
+
+	for i := 0; i < 8; i++ {
+		require.NotEqual(t, "a", call(failover, "Name"))
+	}
+
+	for _, status := range failover.(*client.Client).Transport.(*client.Pool).Endpoints() {
+		switch status.Name {
+		case urls[0], "http://127.0.0.1:1":
+			require.True(t, status.Ejected, status.Name)
+		default:
+			require.False(t, status.Ejected, status.Name)
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+
+	defer slf4go.Sync()
+
+	flaky := &flakyServer{}
+
+	var idsMutex sync.Mutex
+	var ids []uint
+
+	rpcServer, err := server.New(flaky, server.ServerTimeout(30*time.Millisecond), server.ServerInterceptor(func(ctx context.Context, req *jsonrpc.RPCRequest, next server.Invoker) *jsonrpc.RPCError {
+		idsMutex.Lock()
+		ids = append(ids, *req.ID)
+		idsMutex.Unlock()
+
+		return next(ctx)
+	}))
+
+	require.NoError(t, err)
+
+	pipe := transport.NewPipe(rpcServer)
+
+	defer pipe.Close()
+
+	c, err := client.New(client.ClientTrans(pipe), client.ClientRetry(client.RetryPolicy{
+		Methods:     []string{"Flak*"},
+		MaxAttempts: 3,
+		MinBackoff:  10 * time.Millisecond,
+	}))
+
+	require.NoError(t, err)
+
+	var attempt int
+
+	// retried with fresh request id for each attempt
+	flaky.reset(2)
+
+	require.NoError(t, c.Call(context.Background(), "Flaky").Join(&attempt))
+
+	require.Equal(t, 3, attempt)
+	require.Len(t, ids, 3)
+	require.NotEqual(t, ids[0], ids[1])
+	require.NotEqual(t, ids[1], ids[2])
+
+	// give up after max attempts
+	flaky.reset(3)
+
+	err = c.Call(context.Background(), "Flaky").Join(&attempt)
+
+	rpcErr, ok := err.(*jsonrpc.RPCError)
+
+	require.True(t, ok)
+	require.Equal(t, jsonrpc.RPCTimeout, rpcErr.Code)
+	require.Equal(t, 3, flaky.count())
+
+	// methods not opted in are never retried
+	flaky.reset(1)
+
+	require.Error(t, c.Call(context.Background(), "Unsafe").Join(&attempt))
+	require.Equal(t, 1, flaky.count())
+
+	// retries respect ctx deadline
+	slowPipe := transport.NewPipe(rpcServer)
+
+	defer slowPipe.Close()
+
+	slowRetry, err := client.New(client.ClientTrans(slowPipe), client.ClientRetry(client.RetryPolicy{
+		Methods:     []string{"Flaky"},
+		MaxAttempts: 10,
+		MinBackoff:  time.Second,
+	}))
+
+	require.NoError(t, err)
+
+	flaky.reset(10)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+
+	defer cancel()
+
+	start := time.Now()
+
+	require.Error(t, slowRetry.Call(ctx, "Flaky").Join(&attempt))
+	require.Less(t, int64(time.Since(start)), int64(200*time.Millisecond))
+	require.Equal(t, 1, flaky.count())
+}
+
+func TestRetryHTTP(t *testing.T) {
+
+	defer slf4go.Sync()
+
+	flaky := &flakyServer{}
+
+	// the first request is answered by a shutting down server with 503 and RPCShuttingDown
+	stopping, err := server.ServeHTPP(flaky)
+
+	require.NoError(t, err)
+
+	require.NoError(t, stopping.Shutdown(context.Background()))
+
+	serving, err := server.ServeHTPP(flaky)
+
+	require.NoError(t, err)
+
+	var requestsMutex sync.Mutex
+	var requests int
+
+	httpServer := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		requestsMutex.Lock()
+		requests++
+		first := requests == 1
+		requestsMutex.Unlock()
+
+		if first {
+			stopping.ServeHTTP(writer, request)
+			return
+		}
+
+		serving.ServeHTTP(writer, request)
+	}))
+
+	defer httpServer.Close()
+
+	c, err := client.HTTPConnect(httpServer.URL, client.ClientRetry(client.RetryPolicy{
+		Methods:    []string{"Flaky"},
+		MinBackoff: 10 * time.Millisecond,
+	}))
+
+	require.NoError(t, err)
+
+	var attempt int
+
+	require.NoError(t, c.Call(context.Background(), "Flaky").Join(&attempt))
+
+	require.Equal(t, 1, attempt)
+
+	requestsMutex.Lock()
+	defer requestsMutex.Unlock()
+
+	require.Equal(t, 2, requests)
+}
+
+func TestBreaker(t *testing.T) {
+
+	defer slf4go.Sync()
+
+	flaky := &flakyServer{}
+
+	rpcServer, err := server.New(flaky, server.ServerTimeout(20*time.Millisecond))
+
+	require.NoError(t, err)
+
+	pipe := transport.NewPipe(rpcServer)
+
+	defer pipe.Close()
+
+	var changesMutex sync.Mutex
+	var changes []string
+
+	c, err := client.New(client.ClientTrans(pipe), client.ClientBreaker(client.BreakerConfig{
+		MinCalls:     4,
+		FailureRate:  0.5,
+		OpenDuration: 100 * time.Millisecond,
+		OnStateChange: func(key string, from, to client.BreakerState) {
+			changesMutex.Lock()
+			defer changesMutex.Unlock()
+
+			changes = append(changes, key+":"+from.String()+"->"+to.String())
+		},
+	}))
+
+	require.NoError(t, err)
+
+	breaker := c.(*client.Client)
+
+	var attempt int
+
+	flaky.reset(100)
+
+	for i := 0; i < 4; i++ {
+		err := c.Call(context.Background(), "Flaky").Join(&attempt)
+
+		rpcErr, ok := err.(*jsonrpc.RPCError)
+
+		require.True(t, ok)
+		require.Equal(t, jsonrpc.RPCTimeout, rpcErr.Code)
+	}
+
+	require.Equal(t, client.BreakerOpen, breaker.BreakerState("Flaky"))
+	require.Equal(t, client.BreakerClosed, breaker.BreakerState("Unsafe"))
+
+	// fail fast while open
+	start := time.Now()
+
+	err = c.Call(context.Background(), "Flaky").Join(&attempt)
+
+	require.True(t, errors.Is(err, jsonrpc.ErrCircuitOpen))
+	require.Less(t, int64(time.Since(start)), int64(20*time.Millisecond))
+	require.Equal(t, 4, flaky.count())
+
+	halfOpen := func() bool {
+		return breaker.BreakerState("Flaky") == client.BreakerHalfOpen
+	}
+
+	// failed trial call re-opens circuit
+	require.Eventually(t, halfOpen, time.Second, 5*time.Millisecond)
+
+	require.Error(t, c.Call(context.Background(), "Flaky").Join(&attempt))
+
+	require.Equal(t, client.BreakerOpen, breaker.BreakerState("Flaky"))
+
+	// succeeded trial call closes circuit
+	require.Eventually(t, halfOpen, time.Second, 5*time.Millisecond)
+
+	flaky.reset(0)
+
+	require.NoError(t, c.Call(context.Background(), "Flaky").Join(&attempt))
+
+	require.Equal(t, client.BreakerClosed, breaker.BreakerState("Flaky"))
+
+	changesMutex.Lock()
+	defer changesMutex.Unlock()
+
+	require.Equal(t, []string{
+		"Flaky:closed->open",
+		"Flaky:open->half-open",
+		"Flaky:half-open->open",
+		"Flaky:open->half-open",
+		"Flaky:half-open->closed",
+	}, changes)
+}
+
+func TestBreakerHalfOpen(t *testing.T) {
+
+	defer slf4go.Sync()
+
+	trials := &trialServer{started: make(chan struct{}, 10)}
+
+	rpcServer, err := server.New(trials)
+
+	require.NoError(t, err)
+
+	// trials must run concurrently, pipe dispatches one request at a time
+	wsServer := httptest.NewServer(transport.ServeWebSocket(rpcServer))
+
+	defer wsServer.Close()
+
+	c, err := client.WebSocketConnect("ws"+strings.TrimPrefix(wsServer.URL, "http"), client.ClientBreaker(client.BreakerConfig{
+		MinCalls:      2,
+		FailureRate:   0.5,
+		OpenDuration:  50 * time.Millisecond,
+		HalfOpenCalls: 2,
+		FailOn: func(err error) bool {
+			return err != nil
+		},
+	}))
+
+	require.NoError(t, err)
+
+	breaker := c.(*client.Client)
+
+	trial := func(fail bool, delay int) <-chan error {
+		done := make(chan error, 1)
+
+		go func() {
+			var passed bool
+
+			done <- c.Call(context.Background(), "Trial", fail, delay).Join(&passed)
+		}()
+
+		return done
+	}
+
+	halfOpen := func() bool {
+		return breaker.BreakerState("Trial") == client.BreakerHalfOpen
+	}
+
+	for i := 0; i < 2; i++ {
+		require.Error(t, <-trial(true, 0))
+		<-trials.started
+	}
+
+	require.Equal(t, client.BreakerOpen, breaker.BreakerState("Trial"))
+
+	require.Eventually(t, halfOpen, time.Second, 5*time.Millisecond)
+
+	// concurrent trials, the failed one re-opens circuit before the slow one succeeds
+	slow := trial(false, 150)
+
+	<-trials.started
+
+	require.Error(t, <-trial(true, 0))
+	<-trials.started
+
+	require.Equal(t, client.BreakerOpen, breaker.BreakerState("Trial"))
+
+	require.Eventually(t, halfOpen, time.Second, 5*time.Millisecond)
+
+	// trial of the next half-open period is in-flight when the stale trial succeeds
+	next := trial(false, 200)
+
+	require.NoError(t, <-slow)
+
+	require.NoError(t, <-next)
+
+	// one succeeded trial of the current period is not enough to close circuit
+	require.Equal(t, client.BreakerHalfOpen, breaker.BreakerState("Trial"))
+
+	require.NoError(t, <-trial(false, 0))
+
+	require.Equal(t, client.BreakerClosed, breaker.BreakerState("Trial"))
+}
+
+func TestBreakerPerEndpoint(t *testing.T) {
+
+	defer slf4go.Sync()
+
+	rpcServer, err := server.New(&trialServer{started: make(chan struct{}, 10)})
+
+	require.NoError(t, err)
+
+	pipe := transport.NewPipe(rpcServer)
+
+	defer pipe.Close()
+
+	// single endpoint client, the circuit of the client is the circuit of the endpoint
+	c, err := client.New(client.ClientTrans(pipe), client.ClientBreaker(client.BreakerConfig{
+		Key:          client.BreakerPerEndpoint,
+		MinCalls:     2,
+		FailureRate:  0.5,
+		OpenDuration: time.Minute,
+		FailOn: func(err error) bool {
+			return err != nil
+		},
+	}))
+
+	require.NoError(t, err)
+
+	breaker := c.(*client.Client)
+
+	var passed bool
+
+	for i := 0; i < 2; i++ {
+		require.Error(t, c.Call(context.Background(), "Trial", true, 0).Join(&passed))
+	}
+
+	// failures of one method break calls of all methods
+	require.Equal(t, client.BreakerOpen, breaker.BreakerState("Trial"))
+	require.Equal(t, client.BreakerOpen, breaker.BreakerState("Other"))
+
+	err = c.Call(context.Background(), "Other").Join(&passed)
+
+	require.True(t, errors.Is(err, jsonrpc.ErrCircuitOpen))
+}
@@ -0,0 +1,845 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/libs4go/errors"
+	"github.com/libs4go/jsonrpc"
+	"github.com/libs4go/jsonrpc/transport"
+	"github.com/libs4go/slf4go"
+)
+
+// Balancer endpoint selection strategy of Pool
+type Balancer int
+
+const (
+	BalanceRoundRobin     Balancer = iota // endpoints in turn
+	BalanceLeastPending                   // endpoint with fewest in-flight calls
+	BalanceConsistentHash                 // endpoint chosen by hash of call param, calls with equal param go to the same endpoint
+)
+
+// PoolConfig pooled transport settings
+type PoolConfig struct {
+	Balancer       Balancer
+	HashParam      int                      // index of call param hashed by BalanceConsistentHash, calls without it are balanced round-robin
+	Replicas       int                      // virtual nodes of each endpoint on hash ring, default 64
+	MaxFailures    int                      // consecutive failures ejecting endpoint, default 3
+	EjectDuration  time.Duration            // ejected endpoint is not selected until duration elapsed, default 10s
+	PendingTimeout time.Duration            // call without response is forgotten and counted as endpoint failure, default 60s
+	Idempotent     func(method string) bool // methods re-sent to another endpoint even if the failed endpoint may have received them
+}
+
+// PoolEndpoint named transport of one endpoint
+type PoolEndpoint struct {
+	Name      string
+	Transport jsonrpc.ClientTransport
+}
+
+// EndpointStatus health of pool endpoint
+type EndpointStatus struct {
+	Name      string
+	Connected bool // false after transport disconnected, until reconnected
+	Ejected   bool // ejected by consecutive failures
+	Pending   int  // in-flight calls
+	Failures  int  // consecutive failures
+}
+
+type poolEndpoint struct {
+	PoolEndpoint
+	pending      int
+	failures     int
+	ejectedUntil time.Time
+	down         bool // disconnected
+	closed       bool // recv channel closed, never selected again
+}
+
+type poolCall struct {
+	ctx      context.Context
+	id       *uint
+	method   string
+	buff     []byte
+	key      []byte // consistent hash key, nil if call has no hash param
+	endpoint *poolEndpoint
+	tried    map[*poolEndpoint]bool
+	sent     time.Time
+}
+
+type ringNode struct {
+	hash     uint32
+	endpoint *poolEndpoint
+}
+
+// Pool client transport balancing calls over multiple endpoints.
+//
+// Endpoints failing consecutively are ejected for a while (passive health tracking). Calls which never
+// reached the failed endpoint (send refused, server busy or shutting down) fail over to another endpoint,
+// calls which may have reached it fail over only if the method is idempotent (see PoolConfig.Idempotent),
+// otherwise they fail with jsonrpc.ErrDisconnect.
+//
+// Subscriptions are bound to the endpoint which created them, and are ended with error notification
+// (see Subscription.Err) when the endpoint connection is lost.
+type Pool struct {
+	sync.Mutex
+	slf4go.Logger
+	config        PoolConfig
+	endpoints     []*poolEndpoint
+	ring          []ringNode
+	next          int
+	pending       map[uint]*poolCall
+	subs          map[string]*poolEndpoint // subscription owners learned from notifications
+	available     bool
+	listeners     []func(state jsonrpc.ConnState, err error)
+	callListeners []func(id uint, err error)
+	recv          chan []byte
+	recvMutex     sync.RWMutex
+	recvClosed    bool
+	done          chan struct{}
+	closeOnce     sync.Once
+}
+
+// NewPool create pooled transport of endpoints
+func NewPool(endpoints []PoolEndpoint, config PoolConfig) (*Pool, error) {
+	if len(endpoints) == 0 {
+		return nil, errors.Wrap(jsonrpc.ErrTransport, "expect pool endpoints")
+	}
+
+	if config.Replicas <= 0 {
+		config.Replicas = 64
+	}
+
+	if config.MaxFailures <= 0 {
+		config.MaxFailures = 3
+	}
+
+	if config.EjectDuration <= 0 {
+		config.EjectDuration = 10 * time.Second
+	}
+
+	if config.PendingTimeout <= 0 {
+		config.PendingTimeout = time.Minute
+	}
+
+	pool := &Pool{
+		Logger:    slf4go.Get("JSONRPC-CLIENT-POOL"),
+		config:    config,
+		pending:   make(map[uint]*poolCall),
+		subs:      make(map[string]*poolEndpoint),
+		available: true,
+		recv:      make(chan []byte),
+		done:      make(chan struct{}),
+	}
+
+	for i, endpoint := range endpoints {
+		if endpoint.Name == "" {
+			endpoint.Name = strconv.Itoa(i)
+		}
+
+		e := &poolEndpoint{PoolEndpoint: endpoint}
+
+		pool.endpoints = append(pool.endpoints, e)
+
+		for r := 0; r < config.Replicas; r++ {
+			pool.ring = append(pool.ring, ringNode{hash: hashKey([]byte(e.Name + "#" + strconv.Itoa(r))), endpoint: e})
+		}
+	}
+
+	sort.Slice(pool.ring, func(i, j int) bool {
+		return pool.ring[i].hash < pool.ring[j].hash
+	})
+
+	for _, e := range pool.endpoints {
+		if notifier, ok := e.Transport.(jsonrpc.ConnStateNotifier); ok {
+			e := e
+			notifier.AddConnStateListener(func(state jsonrpc.ConnState, err error) {
+				pool.onEndpointState(e, state, err)
+			})
+		}
+
+		go pool.runLoop(e)
+	}
+
+	go pool.sweepLoop()
+
+	return pool, nil
+}
+
+func hashKey(key []byte) uint32 {
+	h := fnv.New32a()
+	h.Write(key)
+	return h.Sum32()
+}
+
+// AddConnStateListener implement jsonrpc.ConnStateNotifier, pool is disconnected only if all endpoints are
+func (pool *Pool) AddConnStateListener(listener func(state jsonrpc.ConnState, err error)) {
+	pool.Lock()
+	defer pool.Unlock()
+
+	pool.listeners = append(pool.listeners, listener)
+}
+
+// AddCallErrorListener implement jsonrpc.CallErrorNotifier
+func (pool *Pool) AddCallErrorListener(listener func(id uint, err error)) {
+	pool.Lock()
+	defer pool.Unlock()
+
+	pool.callListeners = append(pool.callListeners, listener)
+}
+
+// HeaderMeta implement jsonrpc.HeaderTransport, true if all endpoints carry request meta in headers
+func (pool *Pool) HeaderMeta() bool {
+	for _, e := range pool.endpoints {
+		if headerTransport, ok := e.Transport.(jsonrpc.HeaderTransport); !ok || !headerTransport.HeaderMeta() {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Endpoints health status of endpoints
+func (pool *Pool) Endpoints() []EndpointStatus {
+	pool.Lock()
+	defer pool.Unlock()
+
+	now := time.Now()
+
+	status := make([]EndpointStatus, 0, len(pool.endpoints))
+
+	for _, e := range pool.endpoints {
+		status = append(status, EndpointStatus{
+			Name:      e.Name,
+			Connected: !e.down && !e.closed,
+			Ejected:   now.Before(e.ejectedUntil),
+			Pending:   e.pending,
+			Failures:  e.failures,
+		})
+	}
+
+	return status
+}
+
+func (pool *Pool) Recv() <-chan []byte {
+	return pool.recv
+}
+
+// Close close all endpoint transports
+func (pool *Pool) Close() error {
+	pool.closeOnce.Do(func() {
+		close(pool.done)
+	})
+
+	var err error
+
+	for _, e := range pool.endpoints {
+		switch closer := e.Transport.(type) {
+		case jsonrpc.ClientTransportCloser:
+			if closeErr := closer.Close(); closeErr != nil && err == nil {
+				err = closeErr
+			}
+		case interface{ Close() }:
+			closer.Close()
+		}
+	}
+
+	pool.closeRecv()
+
+	return err
+}
+
+func (pool *Pool) closeRecv() {
+	pool.closeOnce.Do(func() {
+		close(pool.done)
+	})
+
+	pool.recvMutex.Lock()
+	defer pool.recvMutex.Unlock()
+
+	if !pool.recvClosed {
+		pool.recvClosed = true
+		close(pool.recv)
+	}
+}
+
+// deliver forward message to client
+func (pool *Pool) deliver(buff []byte) {
+	pool.recvMutex.RLock()
+	defer pool.recvMutex.RUnlock()
+
+	if pool.recvClosed {
+		return
+	}
+
+	select {
+	case pool.recv <- buff:
+	case <-pool.done:
+	}
+}
+
+func (pool *Pool) Send(ctx context.Context, buff []byte) error {
+	var request struct {
+		ID     *uint           `json:"id"`
+		Method string          `json:"method"`
+		Params json.RawMessage `json:"params"`
+	}
+
+	call := &poolCall{
+		ctx:   ctx,
+		buff:  buff,
+		tried: make(map[*poolEndpoint]bool),
+	}
+
+	if err := json.Unmarshal(buff, &request); err == nil {
+		call.id = request.ID
+		call.method = request.Method
+
+		var params []json.RawMessage
+
+		if json.Unmarshal(request.Params, &params) == nil && pool.config.HashParam >= 0 && pool.config.HashParam < len(params) {
+			call.key = params[pool.config.HashParam]
+		}
+
+		if request.Method == jsonrpc.UnsubscribeMethod && len(params) != 0 {
+			var id string
+
+			if json.Unmarshal(params[0], &id) == nil {
+				pool.Lock()
+				call.endpoint = pool.subs[id]
+				delete(pool.subs, id)
+				pool.Unlock()
+			}
+		}
+	}
+
+	return pool.send(call)
+}
+
+// send send call to selected endpoint, failing over to other endpoints
+func (pool *Pool) send(call *poolCall) error {
+	var lastErr error
+
+	for {
+		e, err := pool.pick(call)
+
+		if err != nil {
+			if lastErr != nil {
+				return lastErr
+			}
+
+			return err
+		}
+
+		err = e.Transport.Send(call.ctx, call.buff)
+
+		if err == nil {
+			return nil
+		}
+
+		pool.D("send {@method} to endpoint {@name} error {@err}", call.method, e.Name, err)
+
+		pool.Lock()
+		pool.untrack(call, e)
+		pool.failure(e)
+		pool.Unlock()
+
+		if call.ctx.Err() != nil || (!undelivered(err) && !pool.idempotent(call.method)) {
+			return err
+		}
+
+		lastErr = err
+	}
+}
+
+func (pool *Pool) idempotent(method string) bool {
+	return pool.config.Idempotent != nil && pool.config.Idempotent(method)
+}
+
+// undelivered check if send error guarantees the request was not processed by endpoint
+func undelivered(err error) bool {
+	if errors.Is(err, jsonrpc.ErrDisconnect) || errors.Is(err, jsonrpc.ErrClose) || errors.Is(err, jsonrpc.ErrOverflow) {
+		return true
+	}
+
+	var httpErr *transport.HTTPError
+
+	if errors.As(err, &httpErr) {
+		return httpErr.StatusCode == http.StatusServiceUnavailable || httpErr.StatusCode == http.StatusTooManyRequests
+	}
+
+	// connection refused before request written
+	cause := errors.Unwrap(err)
+
+	if urlErr, ok := cause.(*url.Error); ok {
+		cause = urlErr.Err
+	}
+
+	opErr, ok := cause.(*net.OpError)
+
+	return ok && opErr.Op == "dial"
+}
+
+// pick select endpoint of call and register call in-flight
+func (pool *Pool) pick(call *poolCall) (*poolEndpoint, error) {
+	pool.Lock()
+	defer pool.Unlock()
+
+	now := time.Now()
+
+	var candidates, healthy []*poolEndpoint
+
+	for _, e := range pool.endpoints {
+		if e.down || e.closed || call.tried[e] {
+			continue
+		}
+
+		candidates = append(candidates, e)
+
+		if !now.Before(e.ejectedUntil) {
+			healthy = append(healthy, e)
+		}
+	}
+
+	// all endpoints ejected, try ejected ones rather than failing
+	if len(healthy) == 0 {
+		healthy = candidates
+	}
+
+	if len(healthy) == 0 {
+		return nil, errors.Wrap(jsonrpc.ErrDisconnect, "no available endpoint")
+	}
+
+	var e *poolEndpoint
+
+	// subscription owner of unsubscribe call
+	if call.endpoint != nil && len(call.tried) == 0 && containsEndpoint(healthy, call.endpoint) {
+		e = call.endpoint
+	} else if pool.config.Balancer == BalanceConsistentHash && call.key != nil {
+		e = pool.hashPick(call.key, healthy)
+	} else if pool.config.Balancer == BalanceLeastPending {
+		e = pool.leastPendingPick(healthy)
+	} else {
+		e = pool.roundRobinPick(healthy)
+	}
+
+	call.tried[e] = true
+	call.endpoint = e
+	call.sent = now
+
+	if call.id != nil {
+		e.pending++
+		pool.pending[*call.id] = call
+	}
+
+	return e, nil
+}
+
+func containsEndpoint(endpoints []*poolEndpoint, e *poolEndpoint) bool {
+	for _, candidate := range endpoints {
+		if candidate == e {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (pool *Pool) roundRobinPick(candidates []*poolEndpoint) *poolEndpoint {
+	for i := 0; i < len(pool.endpoints); i++ {
+		index := (pool.next + i) % len(pool.endpoints)
+
+		if containsEndpoint(candidates, pool.endpoints[index]) {
+			pool.next = index + 1
+			return pool.endpoints[index]
+		}
+	}
+
+	return candidates[0]
+}
+
+func (pool *Pool) leastPendingPick(candidates []*poolEndpoint) *poolEndpoint {
+	var selected *poolEndpoint
+
+	// scan in round-robin order so ties are spread
+	for i := 0; i < len(pool.endpoints); i++ {
+		e := pool.endpoints[(pool.next+i)%len(pool.endpoints)]
+
+		if containsEndpoint(candidates, e) && (selected == nil || e.pending < selected.pending) {
+			selected = e
+		}
+	}
+
+	pool.next++
+
+	return selected
+}
+
+func (pool *Pool) hashPick(key []byte, candidates []*poolEndpoint) *poolEndpoint {
+	hash := hashKey(key)
+
+	start := sort.Search(len(pool.ring), func(i int) bool {
+		return pool.ring[i].hash >= hash
+	})
+
+	for i := 0; i < len(pool.ring); i++ {
+		node := pool.ring[(start+i)%len(pool.ring)]
+
+		if containsEndpoint(candidates, node.endpoint) {
+			return node.endpoint
+		}
+	}
+
+	return candidates[0]
+}
+
+// untrack remove in-flight call of endpoint, returns false if the call is not in-flight on the endpoint
+func (pool *Pool) untrack(call *poolCall, e *poolEndpoint) bool {
+	if call.id == nil || pool.pending[*call.id] != call || call.endpoint != e {
+		return false
+	}
+
+	delete(pool.pending, *call.id)
+	e.pending--
+
+	return true
+}
+
+func (pool *Pool) failure(e *poolEndpoint) {
+	e.failures++
+
+	if e.failures >= pool.config.MaxFailures {
+		pool.W("eject endpoint {@name} for {@duration} after {@failures} consecutive failures", e.Name, pool.config.EjectDuration.String(), e.failures)
+		e.ejectedUntil = time.Now().Add(pool.config.EjectDuration)
+		e.failures = 0
+	}
+}
+
+func (pool *Pool) success(e *poolEndpoint) {
+	e.failures = 0
+	e.ejectedUntil = time.Time{}
+}
+
+// hasCandidate check if call can fail over to other endpoint
+func (pool *Pool) hasCandidate(call *poolCall) bool {
+	for _, e := range pool.endpoints {
+		if !e.down && !e.closed && !call.tried[e] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// failover re-send call to other endpoint in background, the call fails if no endpoint accepts it
+func (pool *Pool) failover(call *poolCall, cause error) {
+	go func() {
+		if err := pool.send(call); err != nil {
+			pool.failCall(*call.id, errors.Wrap(err, "failover after %v", cause))
+		}
+	}()
+}
+
+func (pool *Pool) failCall(id uint, err error) {
+	pool.Lock()
+	listeners := pool.callListeners
+	pool.Unlock()
+
+	for _, listener := range listeners {
+		listener(id, err)
+	}
+}
+
+// runLoop forward messages of endpoint to client
+func (pool *Pool) runLoop(e *poolEndpoint) {
+	for buff := range e.Transport.Recv() {
+		pool.handle(e, buff)
+	}
+
+	pool.onEndpointState(e, jsonrpc.ConnClosed, nil)
+}
+
+func (pool *Pool) handle(e *poolEndpoint, buff []byte) {
+	var message struct {
+		ID     *uint             `json:"id"`
+		Method string            `json:"method"`
+		Params json.RawMessage   `json:"params"`
+		Error  *jsonrpc.RPCError `json:"error"`
+	}
+
+	if err := json.Unmarshal(buff, &message); err != nil {
+		pool.deliver(buff)
+		return
+	}
+
+	if message.Method != "" {
+		if message.Method == jsonrpc.SubscriptionMethod {
+			pool.trackSubscription(e, message.Params)
+		}
+
+		pool.deliver(buff)
+		return
+	}
+
+	if message.ID == nil {
+		pool.deliver(buff)
+		return
+	}
+
+	pool.Lock()
+
+	call, ok := pool.pending[*message.ID]
+
+	if ok && call.endpoint != e {
+		pool.Unlock()
+		pool.D("drop stale resp {@id} of endpoint {@name}", *message.ID, e.Name)
+		return
+	}
+
+	if ok {
+		pool.untrack(call, e)
+
+		// endpoint refused the call without processing it
+		if message.Error != nil && (message.Error.Code == jsonrpc.RPCServerBusy || message.Error.Code == jsonrpc.RPCShuttingDown) {
+			pool.failure(e)
+
+			if call.ctx.Err() == nil && pool.hasCandidate(call) {
+				pool.Unlock()
+				pool.failover(call, message.Error)
+				return
+			}
+		} else {
+			pool.success(e)
+		}
+	}
+
+	pool.Unlock()
+
+	pool.deliver(buff)
+}
+
+func (pool *Pool) trackSubscription(e *poolEndpoint, params json.RawMessage) {
+	var notification struct {
+		ID    string            `json:"subscription"`
+		Error *jsonrpc.RPCError `json:"error"`
+	}
+
+	if json.Unmarshal(params, &notification) != nil || notification.ID == "" {
+		return
+	}
+
+	pool.Lock()
+	defer pool.Unlock()
+
+	if notification.Error != nil {
+		delete(pool.subs, notification.ID)
+	} else {
+		pool.subs[notification.ID] = e
+	}
+}
+
+func (pool *Pool) onEndpointState(e *poolEndpoint, state jsonrpc.ConnState, err error) {
+	pool.Lock()
+
+	switch state {
+	case jsonrpc.ConnConnected:
+		e.down = false
+		pool.success(e)
+	case jsonrpc.ConnDisconnected, jsonrpc.ConnClosed:
+		e.down = true
+		e.closed = e.closed || state == jsonrpc.ConnClosed
+	default:
+		pool.Unlock()
+		return
+	}
+
+	pool.I("endpoint {@name} state {@state}", e.Name, state.String())
+
+	var lost []*poolCall
+
+	if e.down {
+		for _, call := range pool.pending {
+			if call.endpoint == e {
+				lost = append(lost, call)
+			}
+		}
+
+		for _, call := range lost {
+			pool.untrack(call, e)
+		}
+	}
+
+	var subs []string
+
+	for id, owner := range pool.subs {
+		if owner == e && e.down {
+			subs = append(subs, id)
+			delete(pool.subs, id)
+		}
+	}
+
+	available, closed := false, true
+
+	for _, endpoint := range pool.endpoints {
+		available = available || !endpoint.down
+		closed = closed && endpoint.closed
+	}
+
+	changed := available != pool.available
+	pool.available = available
+
+	listeners := pool.listeners
+
+	pool.Unlock()
+
+	cause := errors.Wrap(jsonrpc.ErrDisconnect, "endpoint %s connection lost, %v", e.Name, err)
+
+	for _, call := range lost {
+		if call.ctx.Err() == nil && pool.idempotent(call.method) {
+			pool.failover(call, cause)
+		} else {
+			pool.failCall(*call.id, cause)
+		}
+	}
+
+	for _, id := range subs {
+		pool.endSubscription(id, e)
+	}
+
+	if closed {
+		for _, listener := range listeners {
+			listener(jsonrpc.ConnClosed, err)
+		}
+
+		pool.closeRecv()
+
+		return
+	}
+
+	if changed {
+		poolState := jsonrpc.ConnDisconnected
+
+		if available {
+			poolState = jsonrpc.ConnConnected
+		}
+
+		for _, listener := range listeners {
+			listener(poolState, err)
+		}
+	}
+}
+
+// endSubscription push final notification of subscription lost with endpoint connection
+func (pool *Pool) endSubscription(id string, e *poolEndpoint) {
+	buff, err := json.Marshal(&jsonrpc.RPCNotification{
+		JSONRPC: "2.0",
+		Method:  jsonrpc.SubscriptionMethod,
+		Params: &jsonrpc.SubscriptionResult{
+			ID:    id,
+			Error: &jsonrpc.RPCError{Code: jsonrpc.RPCServerError, Message: "endpoint " + e.Name + " connection lost"},
+		},
+	})
+
+	if err != nil {
+		pool.E("marshal subscription end notification error {@err}", err)
+		return
+	}
+
+	pool.deliver(buff)
+}
+
+// sweepLoop forget in-flight calls without response after PendingTimeout
+func (pool *Pool) sweepLoop() {
+	ticker := time.NewTicker(pool.config.PendingTimeout / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-pool.done:
+			return
+		case now := <-ticker.C:
+			pool.Lock()
+
+			for _, call := range pool.pending {
+				if now.Sub(call.sent) > pool.config.PendingTimeout && pool.untrack(call, call.endpoint) {
+					pool.D("forget call {@id} of endpoint {@name} without resp", *call.id, call.endpoint.Name)
+					pool.failure(call.endpoint)
+				}
+			}
+
+			pool.Unlock()
+		}
+	}
+}
+
+// HTTPPoolConnect create jsonrpc client balancing calls over http endpoints
+func HTTPPoolConnect(serviceURLs []string, config PoolConfig, opts ...ClientOpt) (jsonrpc.Client, error) {
+	client := newClient(opts...)
+
+	client.transport = "http"
+
+	var endpoints []PoolEndpoint
+
+	for _, serviceURL := range serviceURLs {
+		endpoint, err := transport.NewHTTPClientTransport(serviceURL, client.httpOps...)
+
+		if err != nil {
+			return nil, err
+		}
+
+		endpoints = append(endpoints, PoolEndpoint{Name: serviceURL, Transport: endpoint})
+	}
+
+	pool, err := NewPool(endpoints, config)
+
+	if err != nil {
+		return nil, err
+	}
+
+	client.Transport = pool
+
+	return client.start()
+}
+
+// WebSocketPoolConnect create jsonrpc client balancing calls over websocket endpoints
+func WebSocketPoolConnect(serviceURLs []string, config PoolConfig, opts ...ClientOpt) (jsonrpc.Client, error) {
+	client := newClient(opts...)
+
+	client.transport = "ws"
+
+	var endpoints []PoolEndpoint
+
+	closeAll := func() {
+		for _, endpoint := range endpoints {
+			endpoint.Transport.(jsonrpc.ClientTransportCloser).Close()
+		}
+	}
+
+	for _, serviceURL := range serviceURLs {
+		endpoint, err := transport.NewWebSocketClientTransport(serviceURL, client.wsOps...)
+
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+
+		endpoints = append(endpoints, PoolEndpoint{Name: serviceURL, Transport: endpoint})
+	}
+
+	pool, err := NewPool(endpoints, config)
+
+	if err != nil {
+		closeAll()
+		return nil, err
+	}
+
+	client.Transport = pool
+
+	return client.start()
+}
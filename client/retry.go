@@ -0,0 +1,227 @@
+package client
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"path"
+	"time"
+
+	"github.com/libs4go/errors"
+	"github.com/libs4go/jsonrpc"
+	"github.com/libs4go/jsonrpc/transport"
+)
+
+// RetryPredicate check if failed attempt should be retried, err is transport error or *jsonrpc.RPCError
+type RetryPredicate func(err error) bool
+
+// RetryOnTransport retry attempts failed by timeout or lost connection
+func RetryOnTransport(err error) bool {
+	return errors.Is(err, jsonrpc.ErrTimeout) || errors.Is(err, jsonrpc.ErrDisconnect) || errors.Is(err, jsonrpc.ErrOverflow)
+}
+
+// RetryOnCodes retry attempts failed with rpc error of codes, including rpc errors carried by *transport.HTTPError
+func RetryOnCodes(codes ...jsonrpc.RPCErrorCode) RetryPredicate {
+	return func(err error) bool {
+		rpcErr := rpcErrorOf(err)
+
+		if rpcErr == nil {
+			return false
+		}
+
+		for _, code := range codes {
+			if rpcErr.Code == code {
+				return true
+			}
+		}
+
+		return false
+	}
+}
+
+// rpcErrorOf get rpc error of call failure, nil if failure carries no rpc error
+func rpcErrorOf(err error) *jsonrpc.RPCError {
+	var rpcErr *jsonrpc.RPCError
+
+	if errors.As(err, &rpcErr) {
+		return rpcErr
+	}
+
+	var httpErr *transport.HTTPError
+
+	if errors.As(err, &httpErr) {
+		return httpErr.RPCError
+	}
+
+	return nil
+}
+
+// DefaultRetryOn retry transport errors and rpc errors of calls rejected without processing or timed out by server
+var DefaultRetryOn = []RetryPredicate{
+	RetryOnTransport,
+	RetryOnCodes(jsonrpc.RPCServerBusy, jsonrpc.RPCShuttingDown, jsonrpc.RPCTimeout),
+}
+
+// RetryPolicy retry settings of idempotent methods, methods are opt-in and never retried unless matched
+type RetryPolicy struct {
+	Methods     []string         // idempotent method names or glob patterns, e.g. "eth_get*"
+	MaxAttempts int              // max attempts including the first one, default 3
+	MinBackoff  time.Duration    // backoff before the first retry, default 100ms
+	MaxBackoff  time.Duration    // max backoff, default 5s
+	Multiplier  float64          // backoff multiplier, default 2
+	Jitter      float64          // backoff randomization factor in [0, 1], default 0.2
+	RetryOn     []RetryPredicate // attempt is retried if any predicate matches, default DefaultRetryOn
+}
+
+func (policy *RetryPolicy) match(method string) bool {
+	for _, pattern := range policy.Methods {
+		if pattern == method {
+			return true
+		}
+
+		if matched, err := path.Match(pattern, method); err == nil && matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (policy *RetryPolicy) retryable(err error) bool {
+	for _, predicate := range policy.RetryOn {
+		if predicate(err) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (policy *RetryPolicy) backoff(attempt int) time.Duration {
+	backoff := float64(policy.MinBackoff) * math.Pow(policy.Multiplier, float64(attempt))
+
+	if backoff > float64(policy.MaxBackoff) {
+		backoff = float64(policy.MaxBackoff)
+	}
+
+	backoff = backoff * (1 + policy.Jitter*(rand.Float64()*2-1))
+
+	return time.Duration(backoff)
+}
+
+// ClientRetry append retry policies, the first policy matching the method applies.
+// Each attempt is sent with a fresh request id, and retries never outlive the call ctx deadline
+func ClientRetry(policies ...RetryPolicy) ClientOpt {
+	return func(client *Client) {
+		for _, policy := range policies {
+			if policy.MaxAttempts <= 0 {
+				policy.MaxAttempts = 3
+			}
+
+			if policy.MinBackoff <= 0 {
+				policy.MinBackoff = time.Millisecond * 100
+			}
+
+			if policy.MaxBackoff <= 0 {
+				policy.MaxBackoff = time.Second * 5
+			}
+
+			if policy.Multiplier < 1 {
+				policy.Multiplier = 2
+			}
+
+			if policy.Jitter <= 0 || policy.Jitter > 1 {
+				policy.Jitter = 0.2
+			}
+
+			if len(policy.RetryOn) == 0 {
+				policy.RetryOn = DefaultRetryOn
+			}
+
+			policy := policy
+
+			client.retries = append(client.retries, &policy)
+		}
+	}
+}
+
+// retryPolicy get retry policy of method, returns nil if method is not retried
+func (client *Client) retryPolicy(method string) *RetryPolicy {
+	for _, policy := range client.retries {
+		if policy.match(method) {
+			return policy
+		}
+	}
+
+	return nil
+}
+
+// call send request, retrying failed attempts by retry policy of method, circuit breaker guards each attempt
+func (client *Client) call(ctx context.Context, req *jsonrpc.RPCRequest) (*jsonrpc.RPCResponse, error) {
+	policy := client.retryPolicy(req.Method)
+
+	for attempt := 0; ; attempt++ {
+		resp, err := client.attempt(ctx, req)
+
+		if policy == nil || attempt+1 >= policy.MaxAttempts {
+			return resp, err
+		}
+
+		failure := callFailure(resp, err)
+
+		if failure == nil || !policy.retryable(failure) {
+			return resp, err
+		}
+
+		backoff := policy.backoff(attempt)
+
+		// give up if the next attempt would start after ctx deadline
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(backoff).After(deadline) {
+			return resp, err
+		}
+
+		client.D("retry {@method} after {@backoff}, attempt {@attempt} failed {@err}", req.Method, backoff.String(), attempt+1, failure.Error())
+
+		timer := time.NewTimer(backoff)
+
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return resp, err
+		case <-client.ctx.Done():
+			timer.Stop()
+			return resp, err
+		}
+	}
+}
+
+// attempt send request once, guarded by circuit breaker
+func (client *Client) attempt(ctx context.Context, req *jsonrpc.RPCRequest) (*jsonrpc.RPCResponse, error) {
+	if client.breaker == nil {
+		return client.send(ctx, req)
+	}
+
+	record, err := client.breaker.allow(req.Method)
+
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+
+	resp, err := client.send(ctx, req)
+
+	record(callFailure(resp, err), time.Since(start))
+
+	return resp, err
+}
+
+// callFailure get transport error or rpc error of call, nil if succeeded
+func callFailure(resp *jsonrpc.RPCResponse, err error) error {
+	if err == nil && resp.Error != nil {
+		return resp.Error
+	}
+
+	return err
+}
@@ -0,0 +1,203 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	"github.com/libs4go/errors"
+	"github.com/libs4go/jsonrpc"
+)
+
+// maxOrphans max buffered subscriptions not registered yet, and max buffered notifications of each one
+const maxOrphans = 100
+
+// SubscriptionHandler handle subscription notification result
+type SubscriptionHandler func(result json.RawMessage)
+
+// Subscription client side subscription, active subscriptions are re-established after transport reconnected
+type Subscription struct {
+	sync.Mutex
+	client  *Client
+	method  string
+	args    []interface{}
+	handler SubscriptionHandler
+	id      string
+	err     chan error
+}
+
+// Subscribe call subscribe method which returns subscription id, the notifications of the subscription are
+// dispatched to handler in order
+func (client *Client) Subscribe(ctx context.Context, method string, handler SubscriptionHandler, args ...interface{}) (*Subscription, error) {
+	sub := &Subscription{
+		client:  client,
+		method:  method,
+		args:    args,
+		handler: handler,
+		err:     make(chan error, 1),
+	}
+
+	if err := sub.subscribe(ctx); err != nil {
+		return nil, err
+	}
+
+	return sub, nil
+}
+
+func (sub *Subscription) subscribe(ctx context.Context) error {
+	var id string
+
+	if err := sub.client.Call(ctx, sub.method, sub.args...).Join(&id); err != nil {
+		return err
+	}
+
+	if id == "" {
+		return errors.Wrap(jsonrpc.ErrServer, "subscribe %s return empty subscription id", sub.method)
+	}
+
+	client := sub.client
+
+	client.Lock()
+
+	sub.Lock()
+	oldID := sub.id
+	sub.id = id
+	sub.Unlock()
+
+	delete(client.subs, oldID)
+	client.subs[id] = sub
+
+	orphans := client.orphans[id]
+	delete(client.orphans, id)
+
+	client.Unlock()
+
+	for _, result := range orphans {
+		sub.handler(result)
+	}
+
+	return nil
+}
+
+// ID current subscription id, changes after re-subscribed
+func (sub *Subscription) ID() string {
+	sub.Lock()
+	defer sub.Unlock()
+
+	return sub.id
+}
+
+// Err receive error of re-subscribing after transport reconnected, or error of subscription ended by server
+func (sub *Subscription) Err() <-chan error {
+	return sub.err
+}
+
+// Unsubscribe cancel subscription
+func (sub *Subscription) Unsubscribe(ctx context.Context) error {
+	id := sub.ID()
+
+	sub.client.Lock()
+	_, ok := sub.client.subs[id]
+	delete(sub.client.subs, id)
+	sub.client.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	var canceled bool
+
+	return sub.client.Call(ctx, jsonrpc.UnsubscribeMethod, id).Join(&canceled)
+}
+
+func (client *Client) handleSubscription(params json.RawMessage) {
+	var notification struct {
+		ID     string            `json:"subscription"`
+		Result json.RawMessage   `json:"result"`
+		Error  *jsonrpc.RPCError `json:"error"`
+	}
+
+	if err := json.Unmarshal(params, &notification); err != nil {
+		client.E("unmarshal subscription notification {@params} error {@err}", string(params), err)
+		return
+	}
+
+	if notification.Error != nil {
+		client.endSubscription(notification.ID, notification.Error)
+		return
+	}
+
+	client.Lock()
+
+	sub, ok := client.subs[notification.ID]
+
+	if !ok {
+		if len(client.orphans) < maxOrphans && len(client.orphans[notification.ID]) < maxOrphans {
+			client.orphans[notification.ID] = append(client.orphans[notification.ID], notification.Result)
+		} else {
+			client.W("drop notification of unknown subscription {@id}", notification.ID)
+		}
+	}
+
+	client.Unlock()
+
+	if ok {
+		sub.handler(notification.Result)
+	}
+}
+
+// endSubscription remove subscription ended by server
+func (client *Client) endSubscription(id string, rpcErr *jsonrpc.RPCError) {
+	client.Lock()
+
+	sub, ok := client.subs[id]
+	delete(client.subs, id)
+	delete(client.orphans, id)
+
+	client.Unlock()
+
+	if !ok {
+		return
+	}
+
+	client.D("subscription {@id} ended by server, {@err}", id, rpcErr.Error())
+
+	select {
+	case sub.err <- rpcErr:
+	default:
+	}
+}
+
+// resubscribe re-establish active subscriptions after transport reconnected
+func (client *Client) resubscribe() {
+	client.Lock()
+
+	var subs []*Subscription
+
+	for _, sub := range client.subs {
+		subs = append(subs, sub)
+	}
+
+	client.orphans = make(map[string][]json.RawMessage)
+
+	client.Unlock()
+
+	for _, sub := range subs {
+		if err := sub.subscribe(client.ctx); err != nil {
+			client.E("resubscribe {@method} error {@err}", sub.method, err)
+
+			client.Lock()
+			delete(client.subs, sub.ID())
+			client.Unlock()
+
+			select {
+			case sub.err <- err:
+			default:
+			}
+
+			continue
+		}
+
+		client.I("resubscribe {@method} success, new subscription {@id}", sub.method, sub.ID())
+	}
+}
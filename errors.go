@@ -7,9 +7,13 @@ const errVendor = "jsonrpc"
 
 // errors
 var (
-	ErrTimeout    = errors.New("RPC timeout", errors.WithVendor(errVendor), errors.WithCode(-1))
-	ErrClose      = errors.New("RPC endpoint closed", errors.WithVendor(errVendor), errors.WithCode(-2))
-	ErrTransport  = errors.New("expect transport", errors.WithVendor(errVendor), errors.WithCode(-3))
-	ErrDispatcher = errors.New("expect dispatcher", errors.WithVendor(errVendor), errors.WithCode(-4))
-	ErrServer     = errors.New("Server type error", errors.WithVendor(errVendor), errors.WithCode(-5))
+	ErrTimeout     = errors.New("RPC timeout", errors.WithVendor(errVendor), errors.WithCode(-1))
+	ErrClose       = errors.New("RPC endpoint closed", errors.WithVendor(errVendor), errors.WithCode(-2))
+	ErrTransport   = errors.New("expect transport", errors.WithVendor(errVendor), errors.WithCode(-3))
+	ErrDispatcher  = errors.New("expect dispatcher", errors.WithVendor(errVendor), errors.WithCode(-4))
+	ErrServer      = errors.New("Server type error", errors.WithVendor(errVendor), errors.WithCode(-5))
+	ErrParse       = errors.New("RPC parse error", errors.WithVendor(errVendor), errors.WithCode(-6))
+	ErrOverflow    = errors.New("outbound queue overflow", errors.WithVendor(errVendor), errors.WithCode(-7))
+	ErrDisconnect  = errors.New("transport disconnected", errors.WithVendor(errVendor), errors.WithCode(-8))
+	ErrCircuitOpen = errors.New("circuit open", errors.WithVendor(errVendor), errors.WithCode(-9))
 )
@@ -3,16 +3,19 @@ package jsonrpc
 import (
 	"context"
 	"fmt"
+	"strconv"
+	"time"
 )
 
 // RPCRequest represents a jsonrpc request object.
 //
 // See: http://www.jsonrpc.org/specification#request_object
 type RPCRequest struct {
-	JSONRPC string      `json:"jsonrpc"`
-	Method  string      `json:"method"`
-	Params  interface{} `json:"params,omitempty"`
-	ID      *uint       `json:"id,omitempty"`
+	JSONRPC string            `json:"jsonrpc"`
+	Method  string            `json:"method"`
+	Params  interface{}       `json:"params,omitempty"`
+	ID      *uint             `json:"id,omitempty"`
+	Meta    map[string]string `json:"meta,omitempty"` // optional envelope extension, e.g. trace context over transports without headers
 }
 
 // RPCNotification represents a jsonrpc notification object.
@@ -64,8 +67,62 @@ const (
 	RPCInvalidParams  RPCErrorCode = -32602
 	RPCInternalError  RPCErrorCode = -32603
 	RPCServerError    RPCErrorCode = -32000
+	RPCServerBusy     RPCErrorCode = -32001
+	RPCUnauthorized   RPCErrorCode = -32002
+	RPCForbidden      RPCErrorCode = -32003
+	RPCRateLimited    RPCErrorCode = -32004
+	RPCShuttingDown   RPCErrorCode = -32005
+	RPCTimeout        RPCErrorCode = -32006
+)
+
+const (
+	// TimeoutMeta request meta key of caller remaining timeout in milliseconds
+	TimeoutMeta = "timeout"
+	// TimeoutHeader http header of caller remaining timeout in milliseconds
+	TimeoutHeader = "Jsonrpc-Timeout"
 )
 
+// FormatTimeout format remaining timeout as TimeoutMeta value, at least 1ms
+func FormatTimeout(timeout time.Duration) string {
+	ms := timeout.Milliseconds()
+
+	if ms < 1 {
+		ms = 1
+	}
+
+	return strconv.FormatInt(ms, 10)
+}
+
+// ParseTimeout parse TimeoutMeta value, returns false if value is empty or invalid
+func ParseTimeout(value string) (time.Duration, bool) {
+	ms, err := strconv.ParseInt(value, 10, 64)
+
+	if err != nil || ms <= 0 {
+		return 0, false
+	}
+
+	return time.Duration(ms) * time.Millisecond, true
+}
+
+type callDeadlineKey struct{}
+
+// WithCallDeadline bind effective deadline of call to ctx passed to ClientTransport.Send, e.g. the smaller
+// of caller ctx deadline and client timeout, HeaderTransport sends it as TimeoutHeader
+func WithCallDeadline(ctx context.Context, deadline time.Time) context.Context {
+	return context.WithValue(ctx, callDeadlineKey{}, deadline)
+}
+
+// CallDeadline get the smaller of call deadline bound by WithCallDeadline and ctx deadline
+func CallDeadline(ctx context.Context) (time.Time, bool) {
+	deadline, ok := ctx.Value(callDeadlineKey{}).(time.Time)
+
+	if ctxDeadline, hasCtxDeadline := ctx.Deadline(); hasCtxDeadline && (!ok || ctxDeadline.Before(deadline)) {
+		return ctxDeadline, true
+	}
+
+	return deadline, ok
+}
+
 type Reply interface {
 	Join(result interface{}) error
 	Cancel()
@@ -83,6 +140,13 @@ type ClientTransport interface {
 	Recv() <-chan []byte
 }
 
+// HeaderTransport client transport carrying request metadata (e.g. trace context, timeout) in protocol headers,
+// requests sent over it omit the meta envelope field
+type HeaderTransport interface {
+	ClientTransport
+	HeaderMeta() bool
+}
+
 type ClientTransportCloser interface {
 	ClientTransport
 	Close() error
@@ -91,3 +155,60 @@ type ClientTransportCloser interface {
 type Server interface {
 	Dispatch(context.Context, []byte) ([]byte, error)
 }
+
+// ServerShutdowner server supporting graceful shutdown
+type ServerShutdowner interface {
+	Server
+	// Shutdown reject new calls and wait for in-flight calls until ctx done
+	Shutdown(ctx context.Context) error
+}
+
+// ConnState connection state of client transport
+type ConnState int
+
+const (
+	ConnConnecting   ConnState = iota // (re)dialing remote
+	ConnConnected                     // connection established
+	ConnDisconnected                  // connection lost
+	ConnClosed                        // transport closed, no more reconnecting
+)
+
+func (state ConnState) String() string {
+	switch state {
+	case ConnConnecting:
+		return "connecting"
+	case ConnConnected:
+		return "connected"
+	case ConnDisconnected:
+		return "disconnected"
+	case ConnClosed:
+		return "closed"
+	}
+
+	return fmt.Sprintf("ConnState(%d)", int(state))
+}
+
+// ConnStateNotifier optional interface implemented by client transport which may reconnect
+type ConnStateNotifier interface {
+	AddConnStateListener(listener func(state ConnState, err error))
+}
+
+// CallErrorNotifier optional interface implemented by client transport which fails in-flight calls individually,
+// e.g. pooled transport losing one of its endpoints
+type CallErrorNotifier interface {
+	AddCallErrorListener(listener func(id uint, err error))
+}
+
+const (
+	// SubscriptionMethod method name of subscription notification pushed by server
+	SubscriptionMethod = "rpc_subscription"
+	// UnsubscribeMethod builtin method cancel subscription, params: [subscription id]
+	UnsubscribeMethod = "rpc_unsubscribe"
+)
+
+// SubscriptionResult params of subscription notification
+type SubscriptionResult struct {
+	ID     string      `json:"subscription"`
+	Result interface{} `json:"result,omitempty"`
+	Error  *RPCError   `json:"error,omitempty"` // set by the final notification of subscription ended by server
+}
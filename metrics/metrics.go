@@ -0,0 +1,45 @@
+// Package metrics jsonrpc client and server instrumentation
+package metrics
+
+// Labels metric labels
+type Labels map[string]string
+
+// Sink metrics sink, implementations must be safe for concurrent use
+type Sink interface {
+	// AddCounter add delta to counter
+	AddCounter(name string, labels Labels, delta float64)
+	// AddGauge add delta to gauge, delta may be negative
+	AddGauge(name string, labels Labels, delta float64)
+	// Observe record value of histogram
+	Observe(name string, labels Labels, value float64)
+}
+
+// metric names
+const (
+	ServerRequests        = "jsonrpc_server_requests_total"
+	ServerRequestDuration = "jsonrpc_server_request_duration_seconds"
+	ServerInFlight        = "jsonrpc_server_in_flight_requests"
+	WebSocketConnections  = "jsonrpc_websocket_connections"
+	ClientRequests        = "jsonrpc_client_requests_total"
+	ClientRequestDuration = "jsonrpc_client_request_duration_seconds"
+	ClientPending         = "jsonrpc_client_pending_requests"
+)
+
+var help = map[string]string{
+	ServerRequests:        "Total jsonrpc calls handled by server.",
+	ServerRequestDuration: "Duration of jsonrpc calls handled by server in seconds.",
+	ServerInFlight:        "Number of jsonrpc calls being handled by server.",
+	WebSocketConnections:  "Number of open websocket server connections.",
+	ClientRequests:        "Total jsonrpc calls sent by client.",
+	ClientRequestDuration: "Duration of jsonrpc calls sent by client in seconds.",
+	ClientPending:         "Number of jsonrpc client calls waiting for response.",
+}
+
+// Discard sink dropping all metrics
+var Discard Sink = discard{}
+
+type discard struct{}
+
+func (discard) AddCounter(name string, labels Labels, delta float64) {}
+func (discard) AddGauge(name string, labels Labels, delta float64)   {}
+func (discard) Observe(name string, labels Labels, value float64)    {}
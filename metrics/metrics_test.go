@@ -0,0 +1,90 @@
+package metrics_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/libs4go/jsonrpc/client"
+	"github.com/libs4go/jsonrpc/metrics"
+	"github.com/libs4go/jsonrpc/server"
+	"github.com/libs4go/jsonrpc/transport"
+	"github.com/libs4go/slf4go"
+	"github.com/stretchr/testify/require"
+)
+
+type rpcServer struct {
+}
+
+func (s *rpcServer) SayHello(msg string, code int) (string, error) {
+	return msg, nil
+}
+
+func (s *rpcServer) ErrorCall() (string, error) {
+	return "", fmt.Errorf("ErrorCall")
+}
+
+func TestMetrics(t *testing.T) {
+
+	defer slf4go.Sync()
+
+	sink := metrics.NewPrometheus()
+
+	rpcServer, err := server.New(&rpcServer{}, server.ServerMetrics(sink))
+
+	require.NoError(t, err)
+
+	httpServer := httptest.NewServer(transport.ServeWebSocket(rpcServer, transport.WebSocketServerMetrics(sink)))
+
+	defer httpServer.Close()
+
+	metricsServer := httptest.NewServer(sink)
+
+	defer metricsServer.Close()
+
+	c, err := client.WebSocketConnect("ws"+strings.TrimPrefix(httpServer.URL, "http"), client.ClientMetrics(sink))
+
+	require.NoError(t, err)
+
+	var echo string
+
+	require.NoError(t, c.Call(context.Background(), "SayHello", "Hello", 1).Join(&echo))
+
+	require.Error(t, c.Call(context.Background(), "ErrorCall").Join(&echo))
+
+	require.Error(t, c.Call(context.Background(), "NotExists").Join(&echo))
+
+	resp, err := http.Get(metricsServer.URL)
+
+	require.NoError(t, err)
+
+	defer resp.Body.Close()
+
+	require.True(t, strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain; version=0.0.4"))
+
+	body, err := io.ReadAll(resp.Body)
+
+	require.NoError(t, err)
+
+	text := string(body)
+
+	for _, line := range []string{
+		"# TYPE jsonrpc_server_requests_total counter",
+		`jsonrpc_server_requests_total{code="ok",method="SayHello",transport="ws"} 1`,
+		`jsonrpc_server_requests_total{code="-32603",method="ErrorCall",transport="ws"} 1`,
+		`jsonrpc_server_requests_total{code="-32600",method="unknown",transport="ws"} 1`,
+		`jsonrpc_server_request_duration_seconds_count{method="SayHello",transport="ws"} 1`,
+		`jsonrpc_server_request_duration_seconds_bucket{method="SayHello",transport="ws",le="+Inf"} 1`,
+		`jsonrpc_server_in_flight_requests{transport="ws"} 0`,
+		"jsonrpc_websocket_connections 1",
+		`jsonrpc_client_requests_total{code="ok",method="SayHello",transport="ws"} 1`,
+		`jsonrpc_client_requests_total{code="-32603",method="ErrorCall",transport="ws"} 1`,
+		`jsonrpc_client_pending_requests{transport="ws"} 0`,
+	} {
+		require.Contains(t, text, line+"\n")
+	}
+}
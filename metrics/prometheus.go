@@ -0,0 +1,241 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets default histogram buckets in seconds
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+const (
+	kindCounter   = "counter"
+	kindGauge     = "gauge"
+	kindHistogram = "histogram"
+)
+
+type series struct {
+	labels string // rendered label pairs without braces
+	value  float64
+	counts []uint64 // histogram bucket counts, not cumulative
+	sum    float64
+	count  uint64
+}
+
+type family struct {
+	kind   string
+	series map[string]*series
+}
+
+// Prometheus in-memory Sink exposing metrics in prometheus text format
+type Prometheus struct {
+	sync.Mutex
+	buckets  []float64
+	families map[string]*family
+}
+
+// NewPrometheus create prometheus sink, histograms use DefaultBuckets if buckets not set
+func NewPrometheus(buckets ...float64) *Prometheus {
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+
+	buckets = append([]float64(nil), buckets...)
+
+	sort.Float64s(buckets)
+
+	return &Prometheus{
+		buckets:  buckets,
+		families: make(map[string]*family),
+	}
+}
+
+// get get or create series, metric of name must keep the same kind
+func (prometheus *Prometheus) get(name string, kind string, labels Labels) *series {
+	f, ok := prometheus.families[name]
+
+	if !ok {
+		f = &family{kind: kind, series: make(map[string]*series)}
+		prometheus.families[name] = f
+	}
+
+	if f.kind != kind {
+		return nil
+	}
+
+	key := renderLabels(labels)
+
+	s, ok := f.series[key]
+
+	if !ok {
+		s = &series{labels: key}
+
+		if kind == kindHistogram {
+			s.counts = make([]uint64, len(prometheus.buckets))
+		}
+
+		f.series[key] = s
+	}
+
+	return s
+}
+
+// AddCounter implement Sink
+func (prometheus *Prometheus) AddCounter(name string, labels Labels, delta float64) {
+	prometheus.Lock()
+	defer prometheus.Unlock()
+
+	if s := prometheus.get(name, kindCounter, labels); s != nil {
+		s.value += delta
+	}
+}
+
+// AddGauge implement Sink
+func (prometheus *Prometheus) AddGauge(name string, labels Labels, delta float64) {
+	prometheus.Lock()
+	defer prometheus.Unlock()
+
+	if s := prometheus.get(name, kindGauge, labels); s != nil {
+		s.value += delta
+	}
+}
+
+// Observe implement Sink
+func (prometheus *Prometheus) Observe(name string, labels Labels, value float64) {
+	prometheus.Lock()
+	defer prometheus.Unlock()
+
+	s := prometheus.get(name, kindHistogram, labels)
+
+	if s == nil {
+		return
+	}
+
+	for i, bound := range prometheus.buckets {
+		if value <= bound {
+			s.counts[i]++
+			break
+		}
+	}
+
+	s.sum += value
+	s.count++
+}
+
+// ServeHTTP write metrics in prometheus text exposition format 0.0.4
+func (prometheus *Prometheus) ServeHTTP(writer http.ResponseWriter, req *http.Request) {
+	writer.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writer.Write(prometheus.Gather())
+}
+
+// Gather render metrics in prometheus text exposition format
+func (prometheus *Prometheus) Gather() []byte {
+	prometheus.Lock()
+	defer prometheus.Unlock()
+
+	var buff bytes.Buffer
+
+	names := make([]string, 0, len(prometheus.families))
+
+	for name := range prometheus.families {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		f := prometheus.families[name]
+
+		if text, ok := help[name]; ok {
+			fmt.Fprintf(&buff, "# HELP %s %s\n", name, text)
+		}
+
+		fmt.Fprintf(&buff, "# TYPE %s %s\n", name, f.kind)
+
+		keys := make([]string, 0, len(f.series))
+
+		for key := range f.series {
+			keys = append(keys, key)
+		}
+
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			s := f.series[key]
+
+			if f.kind != kindHistogram {
+				fmt.Fprintf(&buff, "%s%s %s\n", name, braces(s.labels), formatFloat(s.value))
+				continue
+			}
+
+			var cumulative uint64
+
+			for i, bound := range prometheus.buckets {
+				cumulative += s.counts[i]
+				fmt.Fprintf(&buff, "%s_bucket%s %d\n", name, braces(joinLabels(s.labels, `le="`+formatFloat(bound)+`"`)), cumulative)
+			}
+
+			fmt.Fprintf(&buff, "%s_bucket%s %d\n", name, braces(joinLabels(s.labels, `le="+Inf"`)), s.count)
+			fmt.Fprintf(&buff, "%s_sum%s %s\n", name, braces(s.labels), formatFloat(s.sum))
+			fmt.Fprintf(&buff, "%s_count%s %d\n", name, braces(s.labels), s.count)
+		}
+	}
+
+	return buff.Bytes()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// renderLabels render label pairs sorted by name
+func renderLabels(labels Labels) string {
+	names := make([]string, 0, len(labels))
+
+	for name := range labels {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	pairs := make([]string, len(names))
+
+	for i, name := range names {
+		pairs[i] = name + `="` + labelEscaper.Replace(labels[name]) + `"`
+	}
+
+	return strings.Join(pairs, ",")
+}
+
+func joinLabels(labels string, pair string) string {
+	if labels == "" {
+		return pair
+	}
+
+	return labels + "," + pair
+}
+
+func braces(labels string) string {
+	if labels == "" {
+		return ""
+	}
+
+	return "{" + labels + "}"
+}
+
+func formatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
@@ -0,0 +1,68 @@
+package ratelimit
+
+import (
+	"context"
+	"net"
+	"strconv"
+
+	"github.com/libs4go/jsonrpc"
+	"github.com/libs4go/jsonrpc/auth"
+	"github.com/libs4go/jsonrpc/transport"
+)
+
+// KeyFunc extract client identity of call, calls with the same key share buckets
+type KeyFunc func(ctx context.Context, req *jsonrpc.RPCRequest) string
+
+// ByRemoteIP key calls by remote ip, unix socket peers are keyed by uid
+func ByRemoteIP(ctx context.Context, req *jsonrpc.RPCRequest) string {
+	peer, ok := transport.PeerFromContext(ctx)
+
+	if !ok {
+		return ""
+	}
+
+	if peer.Cred != nil {
+		return "uid:" + strconv.FormatUint(uint64(peer.Cred.UID), 10)
+	}
+
+	host, _, err := net.SplitHostPort(peer.RemoteAddr)
+
+	if err != nil {
+		return "ip:" + peer.RemoteAddr
+	}
+
+	return "ip:" + host
+}
+
+// ByConnection key calls by transport session, http transport creates one session for each request
+// so ByConnection only makes sense for stream transports
+func ByConnection(ctx context.Context, req *jsonrpc.RPCRequest) string {
+	session, ok := transport.SessionFromContext(ctx)
+
+	if !ok {
+		return ""
+	}
+
+	return "conn:" + session.ID()
+}
+
+// ByPrincipal key calls by authenticated principal (see auth.Interceptor), anonymous calls are keyed by remote ip
+func ByPrincipal(ctx context.Context, req *jsonrpc.RPCRequest) string {
+	if principal, ok := auth.PrincipalFromContext(ctx); ok {
+		return "principal:" + principal.Scheme + ":" + principal.Subject
+	}
+
+	return ByRemoteIP(ctx, req)
+}
+
+// ByAPIKey key calls by principal authenticated with api key (see auth.APIKeys), other calls are keyed by remote ip.
+//
+// The api key header itself is never used as key, callers could get a fresh bucket for each request with made-up keys,
+// so auth.Interceptor must run before the rate limiter interceptor.
+func ByAPIKey(ctx context.Context, req *jsonrpc.RPCRequest) string {
+	if principal, ok := auth.PrincipalFromContext(ctx); ok && principal.Scheme == "apikey" {
+		return "apikey:" + principal.Subject
+	}
+
+	return ByRemoteIP(ctx, req)
+}
@@ -0,0 +1,206 @@
+// Package ratelimit token bucket rate limiting of jsonrpc server calls
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/libs4go/jsonrpc"
+	"github.com/libs4go/jsonrpc/server"
+	"github.com/libs4go/jsonrpc/transport"
+	"github.com/libs4go/slf4go"
+)
+
+// Limit token bucket limit of methods.
+//
+// Quotas are limits with low rate and large burst, e.g. 1000 calls per day is Rate 1000/86400 and Burst 1000.
+type Limit struct {
+	Methods []string // method names or glob patterns of namespace, e.g. "Debug*"
+	Rate    float64  // tokens refilled per second, 0 means the bucket never refills, i.e. fixed quota of Burst calls
+	Burst   int      // bucket capacity, default 1
+}
+
+func (limit *Limit) match(method string) bool {
+	for _, pattern := range limit.Methods {
+		if pattern == method {
+			return true
+		}
+
+		if matched, err := path.Match(pattern, method); err == nil && matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Config rate limiter settings
+type Config struct {
+	Key    KeyFunc // client identity of call, default ByRemoteIP
+	Limits []Limit // the first limit matching the method applies, methods not matched are not limited
+}
+
+// RetryData error data of throttled calls
+type RetryData struct {
+	RetryAfter float64 `json:"retryAfter"` // seconds until the call may succeed
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take take one token, returns duration to wait if bucket is empty, 0 if it never refills
+func (b *bucket) take(now time.Time, limit *Limit) (bool, time.Duration) {
+	burst := float64(limit.Burst)
+
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	if limit.Rate <= 0 {
+		return false, 0
+	}
+
+	return false, time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+}
+
+type bucketKey struct {
+	limit int
+	key   string
+}
+
+// sweepInterval interval of removing idle buckets
+const sweepInterval = time.Minute
+
+// Limiter token bucket rate limiter keyed by client identity and method
+type Limiter struct {
+	sync.Mutex
+	slf4go.Logger
+	config    Config
+	buckets   map[bucketKey]*bucket
+	lastSweep time.Time
+}
+
+// New create rate limiter
+func New(config Config) *Limiter {
+	if config.Key == nil {
+		config.Key = ByRemoteIP
+	}
+
+	limits := make([]Limit, len(config.Limits))
+
+	for i, limit := range config.Limits {
+		if limit.Burst < 1 {
+			limit.Burst = 1
+		}
+
+		limits[i] = limit
+	}
+
+	config.Limits = limits
+
+	return &Limiter{
+		Logger:    slf4go.Get("JSONRPC-RATELIMIT"),
+		config:    config,
+		buckets:   make(map[bucketKey]*bucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// Allow take one token of method bucket of key, returns duration to wait if throttled,
+// 0 if throttled by bucket which never refills
+func (limiter *Limiter) Allow(key string, method string) (bool, time.Duration) {
+	index := -1
+
+	for i := range limiter.config.Limits {
+		if limiter.config.Limits[i].match(method) {
+			index = i
+			break
+		}
+	}
+
+	if index < 0 {
+		return true, 0
+	}
+
+	limit := &limiter.config.Limits[index]
+
+	now := time.Now()
+
+	limiter.Lock()
+	defer limiter.Unlock()
+
+	limiter.sweep(now)
+
+	k := bucketKey{limit: index, key: key}
+
+	b, ok := limiter.buckets[k]
+
+	if !ok {
+		b = &bucket{tokens: float64(limit.Burst), last: now}
+		limiter.buckets[k] = b
+	}
+
+	return b.take(now, limit)
+}
+
+// sweep remove buckets refilled to full, which are the same as new buckets
+func (limiter *Limiter) sweep(now time.Time) {
+	if now.Sub(limiter.lastSweep) < sweepInterval {
+		return
+	}
+
+	limiter.lastSweep = now
+
+	for k, b := range limiter.buckets {
+		limit := &limiter.config.Limits[k.limit]
+
+		if b.tokens+now.Sub(b.last).Seconds()*limit.Rate >= float64(limit.Burst) {
+			delete(limiter.buckets, k)
+		}
+	}
+}
+
+// Interceptor server interceptor rejecting throttled calls with jsonrpc.RPCRateLimited error,
+// the error data is RetryData, and http responses carry Retry-After header.
+// Both are omitted if the bucket never refills
+func (limiter *Limiter) Interceptor() server.Interceptor {
+	return func(ctx context.Context, req *jsonrpc.RPCRequest, next server.Invoker) *jsonrpc.RPCError {
+		key := limiter.config.Key(ctx, req)
+
+		ok, retryAfter := limiter.Allow(key, req.Method)
+
+		if ok {
+			return next(ctx)
+		}
+
+		rpcErr := &jsonrpc.RPCError{
+			Code:    jsonrpc.RPCRateLimited,
+			Message: "rate limited",
+		}
+
+		if retryAfter <= 0 {
+			limiter.D("throttle call {@method} of {@key}, quota exhausted", req.Method, key)
+			return rpcErr
+		}
+
+		limiter.D("throttle call {@method} of {@key}, retry after {@retry}", req.Method, key, retryAfter.String())
+
+		if header, ok := transport.ResponseHeaderFromContext(ctx); ok {
+			header.Set("Retry-After", strconv.FormatInt(int64(math.Ceil(retryAfter.Seconds())), 10))
+		}
+
+		rpcErr.Data = &RetryData{RetryAfter: retryAfter.Seconds()}
+
+		return rpcErr
+	}
+}
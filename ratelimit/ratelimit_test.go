@@ -0,0 +1,153 @@
+package ratelimit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/libs4go/jsonrpc"
+	"github.com/libs4go/jsonrpc/auth"
+	"github.com/libs4go/jsonrpc/client"
+	"github.com/libs4go/jsonrpc/server"
+	"github.com/libs4go/jsonrpc/transport"
+	"github.com/libs4go/slf4go"
+	"github.com/stretchr/testify/require"
+)
+
+type meteredServer struct {
+}
+
+func (s *meteredServer) ExpensiveTrace() (bool, error) {
+	return true, nil
+}
+
+func (s *meteredServer) CheapVersion() (string, error) {
+	return "1.0", nil
+}
+
+func (s *meteredServer) QuotaExport() (bool, error) {
+	return true, nil
+}
+
+func TestRateLimit(t *testing.T) {
+
+	defer slf4go.Sync()
+
+	limiter := New(Config{
+		Key: ByAPIKey,
+		Limits: []Limit{
+			{Methods: []string{"Expensive*"}, Rate: 1, Burst: 2},
+			{Methods: []string{"Quota*"}, Burst: 1},
+		},
+	})
+
+	keys := auth.APIKeys("", map[string]*auth.Principal{
+		"alice-key": {Subject: "alice"},
+		"bob-key":   {Subject: "bob"},
+		"carol-key": {Subject: "carol"},
+	})
+
+	rpcServer, err := server.New(&meteredServer{}, server.ServerInterceptor(auth.Interceptor(keys, auth.Policy{{Methods: []string{"*"}, Public: true}}), limiter.Interceptor()))
+
+	require.NoError(t, err)
+
+	httpServer := httptest.NewServer(transport.ServeHTTP(rpcServer))
+
+	defer httpServer.Close()
+
+	call := func(key string, method string) (*http.Response, *jsonrpc.RPCResponse) {
+		req, err := http.NewRequest(http.MethodPost, httpServer.URL, strings.NewReader(`{"jsonrpc":"2.0","method":"`+method+`","id":1}`))
+
+		require.NoError(t, err)
+
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-API-Key", key)
+
+		resp, err := http.DefaultClient.Do(req)
+
+		require.NoError(t, err)
+
+		defer resp.Body.Close()
+
+		var rpcResp jsonrpc.RPCResponse
+
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&rpcResp))
+
+		return resp, &rpcResp
+	}
+
+	for i := 0; i < 2; i++ {
+		_, rpcResp := call("alice-key", "ExpensiveTrace")
+		require.Nil(t, rpcResp.Error)
+	}
+
+	resp, rpcResp := call("alice-key", "ExpensiveTrace")
+
+	require.NotNil(t, rpcResp.Error)
+	require.Equal(t, jsonrpc.RPCRateLimited, rpcResp.Error.Code)
+	require.Equal(t, "1", resp.Header.Get("Retry-After"))
+
+	data, ok := rpcResp.Error.Data.(map[string]interface{})
+
+	require.True(t, ok)
+	require.Greater(t, data["retryAfter"].(float64), 0.0)
+
+	_, rpcResp = call("alice-key", "CheapVersion")
+	require.Nil(t, rpcResp.Error)
+
+	_, rpcResp = call("bob-key", "ExpensiveTrace")
+	require.Nil(t, rpcResp.Error)
+
+	// quota never refills, no retry hint
+	_, rpcResp = call("alice-key", "QuotaExport")
+	require.Nil(t, rpcResp.Error)
+
+	resp, rpcResp = call("alice-key", "QuotaExport")
+
+	require.NotNil(t, rpcResp.Error)
+	require.Equal(t, jsonrpc.RPCRateLimited, rpcResp.Error.Code)
+	require.Equal(t, "", resp.Header.Get("Retry-After"))
+	require.Nil(t, rpcResp.Error.Data)
+
+	// made-up keys are anonymous, they share the bucket of caller address rather than getting fresh ones
+	for i := 0; i < 2; i++ {
+		_, rpcResp = call(fmt.Sprintf("forged-%d", i), "ExpensiveTrace")
+		require.Nil(t, rpcResp.Error)
+	}
+
+	_, rpcResp = call("forged-2", "ExpensiveTrace")
+
+	require.NotNil(t, rpcResp.Error)
+	require.Equal(t, jsonrpc.RPCRateLimited, rpcResp.Error.Code)
+
+	wsServer := httptest.NewServer(transport.ServeWebSocket(rpcServer))
+
+	defer wsServer.Close()
+
+	wsClient, err := client.WebSocketConnect("ws"+strings.TrimPrefix(wsServer.URL, "http"), client.WebSocketTransportOps(transport.WebSocketHeaders(map[string][]string{"X-API-Key": {"carol-key"}})))
+
+	require.NoError(t, err)
+
+	var traced bool
+
+	require.NoError(t, wsClient.Call(context.Background(), "ExpensiveTrace").Join(&traced))
+	require.NoError(t, wsClient.Call(context.Background(), "ExpensiveTrace").Join(&traced))
+
+	err = wsClient.Call(context.Background(), "ExpensiveTrace").Join(&traced)
+
+	rpcErr, ok := err.(*jsonrpc.RPCError)
+
+	require.True(t, ok)
+	require.Equal(t, jsonrpc.RPCRateLimited, rpcErr.Code)
+
+	retryAfter := time.Duration(rpcErr.Data.(map[string]interface{})["retryAfter"].(float64) * float64(time.Second))
+
+	require.Eventually(t, func() bool {
+		return wsClient.Call(context.Background(), "ExpensiveTrace").Join(&traced) == nil
+	}, retryAfter+time.Second, 10*time.Millisecond)
+}
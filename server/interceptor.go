@@ -0,0 +1,83 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/libs4go/jsonrpc"
+	"github.com/libs4go/jsonrpc/transport"
+)
+
+// Invoker invoke method call, returns rpc error of the call, nil if succeeded
+type Invoker func(ctx context.Context) *jsonrpc.RPCError
+
+// Interceptor wraps method calls, e.g. authentication, rate limiting and metrics.
+//
+// Interceptor continues the call by calling next, and rejects the call by returning rpc error without calling next.
+type Interceptor func(ctx context.Context, req *jsonrpc.RPCRequest, next Invoker) *jsonrpc.RPCError
+
+// CallInfo information of call, bound to handler context from the start of the call
+type CallInfo struct {
+	Method       string
+	ID           *uint
+	Params       interface{}
+	Transport    string // transport name of peer
+	RemoteAddr   string
+	Principal    string // caller identity recorded by SetPrincipal, empty for anonymous caller
+	Start        time.Time
+	Duration     time.Duration     // set when call finished
+	Error        *jsonrpc.RPCError // set when call finished, nil if succeeded
+	RequestSize  int
+	ResponseSize int // set when call finished, zero for notification
+}
+
+type callInfoKey struct{}
+
+// CallInfoFromContext get information of current call, interceptors may annotate it, e.g. Principal
+func CallInfoFromContext(ctx context.Context) (*CallInfo, bool) {
+	info, ok := ctx.Value(callInfoKey{}).(*CallInfo)
+
+	return info, ok
+}
+
+// SetPrincipal record caller identity of current call as CallInfo.Principal for observers, e.g. access log.
+// Authentication interceptors call it once the caller is authenticated, it does nothing outside server calls
+func SetPrincipal(ctx context.Context, principal string) {
+	if info, ok := CallInfoFromContext(ctx); ok {
+		info.Principal = principal
+	}
+}
+
+func newCallInfo(ctx context.Context, rpcRequest *jsonrpc.RPCRequest, requestSize int) *CallInfo {
+	info := &CallInfo{
+		Method:      rpcRequest.Method,
+		ID:          rpcRequest.ID,
+		Params:      rpcRequest.Params,
+		Start:       time.Now(),
+		RequestSize: requestSize,
+	}
+
+	if peer, ok := transport.PeerFromContext(ctx); ok {
+		info.Transport = peer.Transport
+		info.RemoteAddr = peer.RemoteAddr
+	}
+
+	return info
+}
+
+// Observer observe finished calls, e.g. access log, observers are called synchronously before response is sent
+type Observer func(ctx context.Context, info *CallInfo)
+
+// intercept chain interceptors around invoker
+func (server *serverImpl) intercept(req *jsonrpc.RPCRequest, invoker Invoker) Invoker {
+	for i := len(server.interceptors) - 1; i >= 0; i-- {
+		interceptor := server.interceptors[i]
+		next := invoker
+
+		invoker = func(ctx context.Context) *jsonrpc.RPCError {
+			return interceptor(ctx, req, next)
+		}
+	}
+
+	return invoker
+}
@@ -7,10 +7,15 @@ import (
 	"fmt"
 	"io"
 	"reflect"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/libs4go/errors"
 	"github.com/libs4go/jsonrpc"
+	"github.com/libs4go/jsonrpc/metrics"
+	"github.com/libs4go/jsonrpc/trace"
 	"github.com/libs4go/jsonrpc/transport"
 	"github.com/libs4go/slf4go"
 )
@@ -67,9 +72,10 @@ type callSite struct {
 	in     []reflect.Type
 	out    []reflect.Type
 	method reflect.Method
+	hasCtx bool // first in param is context.Context
 }
 
-func (cs *callSite) Call(ctx context.Context, server *serverImpl, writer *responseWriter, rpcRequest *jsonrpc.RPCRequest) {
+func (cs *callSite) Call(ctx context.Context, server *serverImpl, receiver reflect.Value, writer *responseWriter, rpcRequest *jsonrpc.RPCRequest) {
 
 	buff, err := json.Marshal(rpcRequest.Params)
 
@@ -92,7 +98,11 @@ func (cs *callSite) Call(ctx context.Context, server *serverImpl, writer *respon
 		params = append(params, reflect.Zero(parmType))
 	}
 
-	params = append([]reflect.Value{server.server}, params...)
+	if cs.hasCtx {
+		params = append([]reflect.Value{reflect.ValueOf(ctx)}, params...)
+	}
+
+	params = append([]reflect.Value{receiver}, params...)
 
 	returns := cs.method.Func.Call(params)
 
@@ -162,33 +172,195 @@ func (writer *responseWriter) marshal(id uint) ([]byte, error) {
 }
 
 type serverImpl struct {
+	canceled uint64 // calls canceled by peer closing or aborting, first field for 64-bit atomic alignment
+	timedOut uint64 // calls canceled by timeout
 	sync.RWMutex
 	slf4go.Logger
-	methods map[string]*callSite
-	server  reflect.Value
+	methods       map[string]*callSite
+	server        reflect.Value
+	subMutex      sync.Mutex
+	subscriptions map[string]*Subscription
+	factory       reflect.Value // per session service factory
+	interceptors  []Interceptor
+	metrics       metrics.Sink
+	tracer        trace.Tracer
+	observers     []Observer
+	timeout       time.Duration            // default handler timeout, zero means unlimited
+	timeouts      map[string]time.Duration // per method handler timeouts
+	drainMutex    sync.Mutex
+	shutdown      bool          // reject new calls
+	inflight      int           // calls being dispatched
+	drained       chan struct{} // closed when no call in-flight after shutdown
+}
+
+// Stats dispatch statistics of jsonrpc server
+type Stats struct {
+	Canceled uint64 // calls canceled by peer closing or aborting
+	TimedOut uint64 // calls canceled by server or caller timeout
+}
+
+// GetStats get dispatch statistics of server created by New
+func GetStats(server jsonrpc.Server) Stats {
+	impl, ok := server.(*serverImpl)
+
+	if !ok {
+		return Stats{}
+	}
+
+	return Stats{
+		Canceled: atomic.LoadUint64(&impl.canceled),
+		TimedOut: atomic.LoadUint64(&impl.timedOut),
+	}
+}
+
+// ServerOpt jsonrpc server option
+type ServerOpt func(*serverImpl)
+
+// ServerInterceptor append interceptors, the first interceptor is the outermost one
+func ServerInterceptor(interceptors ...Interceptor) ServerOpt {
+	return func(server *serverImpl) {
+		server.interceptors = append(server.interceptors, interceptors...)
+	}
+}
+
+// ServerMetrics record call metrics to sink
+func ServerMetrics(sink metrics.Sink) ServerOpt {
+	return func(server *serverImpl) {
+		server.metrics = sink
+	}
+}
+
+// ServerObserver append observers of finished calls
+func ServerObserver(observers ...Observer) ServerOpt {
+	return func(server *serverImpl) {
+		server.observers = append(server.observers, observers...)
+	}
+}
+
+// ServerTracer create server span of each call, the caller trace context is extracted from
+// http headers or request meta envelope whether the tracer is set or not
+func ServerTracer(tracer trace.Tracer) ServerOpt {
+	return func(server *serverImpl) {
+		server.tracer = tracer
+	}
+}
+
+// ServerTimeout set default handler timeout of methods without ServerMethodTimeout, the handler context
+// is canceled and jsonrpc.RPCTimeout error is returned after timeout, even if the handler ignores the context,
+// whose late result is then discarded. The smaller of server timeout and caller remaining timeout
+// (request meta or http header, see jsonrpc.TimeoutMeta) applies
+func ServerTimeout(timeout time.Duration) ServerOpt {
+	return func(server *serverImpl) {
+		server.timeout = timeout
+	}
+}
+
+// ServerMethodTimeout set handler timeout of methods, overrides ServerTimeout
+func ServerMethodTimeout(timeout time.Duration, methods ...string) ServerOpt {
+	return func(server *serverImpl) {
+		for _, method := range methods {
+			server.timeouts[method] = timeout
+		}
+	}
+}
+
+func newServerImpl(opts ...ServerOpt) *serverImpl {
+	server := &serverImpl{
+		Logger:        slf4go.Get("JSONRPC-SERVER"),
+		methods:       make(map[string]*callSite),
+		subscriptions: make(map[string]*Subscription),
+		metrics:       metrics.Discard,
+		timeouts:      make(map[string]time.Duration),
+		drained:       make(chan struct{}),
+	}
+
+	for _, opt := range opts {
+		opt(server)
+	}
+
+	return server
+}
+
+// New create jsonrpc server from service struct ptr, or from per session service factory (see NewWithFactory)
+func New(server interface{}, opts ...ServerOpt) (jsonrpc.Server, error) {
+	if serverType := reflect.TypeOf(server); serverType != nil && serverType.Kind() == reflect.Func {
+		return NewWithFactory(server, opts...)
+	}
+
+	s := newServerImpl(opts...)
+
+	err := s.reflectCreateServer(reflect.TypeOf(server))
+
+	if err != nil {
+		return nil, err
+	}
+
+	s.server = reflect.ValueOf(server)
+
+	return s, nil
 }
 
-func New(server interface{}) (jsonrpc.Server, error) {
-	s := &serverImpl{
-		Logger:  slf4go.Get("JSONRPC-SERVER"),
-		methods: make(map[string]*callSite),
+// NewWithFactory create server which creates one service instance for each session,
+// factory must be a function of type func(*transport.Session) (*Service, error).
+// Stream transports (websocket, unix, pipe) create one session for each connection,
+// http transport creates one session for each request.
+func NewWithFactory(factory interface{}, opts ...ServerOpt) (jsonrpc.Server, error) {
+	factoryType := reflect.TypeOf(factory)
+
+	errorInterface := reflect.TypeOf((*error)(nil)).Elem()
+
+	if factoryType == nil || factoryType.Kind() != reflect.Func ||
+		factoryType.NumIn() != 1 || factoryType.In(0) != reflect.TypeOf((*transport.Session)(nil)) ||
+		factoryType.NumOut() != 2 || factoryType.Out(1) != errorInterface {
+		return nil, errors.Wrap(jsonrpc.ErrServer, "factory type must be func(*transport.Session) (*Service, error)")
 	}
 
-	err := s.reflectCreateServer(server)
+	s := newServerImpl(opts...)
+
+	err := s.reflectCreateServer(factoryType.Out(0))
 
 	if err != nil {
 		return nil, err
 	}
 
+	s.factory = reflect.ValueOf(factory)
+
 	return s, nil
 }
 
-func (server *serverImpl) reflectCreateServer(wrapped interface{}) error {
-	serverType := reflect.TypeOf(wrapped)
+type serviceKey struct{}
+
+// receiver get service instance of current call
+func (server *serverImpl) receiver(ctx context.Context) (reflect.Value, error) {
+	if !server.factory.IsValid() {
+		return server.server, nil
+	}
 
-	serverValue := reflect.ValueOf(wrapped)
+	session, ok := transport.SessionFromContext(ctx)
 
-	if serverType.Kind() != reflect.Ptr {
+	if !ok {
+		return reflect.Value{}, errors.Wrap(jsonrpc.ErrServer, "per session service expect transport session")
+	}
+
+	service, err := session.LoadOrCreate(serviceKey{}, func() (interface{}, error) {
+		returns := server.factory.Call([]reflect.Value{reflect.ValueOf(session)})
+
+		if err, ok := returns[1].Interface().(error); ok && err != nil {
+			return nil, err
+		}
+
+		return returns[0], nil
+	})
+
+	if err != nil {
+		return reflect.Value{}, err
+	}
+
+	return service.(reflect.Value), nil
+}
+
+func (server *serverImpl) reflectCreateServer(serverType reflect.Type) error {
+	if serverType == nil || serverType.Kind() != reflect.Ptr {
 		return errors.Wrap(jsonrpc.ErrServer, "server type must be struct ptr")
 	}
 
@@ -198,6 +370,8 @@ func (server *serverImpl) reflectCreateServer(wrapped interface{}) error {
 
 	errorInterface := reflect.TypeOf((*error)(nil)).Elem()
 
+	contextInterface := reflect.TypeOf((*context.Context)(nil)).Elem()
+
 	for i := 0; i < serverType.NumMethod(); i++ {
 
 		methodType := serverType.Method(i)
@@ -218,7 +392,15 @@ func (server *serverImpl) reflectCreateServer(wrapped interface{}) error {
 
 		var inTypes []reflect.Type
 
-		for i := 1; i < methodType.Type.NumIn(); i++ {
+		firstIn := 1
+
+		hasCtx := methodType.Type.NumIn() > 1 && methodType.Type.In(1) == contextInterface
+
+		if hasCtx {
+			firstIn = 2
+		}
+
+		for i := firstIn; i < methodType.Type.NumIn(); i++ {
 			inTypes = append(inTypes, methodType.Type.In(i))
 		}
 
@@ -232,13 +414,12 @@ func (server *serverImpl) reflectCreateServer(wrapped interface{}) error {
 			in:     inTypes,
 			out:    outTypes,
 			method: methodType,
+			hasCtx: hasCtx,
 		}
 
 		server.I("reflect server method {@name} -- success", methodType.Name)
 	}
 
-	server.server = serverValue
-
 	return nil
 }
 
@@ -248,55 +429,379 @@ func (server *serverImpl) Dispatch(ctx context.Context, buff []byte) ([]byte, er
 	err := json.Unmarshal(buff, &rpcRequest)
 
 	if err != nil {
-		return nil, errors.Wrap(err, "unmarshal request error")
+		return nil, errors.Wrap(jsonrpc.ErrParse, "unmarshal request error, %s", err)
+	}
+
+	if rpcRequest == nil {
+		return nil, errors.Wrap(jsonrpc.ErrParse, "unexpect null request")
 	}
 
 	server.D("recv msg {@buff}", rpcRequest)
 
+	if !server.enter() {
+		if rpcRequest.ID == nil {
+			server.D("drop notification {@method}, server shutting down", rpcRequest.Method)
+			return nil, nil
+		}
+
+		writer := &responseWriter{}
+
+		writer.Error(jsonrpc.RPCShuttingDown, "server shutting down")
+
+		return writer.marshal(*rpcRequest.ID)
+	}
+
+	defer server.leave()
+
 	server.RLock()
 	defer server.RUnlock()
 
 	writer := &responseWriter{}
 
+	ctx = context.WithValue(ctx, serverKey{}, server)
+
+	// error returned to caller of notification
+	var notificationErr error
+
+	invoker := server.intercept(rpcRequest, func(ctx context.Context) *jsonrpc.RPCError {
+		notificationErr = server.invoke(ctx, writer, rpcRequest)
+		return writer.err
+	})
+
+	info := newCallInfo(ctx, rpcRequest, len(buff))
+
+	ctx = context.WithValue(ctx, callInfoKey{}, info)
+
+	instrument := server.instrument(ctx, rpcRequest.Method)
+
+	ctx, endSpan := server.startSpan(ctx, rpcRequest)
+
+	rejected := invoker(ctx)
+
+	if rejected != nil {
+		writer.err = rejected
+	}
+
+	endSpan(writer.err)
+
+	instrument(writer.err)
+
+	var respBuff []byte
+
+	if rpcRequest.ID == nil {
+		if rejected != nil && notificationErr == nil {
+			server.D("notification {@method} rejected, {@err}", rpcRequest.Method, rejected.Error())
+		}
+
+		err = notificationErr
+	} else {
+		respBuff, err = writer.marshal(*rpcRequest.ID)
+	}
+
+	if len(server.observers) != 0 {
+		info.Duration = time.Since(info.Start)
+		info.Error = writer.err
+		info.ResponseSize = len(respBuff)
+
+		for _, observer := range server.observers {
+			observer(ctx, info)
+		}
+	}
+
+	return respBuff, err
+}
+
+// enter register in-flight call, returns false if server is shutting down
+func (server *serverImpl) enter() bool {
+	server.drainMutex.Lock()
+	defer server.drainMutex.Unlock()
+
+	if server.shutdown {
+		return false
+	}
+
+	server.inflight++
+
+	return true
+}
+
+// detach register handler outliving its call as in-flight, the call itself is still registered
+func (server *serverImpl) detach() {
+	server.drainMutex.Lock()
+	defer server.drainMutex.Unlock()
+
+	server.inflight++
+}
+
+func (server *serverImpl) leave() {
+	server.drainMutex.Lock()
+	defer server.drainMutex.Unlock()
+
+	server.inflight--
+
+	if server.shutdown && server.inflight == 0 {
+		close(server.drained)
+	}
+}
+
+// Shutdown implement jsonrpc.ServerShutdowner, new calls are rejected with jsonrpc.RPCShuttingDown error,
+// subscriptions are ended with final notification, then waits for in-flight calls until ctx done
+func (server *serverImpl) Shutdown(ctx context.Context) error {
+	server.drainMutex.Lock()
+
+	if !server.shutdown {
+		server.shutdown = true
+
+		if server.inflight == 0 {
+			close(server.drained)
+		}
+	}
+
+	server.drainMutex.Unlock()
+
+	server.endSubscriptions(ctx, &jsonrpc.RPCError{Code: jsonrpc.RPCShuttingDown, Message: "server shutting down"})
+
+	select {
+	case <-server.drained:
+		return nil
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "wait for in-flight calls")
+	}
+}
+
+// instrument record in-flight gauge of call, the returned function records result of the call
+func (server *serverImpl) instrument(ctx context.Context, method string) func(rpcErr *jsonrpc.RPCError) {
+	transportName := "unknown"
+
+	if peer, ok := transport.PeerFromContext(ctx); ok {
+		transportName = peer.Transport
+	}
+
+	// unknown methods share one label to bound label cardinality
+	if _, ok := server.methods[method]; !ok && method != jsonrpc.UnsubscribeMethod {
+		method = "unknown"
+	}
+
+	server.metrics.AddGauge(metrics.ServerInFlight, metrics.Labels{"transport": transportName}, 1)
+
+	start := time.Now()
+
+	return func(rpcErr *jsonrpc.RPCError) {
+		server.metrics.AddGauge(metrics.ServerInFlight, metrics.Labels{"transport": transportName}, -1)
+
+		code := "ok"
+
+		if rpcErr != nil {
+			code = strconv.Itoa(int(rpcErr.Code))
+		}
+
+		server.metrics.AddCounter(metrics.ServerRequests, metrics.Labels{"method": method, "code": code, "transport": transportName}, 1)
+		server.metrics.Observe(metrics.ServerRequestDuration, metrics.Labels{"method": method, "transport": transportName}, time.Since(start).Seconds())
+	}
+}
+
+// startSpan extract caller trace context and start server span, the returned function ends the span
+func (server *serverImpl) startSpan(ctx context.Context, rpcRequest *jsonrpc.RPCRequest) (context.Context, func(rpcErr *jsonrpc.RPCError)) {
+	peer, _ := transport.PeerFromContext(ctx)
+
+	if rpcRequest.Meta != nil {
+		ctx = trace.Extract(ctx, func(key string) string {
+			return rpcRequest.Meta[key]
+		})
+	} else if peer != nil && peer.Transport == "http" {
+		ctx = trace.Extract(ctx, peer.Header.Get)
+	}
+
+	if server.tracer == nil {
+		return ctx, func(rpcErr *jsonrpc.RPCError) {}
+	}
+
+	ctx, span := server.tracer.Start(ctx, rpcRequest.Method, trace.SpanKindServer)
+
+	span.SetAttribute("rpc.system", "jsonrpc")
+	span.SetAttribute("rpc.method", rpcRequest.Method)
+
+	if peer != nil {
+		span.SetAttribute("rpc.transport", peer.Transport)
+		span.SetAttribute("net.peer.address", peer.RemoteAddr)
+	}
+
+	return ctx, func(rpcErr *jsonrpc.RPCError) {
+		if rpcErr == nil {
+			span.End(nil)
+			return
+		}
+
+		span.SetAttribute("rpc.jsonrpc.error_code", int(rpcErr.Code))
+		span.End(rpcErr)
+	}
+}
+
+// invoke call method of request, returns error for failed notification
+func (server *serverImpl) invoke(ctx context.Context, writer *responseWriter, rpcRequest *jsonrpc.RPCRequest) error {
+	if rpcRequest.Method == jsonrpc.UnsubscribeMethod {
+		server.unsubscribe(ctx, writer, rpcRequest)
+		return nil
+	}
+
 	cs, ok := server.methods[rpcRequest.Method]
 
 	if !ok {
-		if rpcRequest.ID != nil {
-			writer.Error(jsonrpc.RPCInvalidRequest, "unspport method %s", rpcRequest.Method)
-			return writer.marshal(*rpcRequest.ID)
-		} else {
-			return nil, errors.Wrap(jsonrpc.ErrDispatcher, "unspport method %s", rpcRequest.Method)
-		}
+		writer.Error(jsonrpc.RPCInvalidRequest, "unspport method %s", rpcRequest.Method)
+		return errors.Wrap(jsonrpc.ErrDispatcher, "unspport method %s", rpcRequest.Method)
+	}
+
+	receiver, err := server.receiver(ctx)
+
+	if err != nil {
+		server.E("create service instance error {@err}", err)
+		writer.Error(jsonrpc.RPCInternalError, "create service instance error")
+		return err
+	}
+
+	ctx, cancel := server.withTimeout(ctx, rpcRequest)
+
+	defer cancel()
+
+	finished := true
+
+	// handlers may ignore ctx, so they are detached only if the server enforces a timeout
+	if server.methodTimeout(rpcRequest.Method) > 0 {
+		finished = server.callDetached(ctx, cs, receiver, writer, rpcRequest)
 	} else {
-		cs.Call(ctx, server, writer, rpcRequest)
+		cs.Call(ctx, server, receiver, writer, rpcRequest)
+	}
+
+	// success of handler returning at the deadline is kept
+	if finished && writer.err == nil {
+		return nil
+	}
 
-		if rpcRequest.ID != nil {
-			return writer.marshal(*rpcRequest.ID)
+	switch err := ctx.Err(); err {
+	case nil:
+	case context.DeadlineExceeded:
+		atomic.AddUint64(&server.timedOut, 1)
+		server.W("call {@method} timeout", rpcRequest.Method)
+		writer.Error(jsonrpc.RPCTimeout, "call %s timeout", rpcRequest.Method)
+	default:
+		atomic.AddUint64(&server.canceled, 1)
+		server.W("call {@method} canceled, {@err}", rpcRequest.Method, err.Error())
+
+		if !finished {
+			writer.Error(jsonrpc.RPCServerError, "call %s canceled", rpcRequest.Method)
 		}
+	}
 
-		return nil, nil
+	return nil
+}
+
+// callDetached call handler in its own goroutine until it returns or ctx done, so a handler ignoring ctx can't
+// hold the caller past the deadline. The transport dispatch slot (see transport.Hold) and the shutdown drain
+// stay held until the handler returns. Returns false if the handler outlived ctx, its late result is discarded
+func (server *serverImpl) callDetached(ctx context.Context, cs *callSite, receiver reflect.Value, writer *responseWriter, rpcRequest *jsonrpc.RPCRequest) bool {
+	handlerWriter := &responseWriter{}
+
+	done := make(chan struct{})
+
+	release := transport.Hold(ctx)
+
+	server.detach()
+
+	go func() {
+		defer server.leave()
+		defer release()
+		defer close(done)
+
+		cs.Call(ctx, server, receiver, handlerWriter, rpcRequest)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
 	}
 
+	select {
+	case <-done:
+		*writer = *handlerWriter
+		return true
+	default:
+		server.D("call {@method} outlives ctx, discard its late result", rpcRequest.Method)
+		return false
+	}
+}
+
+// methodTimeout get server timeout of method, zero if none
+func (server *serverImpl) methodTimeout(method string) time.Duration {
+	if timeout, ok := server.timeouts[method]; ok {
+		return timeout
+	}
+
+	return server.timeout
+}
+
+// withTimeout bind the smaller of method timeout and caller remaining timeout to handler context
+func (server *serverImpl) withTimeout(ctx context.Context, rpcRequest *jsonrpc.RPCRequest) (context.Context, context.CancelFunc) {
+	timeout := server.methodTimeout(rpcRequest.Method)
+
+	var callerTimeout string
+
+	if rpcRequest.Meta != nil {
+		callerTimeout = rpcRequest.Meta[jsonrpc.TimeoutMeta]
+	} else if peer, ok := transport.PeerFromContext(ctx); ok && peer.Transport == "http" {
+		callerTimeout = peer.Header.Get(jsonrpc.TimeoutHeader)
+	}
+
+	if remaining, ok := jsonrpc.ParseTimeout(callerTimeout); ok && (timeout <= 0 || remaining < timeout) {
+		timeout = remaining
+	}
+
+	if timeout <= 0 {
+		return ctx, func() {}
+	}
+
+	return context.WithTimeout(ctx, timeout)
 }
 
 // ServeHTPP create http server
-func ServeHTPP(server interface{}) (*transport.HTTPServer, error) {
+func ServeHTPP(server interface{}, ops ...transport.HTTPServerOps) (*transport.HTTPServer, error) {
 	s, err := New(server)
 
 	if err != nil {
 		return nil, err
 	}
 
-	return transport.ServeHTTP(s), nil
+	return transport.ServeHTTP(s, ops...), nil
 }
 
 // ServeWebSocket create websocket server
-func ServeWebSocket(server interface{}) (*transport.WebSocketServer, error) {
+func ServeWebSocket(server interface{}, ops ...transport.WebSocketServerOps) (*transport.WebSocketServer, error) {
+	s, err := New(server)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return transport.ServeWebSocket(s, ops...), nil
+}
+
+// ServeUnix create unix domain socket server
+func ServeUnix(server interface{}, ops ...transport.UnixServerOps) (*transport.UnixServer, error) {
+	s, err := New(server)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return transport.ServeUnix(s, ops...), nil
+}
+
+// ServePipe create in-memory transport pair connected to server
+func ServePipe(server interface{}, ops ...transport.PipeOps) (*transport.Pipe, error) {
 	s, err := New(server)
 
 	if err != nil {
 		return nil, err
 	}
 
-	return transport.ServeWebSocket(s), nil
+	return transport.NewPipe(s, ops...), nil
 }
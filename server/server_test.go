@@ -2,11 +2,19 @@ package server
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/gorilla/websocket"
+	"github.com/libs4go/errors"
+	"github.com/libs4go/jsonrpc"
 	"github.com/libs4go/jsonrpc/client"
+	"github.com/libs4go/jsonrpc/transport"
 	"github.com/libs4go/scf4go"
 	_ "github.com/libs4go/scf4go/codec/json" //
 	"github.com/libs4go/scf4go/reader/memory"
@@ -31,6 +39,46 @@ func (s *rpcServer) ErrorCall() (string, error) {
 	return "", fmt.Errorf("ErrorCall")
 }
 
+func (s *rpcServer) PeerTransport(ctx context.Context) (string, error) {
+	peer, ok := transport.PeerFromContext(ctx)
+
+	if !ok {
+		return "", fmt.Errorf("peer not found")
+	}
+
+	if peer.RemoteAddr == "" {
+		return "", fmt.Errorf("peer remote addr not found")
+	}
+
+	return peer.Transport, nil
+}
+
+func (s *rpcServer) Tick(ctx context.Context) (string, error) {
+	sub, err := NewSubscription(ctx)
+
+	if err != nil {
+		return "", err
+	}
+
+	go func() {
+		ticker := time.NewTicker(10 * time.Millisecond)
+		defer ticker.Stop()
+
+		for i := 0; ; i++ {
+			select {
+			case <-sub.Done():
+				return
+			case <-ticker.C:
+				if err := sub.Notify(context.Background(), i); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	return sub.ID, nil
+}
+
 var configFile = `
 {
     "default": {
@@ -71,13 +119,11 @@ func TestHttp(t *testing.T) {
 
 	require.NoError(t, err)
 
-	go func() {
-		err := http.ListenAndServe(":8080", server)
+	httpServer := httptest.NewServer(server)
 
-		require.NoError(t, err)
-	}()
+	defer httpServer.Close()
 
-	client, err := client.HTTPConnect("http://localhost:8080")
+	client, err := client.HTTPConnect(httpServer.URL)
 
 	require.NoError(t, err)
 
@@ -95,6 +141,12 @@ func TestHttp(t *testing.T) {
 
 	require.Equal(t, echo, "Hello")
 
+	err = client.Call(context.Background(), "PeerTransport").Join(&echo)
+
+	require.NoError(t, err)
+
+	require.Equal(t, "http", echo)
+
 	err = client.Call(context.Background(), "ErrorCall").Join(&echo)
 
 	require.Error(t, err)
@@ -108,13 +160,11 @@ func TestWebsocket(t *testing.T) {
 
 	require.NoError(t, err)
 
-	go func() {
-		err := http.ListenAndServe(":8080", server)
+	httpServer := httptest.NewServer(server)
 
-		require.NoError(t, err)
-	}()
+	defer httpServer.Close()
 
-	client, err := client.WebSocketConnect("ws://localhost:8080")
+	client, err := client.WebSocketConnect("ws" + strings.TrimPrefix(httpServer.URL, "http"))
 
 	require.NoError(t, err)
 
@@ -132,7 +182,493 @@ func TestWebsocket(t *testing.T) {
 
 	require.Equal(t, echo, "Hello")
 
+	err = client.Call(context.Background(), "PeerTransport").Join(&echo)
+
+	require.NoError(t, err)
+
+	require.Equal(t, "ws", echo)
+
 	err = client.Call(context.Background(), "ErrorCall").Join(&echo)
 
 	require.Error(t, err)
 }
+
+type sessionServer struct {
+	session *transport.Session
+	user    string
+}
+
+func (s *sessionServer) Login(user string) (bool, error) {
+	s.user = user
+	return true, nil
+}
+
+func (s *sessionServer) WhoAmI() (string, error) {
+	return s.user, nil
+}
+
+func (s *sessionServer) Echo(ctx context.Context, msg string) (string, error) {
+	session, ok := transport.SessionFromContext(ctx)
+
+	if !ok || session != s.session {
+		return "", fmt.Errorf("session not found")
+	}
+
+	return session.ID(), session.Notify(ctx, "Echo", msg)
+}
+
+func TestSession(t *testing.T) {
+
+	defer slf4go.Sync()
+
+	closed := make(chan string, 2)
+
+	server, err := ServeWebSocket(func(session *transport.Session) (*sessionServer, error) {
+		session.OnClose(func() {
+			closed <- session.ID()
+		})
+
+		return &sessionServer{session: session}, nil
+	})
+
+	require.NoError(t, err)
+
+	httpServer := httptest.NewServer(server)
+
+	defer httpServer.Close()
+
+	pushed := make(chan string, 1)
+
+	alice, err := client.WebSocketConnect("ws"+strings.TrimPrefix(httpServer.URL, "http"), client.ClientNotification(func(method string, params json.RawMessage) {
+		var args []string
+		json.Unmarshal(params, &args)
+		pushed <- args[0]
+	}))
+
+	require.NoError(t, err)
+
+	bob, err := client.WebSocketConnect("ws" + strings.TrimPrefix(httpServer.URL, "http"))
+
+	require.NoError(t, err)
+
+	var ok bool
+
+	require.NoError(t, alice.Call(context.Background(), "Login", "alice").Join(&ok))
+
+	var user string
+
+	require.NoError(t, alice.Call(context.Background(), "WhoAmI").Join(&user))
+
+	require.Equal(t, "alice", user)
+
+	require.NoError(t, bob.Call(context.Background(), "WhoAmI").Join(&user))
+
+	require.Equal(t, "", user)
+
+	var sessionID string
+
+	require.NoError(t, alice.Call(context.Background(), "Echo", "hello").Join(&sessionID))
+
+	require.Equal(t, "hello", <-pushed)
+
+	require.NoError(t, alice.(*client.Client).Close())
+
+	require.Equal(t, sessionID, <-closed)
+}
+
+func TestUnsubscribe(t *testing.T) {
+
+	defer slf4go.Sync()
+
+	server, err := ServeWebSocket(&rpcServer{})
+
+	require.NoError(t, err)
+
+	httpServer := httptest.NewServer(server)
+
+	defer httpServer.Close()
+
+	alice, err := client.WebSocketConnect("ws" + strings.TrimPrefix(httpServer.URL, "http"))
+
+	require.NoError(t, err)
+
+	bob, err := client.WebSocketConnect("ws" + strings.TrimPrefix(httpServer.URL, "http"))
+
+	require.NoError(t, err)
+
+	ticks := make(chan int, 100)
+
+	sub, err := alice.(*client.Client).Subscribe(context.Background(), "Tick", func(result json.RawMessage) {
+		var tick int
+
+		json.Unmarshal(result, &tick)
+
+		select {
+		case ticks <- tick:
+		default:
+		}
+	})
+
+	require.NoError(t, err)
+
+	<-ticks
+
+	var canceled bool
+
+	// other connections can't cancel the subscription
+	err = bob.Call(context.Background(), jsonrpc.UnsubscribeMethod, sub.ID()).Join(&canceled)
+
+	rpcErr, ok := err.(*jsonrpc.RPCError)
+
+	require.True(t, ok)
+	require.Equal(t, jsonrpc.RPCInvalidParams, rpcErr.Code)
+
+	for len(ticks) > 0 {
+		<-ticks
+	}
+
+	<-ticks
+
+	require.NoError(t, alice.Call(context.Background(), jsonrpc.UnsubscribeMethod, sub.ID()).Join(&canceled))
+	require.True(t, canceled)
+
+	require.NoError(t, alice.Call(context.Background(), jsonrpc.UnsubscribeMethod, sub.ID()).Join(&canceled))
+	require.False(t, canceled)
+}
+
+type slowServer struct {
+	started  chan struct{}
+	canceled chan error
+}
+
+func (s *slowServer) Sleep(ctx context.Context, duration time.Duration) (bool, error) {
+	s.started <- struct{}{}
+
+	select {
+	case <-ctx.Done():
+		s.canceled <- ctx.Err()
+		return false, ctx.Err()
+	case <-time.After(duration):
+		return true, nil
+	}
+}
+
+// Block ignores ctx
+func (s *slowServer) Block(duration time.Duration) (bool, error) {
+	time.Sleep(duration)
+	return true, nil
+}
+
+type holdServer struct {
+	hold chan struct{}
+}
+
+// Hold ignores ctx, returns when hold closed
+func (s *holdServer) Hold() (bool, error) {
+	<-s.hold
+	return true, nil
+}
+
+func (s *holdServer) Echo(n int) (int, error) {
+	return n, nil
+}
+
+type drainServer struct {
+	rpcServer
+	slowServer
+}
+
+func TestShutdown(t *testing.T) {
+
+	defer slf4go.Sync()
+
+	drain := &drainServer{slowServer: slowServer{started: make(chan struct{}, 1)}}
+
+	rpcServer, err := New(drain)
+
+	require.NoError(t, err)
+
+	wsServer := transport.ServeWebSocket(rpcServer)
+
+	httpServer := httptest.NewServer(wsServer)
+
+	defer httpServer.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(httpServer.URL, "http")
+
+	c, err := client.WebSocketConnect(wsURL)
+
+	require.NoError(t, err)
+
+	defer c.(*client.Client).Close()
+
+	ticks := make(chan json.RawMessage, 100)
+
+	sub, err := c.(*client.Client).Subscribe(context.Background(), "Tick", func(result json.RawMessage) {
+		select {
+		case ticks <- result:
+		default:
+		}
+	})
+
+	require.NoError(t, err)
+
+	<-ticks
+
+	slept := make(chan error, 1)
+
+	go func() {
+		var ok bool
+		slept <- c.Call(context.Background(), "Sleep", 200*time.Millisecond).Join(&ok)
+	}()
+
+	<-drain.started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	start := time.Now()
+
+	require.NoError(t, wsServer.Shutdown(ctx))
+
+	require.GreaterOrEqual(t, int64(time.Since(start)), int64(100*time.Millisecond))
+
+	// in-flight call completed before close frame
+	require.NoError(t, <-slept)
+
+	select {
+	case err := <-sub.Err():
+		rpcErr, ok := err.(*jsonrpc.RPCError)
+		require.True(t, ok)
+		require.Equal(t, jsonrpc.RPCShuttingDown, rpcErr.Code)
+	case <-time.After(time.Second):
+		require.Fail(t, "subscription not ended")
+	}
+
+	// new connections are rejected
+	_, resp, err := websocket.DefaultDialer.Dial(wsURL, nil)
+
+	require.Error(t, err)
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+
+	// new calls are rejected by server
+	pipe := transport.NewPipe(rpcServer)
+
+	defer pipe.Close()
+
+	pipeClient, err := client.New(client.ClientTrans(pipe))
+
+	require.NoError(t, err)
+
+	var echo string
+
+	err = pipeClient.Call(context.Background(), "SayHello", "Hello", 1).Join(&echo)
+
+	rpcErr, ok := err.(*jsonrpc.RPCError)
+
+	require.True(t, ok)
+	require.Equal(t, jsonrpc.RPCShuttingDown, rpcErr.Code)
+
+	// http transport rejects requests with 503
+	rpcHTTPServer := transport.ServeHTTP(rpcServer)
+
+	require.NoError(t, rpcHTTPServer.Shutdown(ctx))
+
+	rpcHTTP := httptest.NewServer(rpcHTTPServer)
+
+	defer rpcHTTP.Close()
+
+	httpClient, err := client.HTTPConnect(rpcHTTP.URL)
+
+	require.NoError(t, err)
+
+	err = httpClient.Call(context.Background(), "SayHello", "Hello", 1).Join(&echo)
+
+	var httpErr *transport.HTTPError
+
+	require.True(t, errors.As(err, &httpErr))
+	require.Equal(t, http.StatusServiceUnavailable, httpErr.StatusCode)
+	require.Equal(t, jsonrpc.RPCShuttingDown, httpErr.RPCError.Code)
+}
+
+func TestTimeout(t *testing.T) {
+
+	defer slf4go.Sync()
+
+	slow := &slowServer{started: make(chan struct{}, 10), canceled: make(chan error, 10)}
+
+	rpcServer, err := New(slow, ServerTimeout(time.Minute), ServerMethodTimeout(50*time.Millisecond, "Sleep", "Block"))
+
+	require.NoError(t, err)
+
+	wsServer := httptest.NewServer(transport.ServeWebSocket(rpcServer))
+
+	defer wsServer.Close()
+
+	c, err := client.WebSocketConnect("ws"+strings.TrimPrefix(wsServer.URL, "http"), client.ClientMeta())
+
+	require.NoError(t, err)
+
+	var ok bool
+
+	// method timeout
+	err = c.Call(context.Background(), "Sleep", time.Minute).Join(&ok)
+
+	rpcErr, isRPCErr := err.(*jsonrpc.RPCError)
+
+	require.True(t, isRPCErr)
+	require.Equal(t, jsonrpc.RPCTimeout, rpcErr.Code)
+	require.Equal(t, context.DeadlineExceeded, <-slow.canceled)
+
+	require.Equal(t, uint64(1), GetStats(rpcServer).TimedOut)
+
+	// caller remaining timeout is smaller than method timeout
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+
+	defer cancel()
+
+	start := time.Now()
+
+	require.Error(t, c.Call(ctx, "Sleep", time.Minute).Join(&ok))
+
+	require.Equal(t, context.DeadlineExceeded, <-slow.canceled)
+	require.Less(t, int64(time.Since(start)), int64(50*time.Millisecond))
+
+	// http caller timeout header
+	httpServer := httptest.NewServer(transport.ServeHTTP(rpcServer))
+
+	defer httpServer.Close()
+
+	req, err := http.NewRequest(http.MethodPost, httpServer.URL, strings.NewReader(`{"jsonrpc":"2.0","method":"Sleep","params":[60000000000],"id":1}`))
+
+	require.NoError(t, err)
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(jsonrpc.TimeoutHeader, "10")
+
+	resp, err := http.DefaultClient.Do(req)
+
+	require.NoError(t, err)
+
+	defer resp.Body.Close()
+
+	var rpcResp jsonrpc.RPCResponse
+
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&rpcResp))
+
+	require.NotNil(t, rpcResp.Error)
+	require.Equal(t, jsonrpc.RPCTimeout, rpcResp.Error.Code)
+	require.Equal(t, context.DeadlineExceeded, <-slow.canceled)
+
+	require.Equal(t, uint64(3), GetStats(rpcServer).TimedOut)
+
+	// handler ignoring ctx can't hold the caller past the deadline
+	start = time.Now()
+
+	err = c.Call(context.Background(), "Block", 300*time.Millisecond).Join(&ok)
+
+	rpcErr, isRPCErr = err.(*jsonrpc.RPCError)
+
+	require.True(t, isRPCErr)
+	require.Equal(t, jsonrpc.RPCTimeout, rpcErr.Code)
+	require.Less(t, int64(time.Since(start)), int64(200*time.Millisecond))
+
+	require.Equal(t, uint64(4), GetStats(rpcServer).TimedOut)
+
+	// http client sends client timeout if ctx has no deadline
+	timeouts := make(chan string, 1)
+
+	headerServer := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		timeouts <- request.Header.Get(jsonrpc.TimeoutHeader)
+
+		transport.ServeHTTP(rpcServer).ServeHTTP(writer, request)
+	}))
+
+	defer headerServer.Close()
+
+	httpClient, err := client.HTTPConnect(headerServer.URL, client.ClientTimeout(2*time.Second))
+
+	require.NoError(t, err)
+
+	require.NoError(t, httpClient.Call(context.Background(), "Sleep", time.Millisecond).Join(&ok))
+
+	remaining, valid := jsonrpc.ParseTimeout(<-timeouts)
+
+	require.True(t, valid)
+	require.LessOrEqual(t, int64(remaining), int64(2*time.Second))
+	require.Greater(t, int64(remaining), int64(time.Second))
+}
+
+func TestTimeoutDetached(t *testing.T) {
+
+	defer slf4go.Sync()
+
+	held := &holdServer{hold: make(chan struct{})}
+
+	rpcServer, err := New(held, ServerMethodTimeout(20*time.Millisecond, "Hold"))
+
+	require.NoError(t, err)
+
+	wsServer := httptest.NewServer(transport.ServeWebSocket(rpcServer, transport.WebSocketDispatchLimit(transport.DispatchLimit{
+		Sequential: true,
+	})))
+
+	defer wsServer.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(wsServer.URL, "http"), nil)
+
+	require.NoError(t, err)
+
+	defer conn.Close()
+
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"jsonrpc":"2.0","method":"Hold","id":1}`)))
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"jsonrpc":"2.0","method":"Echo","params":[2],"id":2}`)))
+
+	var resp jsonrpc.RPCResponse
+
+	require.NoError(t, conn.ReadJSON(&resp))
+	require.Equal(t, uint(1), resp.ID)
+	require.NotNil(t, resp.Error)
+	require.Equal(t, jsonrpc.RPCTimeout, resp.Error.Code)
+
+	// the detached handler keeps the sequential slot and the shutdown drain
+	shutdown := make(chan error, 1)
+
+	go func() {
+		shutdown <- rpcServer.(jsonrpc.ServerShutdowner).Shutdown(context.Background())
+	}()
+
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+
+	require.Error(t, conn.ReadJSON(&resp))
+
+	select {
+	case <-shutdown:
+		require.Fail(t, "shutdown returned before detached handler")
+	default:
+	}
+
+	close(held.hold)
+
+	require.NoError(t, <-shutdown)
+
+	// handler canceled before finishing answers error, not null result
+	ctx, cancel := context.WithCancel(context.Background())
+
+	cancel()
+
+	rpcServer, err = New(&holdServer{hold: make(chan struct{})}, ServerTimeout(time.Minute))
+
+	require.NoError(t, err)
+
+	buff, err := rpcServer.Dispatch(ctx, []byte(`{"jsonrpc":"2.0","method":"Hold","id":3}`))
+
+	require.NoError(t, err)
+
+	resp = jsonrpc.RPCResponse{}
+
+	require.NoError(t, json.Unmarshal(buff, &resp))
+	require.NotNil(t, resp.Error)
+	require.Equal(t, jsonrpc.RPCServerError, resp.Error.Code)
+}
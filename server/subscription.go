@@ -0,0 +1,189 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+
+	"github.com/libs4go/errors"
+	"github.com/libs4go/jsonrpc"
+	"github.com/libs4go/jsonrpc/transport"
+)
+
+type serverKey struct{}
+
+// Subscription server side subscription, notifications are pushed to the connection which created it.
+//
+// The handler creates subscription by NewSubscription and returns subscription ID as call result.
+type Subscription struct {
+	ID        string
+	pusher    transport.Pusher
+	session   *transport.Session // connection owning the subscription, nil if transport has no session
+	server    *serverImpl
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewSubscription create subscription bound to the connection of handler context
+func NewSubscription(ctx context.Context) (*Subscription, error) {
+	server, ok := ctx.Value(serverKey{}).(*serverImpl)
+
+	if !ok {
+		return nil, errors.Wrap(jsonrpc.ErrServer, "expect jsonrpc handler context")
+	}
+
+	pusher, ok := transport.PusherFromContext(ctx)
+
+	if !ok {
+		return nil, errors.Wrap(jsonrpc.ErrTransport, "transport not support server push")
+	}
+
+	id, err := newSubscriptionID()
+
+	if err != nil {
+		return nil, err
+	}
+
+	sub := &Subscription{
+		ID:     id,
+		pusher: pusher,
+		server: server,
+		done:   make(chan struct{}),
+	}
+
+	sub.session, _ = transport.SessionFromContext(ctx)
+
+	server.subMutex.Lock()
+	server.subscriptions[id] = sub
+	server.subMutex.Unlock()
+
+	if sub.session != nil {
+		sub.session.OnClose(sub.Close)
+	}
+
+	return sub, nil
+}
+
+func newSubscriptionID() (string, error) {
+	var buff [16]byte
+
+	if _, err := rand.Read(buff[:]); err != nil {
+		return "", errors.Wrap(err, "generate subscription id error")
+	}
+
+	return "0x" + hex.EncodeToString(buff[:]), nil
+}
+
+// Notify push subscription notification
+func (sub *Subscription) Notify(ctx context.Context, result interface{}) error {
+	return sub.push(ctx, &jsonrpc.SubscriptionResult{
+		ID:     sub.ID,
+		Result: result,
+	})
+}
+
+// End push final notification carrying rpcErr and close subscription
+func (sub *Subscription) End(ctx context.Context, rpcErr *jsonrpc.RPCError) error {
+	defer sub.Close()
+
+	return sub.push(ctx, &jsonrpc.SubscriptionResult{
+		ID:    sub.ID,
+		Error: rpcErr,
+	})
+}
+
+func (sub *Subscription) push(ctx context.Context, params *jsonrpc.SubscriptionResult) error {
+	select {
+	case <-sub.done:
+		return errors.Wrap(jsonrpc.ErrClose, "subscription %s closed", sub.ID)
+	default:
+	}
+
+	buff, err := json.Marshal(&jsonrpc.RPCNotification{
+		JSONRPC: "2.0",
+		Method:  jsonrpc.SubscriptionMethod,
+		Params:  params,
+	})
+
+	if err != nil {
+		return errors.Wrap(err, "marshal notification error")
+	}
+
+	if err := sub.pusher.Push(ctx, buff); err != nil {
+		sub.Close()
+		return err
+	}
+
+	return nil
+}
+
+// Done closed when subscription is canceled by client or closed
+func (sub *Subscription) Done() <-chan struct{} {
+	return sub.done
+}
+
+// Close close subscription
+func (sub *Subscription) Close() {
+	sub.closeOnce.Do(func() {
+		close(sub.done)
+
+		sub.server.subMutex.Lock()
+		delete(sub.server.subscriptions, sub.ID)
+		sub.server.subMutex.Unlock()
+	})
+}
+
+// endSubscriptions end all subscriptions with final notification
+func (server *serverImpl) endSubscriptions(ctx context.Context, rpcErr *jsonrpc.RPCError) {
+	server.subMutex.Lock()
+
+	subs := make([]*Subscription, 0, len(server.subscriptions))
+
+	for _, sub := range server.subscriptions {
+		subs = append(subs, sub)
+	}
+
+	server.subMutex.Unlock()
+
+	for _, sub := range subs {
+		if err := sub.End(ctx, rpcErr); err != nil {
+			server.W("end subscription {@id} error {@err}", sub.ID, err)
+		}
+	}
+}
+
+// unsubscribe builtin method handler, connections can only cancel subscriptions created by themselves
+func (server *serverImpl) unsubscribe(ctx context.Context, writer *responseWriter, rpcRequest *jsonrpc.RPCRequest) {
+	var ids []string
+
+	buff, err := json.Marshal(rpcRequest.Params)
+
+	if err == nil {
+		err = json.Unmarshal(buff, &ids)
+	}
+
+	if err != nil || len(ids) != 1 {
+		writer.Error(jsonrpc.RPCInvalidParams, "expect subscription id")
+		return
+	}
+
+	server.subMutex.Lock()
+	sub, ok := server.subscriptions[ids[0]]
+	server.subMutex.Unlock()
+
+	if !ok {
+		writer.Result(false)
+		return
+	}
+
+	if session, _ := transport.SessionFromContext(ctx); sub.session != session {
+		writer.Error(jsonrpc.RPCInvalidParams, "subscription %s not owned by connection", ids[0])
+		return
+	}
+
+	sub.Close()
+
+	writer.Result(true)
+}
@@ -0,0 +1,184 @@
+package trace
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/libs4go/errors"
+)
+
+// MemoryExporter keep exported spans in memory, for tests
+type MemoryExporter struct {
+	sync.Mutex
+	spans []*SpanData
+}
+
+// NewMemoryExporter create in-memory exporter
+func NewMemoryExporter() *MemoryExporter {
+	return &MemoryExporter{}
+}
+
+// Export implement Exporter
+func (exporter *MemoryExporter) Export(span *SpanData) {
+	exporter.Lock()
+	defer exporter.Unlock()
+
+	exporter.spans = append(exporter.spans, span)
+}
+
+// Spans exported spans in order of ending
+func (exporter *MemoryExporter) Spans() []*SpanData {
+	exporter.Lock()
+	defer exporter.Unlock()
+
+	return append([]*SpanData(nil), exporter.spans...)
+}
+
+// Reset drop exported spans
+func (exporter *MemoryExporter) Reset() {
+	exporter.Lock()
+	defer exporter.Unlock()
+
+	exporter.spans = nil
+}
+
+// FileExporter write spans to file in OTLP JSON lines format, each line is one ExportTraceServiceRequest
+// which can be replayed to OTLP/HTTP collectors or read by the collector otlpjsonfile receiver
+type FileExporter struct {
+	sync.Mutex
+	file *os.File
+}
+
+// NewFileExporter create file exporter appending to path
+func NewFileExporter(path string) (*FileExporter, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "open trace file %s error", path)
+	}
+
+	return &FileExporter{file: file}, nil
+}
+
+// Export implement Exporter, write errors are dropped
+func (exporter *FileExporter) Export(span *SpanData) {
+	buff, err := json.Marshal(otlpRequest(span))
+
+	if err != nil {
+		return
+	}
+
+	exporter.Lock()
+	defer exporter.Unlock()
+
+	exporter.file.Write(append(buff, '\n'))
+}
+
+// Close close trace file
+func (exporter *FileExporter) Close() error {
+	exporter.Lock()
+	defer exporter.Unlock()
+
+	return exporter.file.Close()
+}
+
+type otlpKeyValue struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              SpanKind       `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+// otlpStatusError OTLP STATUS_CODE_ERROR
+const otlpStatusError = 2
+
+func otlpRequest(span *SpanData) interface{} {
+	s := &otlpSpan{
+		TraceID:           span.TraceID.String(),
+		SpanID:            span.SpanID.String(),
+		Name:              span.Name,
+		Kind:              span.Kind,
+		StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+		Attributes:        otlpAttributes(span.Attributes),
+	}
+
+	if span.ParentSpanID != (SpanID{}) {
+		s.ParentSpanID = span.ParentSpanID.String()
+	}
+
+	if span.Error != "" {
+		s.Status = otlpStatus{Code: otlpStatusError, Message: span.Error}
+	}
+
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": otlpAttributes(map[string]interface{}{"service.name": span.Service}),
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]interface{}{"name": "github.com/libs4go/jsonrpc"},
+						"spans": []interface{}{s},
+					},
+				},
+			},
+		},
+	}
+}
+
+// otlpAttributes convert attributes to OTLP AnyValue list sorted by key
+func otlpAttributes(attributes map[string]interface{}) []otlpKeyValue {
+	keys := make([]string, 0, len(attributes))
+
+	for key := range attributes {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	values := make([]otlpKeyValue, 0, len(keys))
+
+	for _, key := range keys {
+		var value map[string]interface{}
+
+		switch v := attributes[key].(type) {
+		case string:
+			value = map[string]interface{}{"stringValue": v}
+		case bool:
+			value = map[string]interface{}{"boolValue": v}
+		case int:
+			value = map[string]interface{}{"intValue": strconv.FormatInt(int64(v), 10)}
+		case int64:
+			value = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+		case float64:
+			value = map[string]interface{}{"doubleValue": v}
+		default:
+			value = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+		}
+
+		values = append(values, otlpKeyValue{Key: key, Value: value})
+	}
+
+	return values
+}
@@ -0,0 +1,189 @@
+// Package trace distributed tracing of jsonrpc calls with W3C trace context propagation
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/libs4go/errors"
+)
+
+// W3C trace context header names, also used as keys of request meta envelope
+const (
+	TraceparentHeader = "traceparent"
+	TracestateHeader  = "tracestate"
+)
+
+// FlagSampled trace flags bit of sampled trace
+const FlagSampled byte = 0x01
+
+// TraceID 16 bytes trace id
+type TraceID [16]byte
+
+// SpanID 8 bytes span id
+type SpanID [8]byte
+
+func (id TraceID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+func (id SpanID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// SpanContext propagated span identity
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Flags   byte
+	State   string // tracestate header value, propagated as is
+	Remote  bool   // extracted from caller
+}
+
+// IsValid check trace id and span id are not zero
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+// Sampled check sampled flag
+func (sc SpanContext) Sampled() bool {
+	return sc.Flags&FlagSampled != 0
+}
+
+// Traceparent format traceparent header value
+func (sc SpanContext) Traceparent() string {
+	return fmt.Sprintf("00-%s-%s-%02x", sc.TraceID, sc.SpanID, sc.Flags)
+}
+
+// ParseTraceparent parse traceparent header value with tracestate
+func ParseTraceparent(traceparent string, tracestate string) (SpanContext, error) {
+	traceparent = strings.TrimSpace(traceparent)
+
+	parts := strings.Split(traceparent, "-")
+
+	// future versions may append fields
+	if len(parts) < 4 || len(parts[0]) != 2 || (parts[0] == "00" && len(parts) != 4) {
+		return SpanContext{}, errors.New(fmt.Sprintf("invalid traceparent %s", traceparent))
+	}
+
+	version, err := hex.DecodeString(parts[0])
+
+	if err != nil || version[0] == 0xff {
+		return SpanContext{}, errors.New(fmt.Sprintf("invalid traceparent version %s", parts[0]))
+	}
+
+	var sc SpanContext
+
+	if err := decodeHex(parts[1], sc.TraceID[:]); err != nil {
+		return SpanContext{}, errors.Wrap(err, "invalid trace id")
+	}
+
+	if err := decodeHex(parts[2], sc.SpanID[:]); err != nil {
+		return SpanContext{}, errors.Wrap(err, "invalid parent id")
+	}
+
+	var flags [1]byte
+
+	if err := decodeHex(parts[3], flags[:]); err != nil {
+		return SpanContext{}, errors.Wrap(err, "invalid trace flags")
+	}
+
+	sc.Flags = flags[0]
+	sc.State = strings.TrimSpace(tracestate)
+	sc.Remote = true
+
+	if !sc.IsValid() {
+		return SpanContext{}, errors.New("invalid traceparent, zero trace id or parent id")
+	}
+
+	return sc, nil
+}
+
+// decodeHex decode lower case hex string of exact length
+func decodeHex(s string, buff []byte) error {
+	if len(s) != 2*len(buff) || strings.ToLower(s) != s {
+		return errors.New(fmt.Sprintf("expect %d lower case hex digits", 2*len(buff)))
+	}
+
+	_, err := hex.Decode(buff, []byte(s))
+
+	return err
+}
+
+func newTraceID() (id TraceID) {
+	// crypto/rand never fails on supported platforms
+	rand.Read(id[:])
+	return
+}
+
+func newSpanID() (id SpanID) {
+	rand.Read(id[:])
+	return
+}
+
+type spanContextKey struct{}
+
+type spanKey struct{}
+
+// ContextWithSpanContext bind remote span context to context, e.g. extracted from caller request
+func ContextWithSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, spanContextKey{}, sc)
+}
+
+// ContextWithSpan bind active span to context
+func ContextWithSpan(ctx context.Context, span Span) context.Context {
+	ctx = context.WithValue(ctx, spanKey{}, span)
+
+	return ContextWithSpanContext(ctx, span.SpanContext())
+}
+
+// SpanContextFromContext get span context of active span or remote caller
+func SpanContextFromContext(ctx context.Context) (SpanContext, bool) {
+	sc, ok := ctx.Value(spanContextKey{}).(SpanContext)
+
+	return sc, ok && sc.IsValid()
+}
+
+// SpanFromContext get active span
+func SpanFromContext(ctx context.Context) (Span, bool) {
+	span, ok := ctx.Value(spanKey{}).(Span)
+
+	return span, ok
+}
+
+// Inject write span context of ctx to carrier map, e.g. http header or request meta envelope
+func Inject(ctx context.Context, set func(key, value string)) bool {
+	sc, ok := SpanContextFromContext(ctx)
+
+	if !ok {
+		return false
+	}
+
+	set(TraceparentHeader, sc.Traceparent())
+
+	if sc.State != "" {
+		set(TracestateHeader, sc.State)
+	}
+
+	return true
+}
+
+// Extract bind span context read from carrier to ctx, ctx is returned unchanged if traceparent is missing or invalid
+func Extract(ctx context.Context, get func(key string) string) context.Context {
+	traceparent := get(TraceparentHeader)
+
+	if traceparent == "" {
+		return ctx
+	}
+
+	sc, err := ParseTraceparent(traceparent, get(TracestateHeader))
+
+	if err != nil {
+		return ctx
+	}
+
+	return ContextWithSpanContext(ctx, sc)
+}
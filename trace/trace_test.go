@@ -0,0 +1,83 @@
+package trace
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTraceparent(t *testing.T) {
+	sc, err := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "")
+
+	require.NoError(t, err)
+	require.True(t, sc.Sampled())
+	require.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", sc.Traceparent())
+
+	for _, invalid := range []string{
+		"",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+	} {
+		_, err := ParseTraceparent(invalid, "")
+		require.Error(t, err, invalid)
+	}
+
+	_, err = ParseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", "")
+
+	require.NoError(t, err)
+}
+
+func TestFileExporter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.json")
+
+	exporter, err := NewFileExporter(path)
+
+	require.NoError(t, err)
+
+	tracer := NewTracer("test", exporter)
+
+	ctx, root := tracer.Start(context.Background(), "root", SpanKindServer)
+
+	_, child := tracer.Start(ctx, "child", SpanKindClient)
+
+	child.SetAttribute("rpc.method", "SayHello")
+	child.End(errors.New("failed"))
+	root.End(nil)
+
+	require.NoError(t, exporter.Close())
+
+	file, err := os.Open(path)
+
+	require.NoError(t, err)
+
+	defer file.Close()
+
+	var lines []map[string]interface{}
+
+	scanner := bufio.NewScanner(file)
+
+	for scanner.Scan() {
+		var line map[string]interface{}
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &line))
+		lines = append(lines, line)
+	}
+
+	require.Len(t, lines, 2)
+
+	span := lines[0]["resourceSpans"].([]interface{})[0].(map[string]interface{})["scopeSpans"].([]interface{})[0].(map[string]interface{})["spans"].([]interface{})[0].(map[string]interface{})
+
+	require.Equal(t, "child", span["name"])
+	require.Equal(t, root.SpanContext().TraceID.String(), span["traceId"])
+	require.Equal(t, root.SpanContext().SpanID.String(), span["parentSpanId"])
+	require.Equal(t, float64(SpanKindClient), span["kind"])
+	require.Equal(t, float64(otlpStatusError), span["status"].(map[string]interface{})["code"])
+}
@@ -0,0 +1,140 @@
+package trace
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// SpanKind role of span in the call
+type SpanKind int
+
+const (
+	SpanKindInternal SpanKind = iota + 1
+	SpanKindServer
+	SpanKindClient
+)
+
+// Tracer create spans
+type Tracer interface {
+	// Start start span as child of the span context of ctx, the returned context carries the new span
+	Start(ctx context.Context, name string, kind SpanKind) (context.Context, Span)
+}
+
+// Span timed operation of trace
+type Span interface {
+	SpanContext() SpanContext
+	SetAttribute(key string, value interface{})
+	// End finish span, non nil err marks span failed
+	End(err error)
+}
+
+// SpanData finished span exported by Exporter
+type SpanData struct {
+	Service      string
+	Name         string
+	Kind         SpanKind
+	TraceID      TraceID
+	SpanID       SpanID
+	ParentSpanID SpanID // zero for root span
+	Start        time.Time
+	End          time.Time
+	Attributes   map[string]interface{}
+	Error        string // error message of failed span, empty if succeeded
+}
+
+// Exporter export finished spans, implementations must be safe for concurrent use
+type Exporter interface {
+	Export(span *SpanData)
+}
+
+type tracer struct {
+	service  string
+	exporter Exporter
+}
+
+// NewTracer create tracer exporting sampled spans to exporter, root spans are always sampled
+// and child spans follow the sampled flag of parent
+func NewTracer(service string, exporter Exporter) Tracer {
+	return &tracer{
+		service:  service,
+		exporter: exporter,
+	}
+}
+
+func (t *tracer) Start(ctx context.Context, name string, kind SpanKind) (context.Context, Span) {
+	s := &span{
+		tracer: t,
+		data: SpanData{
+			Service:    t.service,
+			Name:       name,
+			Kind:       kind,
+			SpanID:     newSpanID(),
+			Start:      time.Now(),
+			Attributes: make(map[string]interface{}),
+		},
+	}
+
+	if parent, ok := SpanContextFromContext(ctx); ok {
+		s.data.TraceID = parent.TraceID
+		s.data.ParentSpanID = parent.SpanID
+		s.flags = parent.Flags
+		s.state = parent.State
+	} else {
+		s.data.TraceID = newTraceID()
+		s.flags = FlagSampled
+	}
+
+	return ContextWithSpan(ctx, s), s
+}
+
+type span struct {
+	sync.Mutex
+	tracer *tracer
+	data   SpanData
+	flags  byte
+	state  string
+	ended  bool
+}
+
+func (s *span) SpanContext() SpanContext {
+	return SpanContext{
+		TraceID: s.data.TraceID,
+		SpanID:  s.data.SpanID,
+		Flags:   s.flags,
+		State:   s.state,
+	}
+}
+
+func (s *span) SetAttribute(key string, value interface{}) {
+	s.Lock()
+	defer s.Unlock()
+
+	if !s.ended {
+		s.data.Attributes[key] = value
+	}
+}
+
+func (s *span) End(err error) {
+	s.Lock()
+
+	if s.ended {
+		s.Unlock()
+		return
+	}
+
+	s.ended = true
+	s.data.End = time.Now()
+
+	if err != nil {
+		s.data.Error = err.Error()
+	}
+
+	data := s.data
+
+	s.Unlock()
+
+	if s.flags&FlagSampled != 0 && s.tracer.exporter != nil {
+		s.tracer.exporter.Export(&data)
+	}
+}
@@ -0,0 +1,111 @@
+package trace_test
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/libs4go/jsonrpc"
+	"github.com/libs4go/jsonrpc/client"
+	"github.com/libs4go/jsonrpc/server"
+	"github.com/libs4go/jsonrpc/trace"
+	"github.com/libs4go/jsonrpc/transport"
+	"github.com/libs4go/slf4go"
+	"github.com/stretchr/testify/require"
+)
+
+type rpcServer struct {
+}
+
+func (s *rpcServer) SayHello(msg string, code int) (string, error) {
+	return msg, nil
+}
+
+func (s *rpcServer) ErrorCall() (string, error) {
+	return "", fmt.Errorf("ErrorCall")
+}
+
+func TestTracing(t *testing.T) {
+
+	defer slf4go.Sync()
+
+	exporter := trace.NewMemoryExporter()
+
+	metas := make(chan map[string]string, 10)
+
+	rpcServer, err := server.New(&rpcServer{}, server.ServerTracer(trace.NewTracer("server", exporter)), server.ServerInterceptor(func(ctx context.Context, req *jsonrpc.RPCRequest, next server.Invoker) *jsonrpc.RPCError {
+		metas <- req.Meta
+		return next(ctx)
+	}))
+
+	require.NoError(t, err)
+
+	httpServer := httptest.NewServer(transport.ServeHTTP(rpcServer))
+
+	defer httpServer.Close()
+
+	wsServer := httptest.NewServer(transport.ServeWebSocket(rpcServer))
+
+	defer wsServer.Close()
+
+	httpClient, err := client.HTTPConnect(httpServer.URL, client.ClientTracer(trace.NewTracer("client", exporter)))
+
+	require.NoError(t, err)
+
+	wsClient, err := client.WebSocketConnect("ws"+strings.TrimPrefix(wsServer.URL, "http"), client.ClientTracer(trace.NewTracer("client", exporter)), client.ClientMeta())
+
+	require.NoError(t, err)
+
+	// meta is opt-in, requests are plain JSON-RPC 2.0 by default
+	plainClient, err := client.WebSocketConnect("ws"+strings.TrimPrefix(wsServer.URL, "http"), client.ClientTracer(trace.NewTracer("client", exporter)))
+
+	require.NoError(t, err)
+
+	var hello string
+
+	require.NoError(t, plainClient.Call(context.Background(), "SayHello", "Hello", 1).Join(&hello))
+
+	require.Nil(t, <-metas)
+
+	parent, err := trace.ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "vendor=value")
+
+	require.NoError(t, err)
+
+	for _, c := range []jsonrpc.Client{httpClient, wsClient} {
+		exporter.Reset()
+
+		ctx := trace.ContextWithSpanContext(context.Background(), parent)
+
+		var echo string
+
+		require.NoError(t, c.Call(ctx, "SayHello", "Hello", 1).Join(&echo))
+
+		require.Error(t, c.Call(ctx, "ErrorCall").Join(&echo))
+
+		<-metas
+		<-metas
+
+		spans := exporter.Spans()
+
+		require.Len(t, spans, 4)
+
+		for i := 0; i < 4; i += 2 {
+			serverSpan, clientSpan := spans[i], spans[i+1]
+
+			require.Equal(t, trace.SpanKindServer, serverSpan.Kind)
+			require.Equal(t, trace.SpanKindClient, clientSpan.Kind)
+
+			require.Equal(t, parent.TraceID, clientSpan.TraceID)
+			require.Equal(t, parent.SpanID, clientSpan.ParentSpanID)
+
+			require.Equal(t, clientSpan.TraceID, serverSpan.TraceID)
+			require.Equal(t, clientSpan.SpanID, serverSpan.ParentSpanID)
+		}
+
+		require.Equal(t, "", spans[0].Error)
+		require.NotEqual(t, "", spans[2].Error)
+		require.Equal(t, int(jsonrpc.RPCInternalError), spans[2].Attributes["rpc.jsonrpc.error_code"])
+	}
+}
@@ -0,0 +1,143 @@
+package transport
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/libs4go/errors"
+)
+
+// errUnsupportedEncoding content encoding other than gzip and deflate
+var errUnsupportedEncoding = errors.New("unsupported content encoding")
+
+// Compression message compression settings
+type Compression struct {
+	Level     int // flate compression level, 0 means flate.DefaultCompression
+	Threshold int // messages smaller than threshold bytes are sent uncompressed
+}
+
+func (compression *Compression) level() int {
+	if compression.Level == 0 {
+		return flate.DefaultCompression
+	}
+
+	return compression.Level
+}
+
+// compress returns true if message of size should be compressed
+func (compression *Compression) compress(size int) bool {
+	return compression != nil && size >= compression.Threshold
+}
+
+// acceptedEncoding select response content encoding from Accept-Encoding header, gzip is preferred,
+// returns empty string if neither gzip nor deflate is acceptable
+func acceptedEncoding(acceptEncoding string) string {
+	var gzipOK, deflateOK bool
+
+	for _, item := range strings.Split(acceptEncoding, ",") {
+		parts := strings.Split(item, ";")
+
+		coding := strings.ToLower(strings.TrimSpace(parts[0]))
+
+		if !encodingAccepted(parts[1:]) {
+			continue
+		}
+
+		switch coding {
+		case "gzip", "*":
+			gzipOK = true
+		case "deflate":
+			deflateOK = true
+		}
+	}
+
+	switch {
+	case gzipOK:
+		return "gzip"
+	case deflateOK:
+		return "deflate"
+	}
+
+	return ""
+}
+
+// encodingAccepted check the q parameter of Accept-Encoding item, q=0 means not acceptable
+func encodingAccepted(params []string) bool {
+	for _, param := range params {
+		param = strings.TrimSpace(param)
+
+		if !strings.HasPrefix(param, "q=") {
+			continue
+		}
+
+		q, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64)
+
+		if err != nil || q <= 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// encodeBody compress buff with content encoding gzip or deflate
+func encodeBody(encoding string, level int, buff []byte) ([]byte, error) {
+	var out bytes.Buffer
+
+	var writer io.WriteCloser
+	var err error
+
+	switch encoding {
+	case "gzip":
+		writer, err = gzip.NewWriterLevel(&out, level)
+	case "deflate":
+		writer, err = zlib.NewWriterLevel(&out, level)
+	default:
+		return nil, errors.Wrap(errUnsupportedEncoding, "content encoding %s", encoding)
+	}
+
+	if err != nil {
+		return nil, errors.Wrap(err, "create %s writer error", encoding)
+	}
+
+	if _, err := writer.Write(buff); err != nil {
+		return nil, errors.Wrap(err, "%s compress error", encoding)
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, errors.Wrap(err, "%s compress error", encoding)
+	}
+
+	return out.Bytes(), nil
+}
+
+// decodeBody wrap reader with decompressor of content encoding, empty and identity encoding return reader as is
+func decodeBody(encoding string, reader io.Reader) (io.Reader, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "identity":
+		return reader, nil
+	case "gzip", "x-gzip":
+		gzipReader, err := gzip.NewReader(reader)
+
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid gzip body")
+		}
+
+		return gzipReader, nil
+	case "deflate":
+		zlibReader, err := zlib.NewReader(reader)
+
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid deflate body")
+		}
+
+		return zlibReader, nil
+	}
+
+	return nil, errors.Wrap(errUnsupportedEncoding, "content encoding %s", encoding)
+}
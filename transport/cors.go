@@ -0,0 +1,119 @@
+package transport
+
+import (
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORS cross-origin resource sharing policy
+type CORS struct {
+	AllowedOrigins   []string      // exact origin, "*" or glob pattern, e.g. "https://*.example.com"
+	AllowedMethods   []string      // allowed methods of preflight request, default POST, GET, OPTIONS
+	AllowedHeaders   []string      // allowed headers of preflight request, default Content-Type, Accept, Authorization
+	AllowCredentials bool          // set Access-Control-Allow-Credentials
+	MaxAge           time.Duration // preflight result cache duration, zero means not set
+}
+
+func (cors *CORS) allowOrigin(origin string) bool {
+	for _, allowed := range cors.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+
+		if matched, err := path.Match(strings.ToLower(allowed), strings.ToLower(origin)); err == nil && matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (cors *CORS) allowAnyOrigin() bool {
+	for _, allowed := range cors.AllowedOrigins {
+		if allowed == "*" {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (cors *CORS) allowedMethods() []string {
+	if len(cors.AllowedMethods) == 0 {
+		return []string{http.MethodPost, http.MethodGet, http.MethodOptions}
+	}
+
+	return cors.AllowedMethods
+}
+
+func (cors *CORS) allowedHeaders() []string {
+	if len(cors.AllowedHeaders) == 0 {
+		return []string{"Content-Type", "Accept", "Authorization"}
+	}
+
+	return cors.AllowedHeaders
+}
+
+// checkOrigin websocket upgrader origin check, requests without Origin header come from non-browser clients
+func (cors *CORS) checkOrigin(req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+
+	if origin == "" {
+		return true
+	}
+
+	return cors.allowOrigin(origin)
+}
+
+// handle write CORS response headers, returns true if the request is a preflight request and has been answered
+func (cors *CORS) handle(writer http.ResponseWriter, req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+
+	if origin == "" {
+		return false
+	}
+
+	preflight := req.Method == http.MethodOptions && req.Header.Get("Access-Control-Request-Method") != ""
+
+	header := writer.Header()
+
+	header.Add("Vary", "Origin")
+
+	if !cors.allowOrigin(origin) {
+		if preflight {
+			writer.WriteHeader(http.StatusForbidden)
+		}
+
+		return preflight
+	}
+
+	if cors.allowAnyOrigin() && !cors.AllowCredentials {
+		header.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		header.Set("Access-Control-Allow-Origin", origin)
+	}
+
+	if cors.AllowCredentials {
+		header.Set("Access-Control-Allow-Credentials", "true")
+	}
+
+	if !preflight {
+		return false
+	}
+
+	header.Add("Vary", "Access-Control-Request-Method")
+	header.Add("Vary", "Access-Control-Request-Headers")
+	header.Set("Access-Control-Allow-Methods", strings.Join(cors.allowedMethods(), ", "))
+	header.Set("Access-Control-Allow-Headers", strings.Join(cors.allowedHeaders(), ", "))
+
+	if cors.MaxAge > 0 {
+		header.Set("Access-Control-Max-Age", strconv.Itoa(int(cors.MaxAge/time.Second)))
+	}
+
+	writer.WriteHeader(http.StatusNoContent)
+
+	return true
+}
@@ -0,0 +1,243 @@
+package transport
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	"github.com/libs4go/jsonrpc"
+	"github.com/libs4go/slf4go"
+)
+
+// DispatchLimit concurrency limits of stream transport (websocket, unix) dispatching
+type DispatchLimit struct {
+	MaxConcurrent     int  // max concurrent dispatching of all connections, 0 means unlimited
+	MaxConnConcurrent int  // max concurrent dispatching of each connection, default 64 if 0, negative means unlimited
+	QueueSize         int  // max requests of each connection waiting for dispatching, default 256 if 0, negative disables queueing
+	Sequential        bool // dispatch requests of each connection strictly in order, for services with ordering semantics
+}
+
+// DefaultDispatchLimit default dispatch limits of stream transports, also fills zero fields of user limits
+var DefaultDispatchLimit = DispatchLimit{
+	MaxConnConcurrent: 64,
+	QueueSize:         256,
+}
+
+// newGlobalLimiter create semaphore shared by all connections of one server, returns nil if unlimited
+func newGlobalLimiter(limit DispatchLimit) chan struct{} {
+	if limit.MaxConcurrent <= 0 {
+		return nil
+	}
+
+	return make(chan struct{}, limit.MaxConcurrent)
+}
+
+type holdKey struct{}
+
+// withHold bind dispatch hold of one request to ctx, the returned function waits until all holds are released
+func withHold(ctx context.Context) (context.Context, func()) {
+	hold := &sync.WaitGroup{}
+
+	return context.WithValue(ctx, holdKey{}, hold), hold.Wait
+}
+
+// Hold keep the dispatch slot of current request (concurrency limits and sequential order) occupied after
+// Dispatch returned, until the returned function is called, e.g. by handler outliving its timed out call.
+// It does nothing for transports without dispatch slots
+func Hold(ctx context.Context) func() {
+	hold, ok := ctx.Value(holdKey{}).(*sync.WaitGroup)
+
+	if !ok {
+		return func() {}
+	}
+
+	hold.Add(1)
+
+	var once sync.Once
+
+	return func() {
+		once.Do(hold.Done)
+	}
+}
+
+// busyQueueSize max busy responses of each connection waiting for writing, more are dropped
+const busyQueueSize = 16
+
+// connDispatcher dispatch requests of one connection, requests exceeding the concurrency limit are queued,
+// and rejected with RPCServerBusy error when the queue is full
+type connDispatcher struct {
+	sync.Mutex
+	slf4go.Logger
+	ctx        context.Context
+	global     chan struct{}
+	queue      chan []byte
+	workers    int
+	maxWorkers int
+	busy       chan []byte // busy responses written by one goroutine, so slow peers never stall the read loop
+	busyWriter bool        // busy responses writing goroutine running
+	handle     func(message []byte)
+	reply      func(buff []byte)
+}
+
+func newConnDispatcher(ctx context.Context, logger slf4go.Logger, limit DispatchLimit, global chan struct{}, handle func(message []byte), reply func(buff []byte)) *connDispatcher {
+	maxWorkers := limit.MaxConnConcurrent
+
+	if maxWorkers == 0 {
+		maxWorkers = DefaultDispatchLimit.MaxConnConcurrent
+	}
+
+	if limit.Sequential {
+		maxWorkers = 1
+	}
+
+	queueSize := limit.QueueSize
+
+	if queueSize == 0 {
+		queueSize = DefaultDispatchLimit.QueueSize
+	}
+
+	if queueSize < 0 {
+		queueSize = 0
+	}
+
+	return &connDispatcher{
+		Logger:     logger,
+		ctx:        ctx,
+		global:     global,
+		queue:      make(chan []byte, queueSize),
+		maxWorkers: maxWorkers,
+		busy:       make(chan []byte, busyQueueSize),
+		handle:     handle,
+		reply:      reply,
+	}
+}
+
+// Dispatch dispatch message without blocking the read loop
+func (dispatcher *connDispatcher) Dispatch(message []byte) {
+	dispatcher.Lock()
+
+	if dispatcher.maxWorkers <= 0 || dispatcher.workers < dispatcher.maxWorkers {
+		dispatcher.workers++
+		dispatcher.Unlock()
+
+		go dispatcher.work(message)
+
+		return
+	}
+
+	select {
+	case dispatcher.queue <- message:
+		dispatcher.Unlock()
+		return
+	default:
+	}
+
+	dispatcher.Unlock()
+
+	dispatcher.reject(message)
+}
+
+// work handle message and then queued messages until the queue is empty,
+// the queue is checked under lock so sequential mode never reorders requests
+func (dispatcher *connDispatcher) work(message []byte) {
+	for {
+		if !dispatcher.acquire() {
+			return
+		}
+
+		dispatcher.handle(message)
+
+		dispatcher.release()
+
+		dispatcher.Lock()
+
+		select {
+		case message = <-dispatcher.queue:
+			dispatcher.Unlock()
+		default:
+			dispatcher.workers--
+			dispatcher.Unlock()
+			return
+		}
+	}
+}
+
+func (dispatcher *connDispatcher) acquire() bool {
+	if dispatcher.global == nil {
+		return true
+	}
+
+	select {
+	case dispatcher.global <- struct{}{}:
+		return true
+	case <-dispatcher.ctx.Done():
+		return false
+	}
+}
+
+func (dispatcher *connDispatcher) release() {
+	if dispatcher.global != nil {
+		<-dispatcher.global
+	}
+}
+
+// reject reply server busy error without blocking the read loop, notifications are dropped silently
+func (dispatcher *connDispatcher) reject(message []byte) {
+	var request struct {
+		ID *uint `json:"id"`
+	}
+
+	if err := json.Unmarshal(message, &request); err != nil || request.ID == nil {
+		dispatcher.W("dispatch queue full, drop message")
+		return
+	}
+
+	dispatcher.W("dispatch queue full, reject request {@id}", *request.ID)
+
+	buff, err := json.Marshal(&errorResponse{
+		JSONRPC: "2.0",
+		Error: &jsonrpc.RPCError{
+			Code:    jsonrpc.RPCServerBusy,
+			Message: "server busy",
+		},
+		ID: request.ID,
+	})
+
+	if err != nil {
+		dispatcher.E("marshal busy response error {@err}", err)
+		return
+	}
+
+	dispatcher.Lock()
+	defer dispatcher.Unlock()
+
+	select {
+	case dispatcher.busy <- buff:
+	default:
+		dispatcher.W("busy response queue full, drop busy response of request {@id}", *request.ID)
+		return
+	}
+
+	if !dispatcher.busyWriter {
+		dispatcher.busyWriter = true
+
+		go dispatcher.writeBusy()
+	}
+}
+
+// writeBusy write queued busy responses until the queue is empty
+func (dispatcher *connDispatcher) writeBusy() {
+	for {
+		dispatcher.Lock()
+
+		select {
+		case buff := <-dispatcher.busy:
+			dispatcher.Unlock()
+			dispatcher.reply(buff)
+		default:
+			dispatcher.busyWriter = false
+			dispatcher.Unlock()
+			return
+		}
+	}
+}
@@ -3,71 +3,493 @@ package transport
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
 	"io"
+	"mime"
 	"net/http"
 	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/libs4go/errors"
 	"github.com/libs4go/jsonrpc"
+	"github.com/libs4go/jsonrpc/trace"
 	"github.com/libs4go/slf4go"
 )
 
 type HTTPServer struct {
 	slf4go.Logger
 	jsonrpc.Server
+	getMethods     []string
+	maxRequestSize int64
+	cors           *CORS
+	compression    *Compression
+	requests       drain
 }
 
-func ServeHTTP(server jsonrpc.Server) *HTTPServer {
-	return &HTTPServer{
-		Logger: slf4go.Get("JSONRPC-TRANSPORT-HTTP-SERVER"),
-		Server: server,
+type HTTPServerOps func(*HTTPServer)
+
+// HTTPAllowGET accept GET request with query encoded method, params and id for read-only methods,
+// methods are names or glob patterns, e.g. "Get*".
+//
+// GET requests are sent cross-site by plain links and images without CORS preflight,
+// and carry the browser's cookies, so only allow methods without side effects (CSRF).
+func HTTPAllowGET(methods ...string) HTTPServerOps {
+	return func(server *HTTPServer) {
+		server.getMethods = append(server.getMethods, methods...)
+	}
+}
+
+// HTTPMaxRequestSize set max request body size, default 5MB
+func HTTPMaxRequestSize(size int64) HTTPServerOps {
+	return func(server *HTTPServer) {
+		server.maxRequestSize = size
+	}
+}
+
+// HTTPCORS enable CORS handling with policy
+func HTTPCORS(cors *CORS) HTTPServerOps {
+	return func(server *HTTPServer) {
+		server.cors = cors
+	}
+}
+
+// HTTPCompression compress responses with gzip or deflate negotiated by Accept-Encoding,
+// compressed requests are always decoded by Content-Encoding
+func HTTPCompression(compression Compression) HTTPServerOps {
+	return func(server *HTTPServer) {
+		server.compression = &compression
 	}
 }
 
+func ServeHTTP(server jsonrpc.Server, ops ...HTTPServerOps) *HTTPServer {
+	httpServer := &HTTPServer{
+		Logger:         slf4go.Get("JSONRPC-TRANSPORT-HTTP-SERVER"),
+		Server:         server,
+		maxRequestSize: 5 * 1024 * 1024,
+	}
+
+	for _, op := range ops {
+		op(httpServer)
+	}
+
+	return httpServer
+}
+
 func (server *HTTPServer) ServeHTTP(writer http.ResponseWriter, resq *http.Request) {
 	defer resq.Body.Close()
 
-	buff, err := io.ReadAll(resq.Body)
+	if !server.requests.enter() {
+		writer.Header().Set("Connection", "close")
+		writeRPCError(writer, http.StatusServiceUnavailable, jsonrpc.RPCShuttingDown, "server shutting down")
+		return
+	}
 
-	if err != nil {
-		writer.WriteHeader(http.StatusBadRequest)
-		writer.Write([]byte("read http body error"))
+	defer server.requests.leave()
+
+	if server.cors != nil && server.cors.handle(writer, resq) {
+		return
+	}
+
+	if !acceptJSON(resq.Header.Get("Accept")) {
+		writeRPCError(writer, http.StatusNotAcceptable, jsonrpc.RPCInvalidRequest, "response content type application/json not acceptable")
+		return
+	}
+
+	var buff []byte
+	var err error
+
+	switch {
+	case resq.Method == http.MethodPost:
+		if !isJSONContentType(resq.Header.Get("Content-Type")) {
+			writeRPCError(writer, http.StatusUnsupportedMediaType, jsonrpc.RPCInvalidRequest, "unsupported content type, expect application/json")
+			return
+		}
+
+		body, err := decodeBody(resq.Header.Get("Content-Encoding"), resq.Body)
+
+		if errors.Is(err, errUnsupportedEncoding) {
+			writeRPCError(writer, http.StatusUnsupportedMediaType, jsonrpc.RPCInvalidRequest, "unsupported content encoding, expect gzip or deflate")
+			return
+		}
+
+		if err != nil {
+			writeRPCError(writer, http.StatusBadRequest, jsonrpc.RPCInvalidRequest, "invalid compressed body")
+			return
+		}
+
+		// max request size limits the decoded body
+		buff, err = io.ReadAll(io.LimitReader(body, server.maxRequestSize+1))
+
+		if err != nil {
+			writeRPCError(writer, http.StatusBadRequest, jsonrpc.RPCInvalidRequest, "read http body error")
+			return
+		}
+
+		if int64(len(buff)) > server.maxRequestSize {
+			writeRPCError(writer, http.StatusRequestEntityTooLarge, jsonrpc.RPCInvalidRequest, fmt.Sprintf("request body exceeds %d bytes", server.maxRequestSize))
+			return
+		}
+
+	case resq.Method == http.MethodGet && len(server.getMethods) != 0:
+		if method := resq.URL.Query().Get("method"); method != "" && !server.allowGET(method) {
+			writer.Header().Set("Allow", "POST")
+			writeRPCError(writer, http.StatusMethodNotAllowed, jsonrpc.RPCInvalidRequest, fmt.Sprintf("http method GET not allowed for %s", method))
+			return
+		}
+
+		buff, err = requestFromQuery(resq.URL.Query())
+
+		if err != nil {
+			writeRPCError(writer, http.StatusBadRequest, jsonrpc.RPCInvalidRequest, err.Error())
+			return
+		}
+
+	default:
+		if len(server.getMethods) != 0 {
+			writer.Header().Set("Allow", "GET, POST")
+		} else {
+			writer.Header().Set("Allow", "POST")
+		}
+
+		writeRPCError(writer, http.StatusMethodNotAllowed, jsonrpc.RPCInvalidRequest, fmt.Sprintf("http method %s not allowed", resq.Method))
 		return
 	}
 
-	respBuff, err := server.Dispatch(context.Background(), buff)
+	ctx, session := newSessionContext(resq.Context(), newHTTPPeer("http", resq), nil)
+
+	defer session.close()
+
+	ctx = context.WithValue(ctx, responseHeaderKey{}, writer.Header())
+
+	respBuff, err := server.Dispatch(ctx, buff)
 
 	if err != nil {
-		writer.WriteHeader(http.StatusInternalServerError)
-		server.E("server internal error {@err}", err.Error())
+		switch {
+		case errors.Is(err, jsonrpc.ErrParse):
+			writeRPCError(writer, http.StatusBadRequest, jsonrpc.RPCParseError, "parse error")
+		case errors.Is(err, jsonrpc.ErrDispatcher):
+			// notification errors are never reported to client
+			writer.WriteHeader(http.StatusNoContent)
+		default:
+			writeRPCError(writer, http.StatusInternalServerError, jsonrpc.RPCInternalError, "internal error")
+			server.E("server internal error {@err}", err.Error())
+		}
+
 		return
 	}
 
-	if len(respBuff) != 0 {
-		_, err = writer.Write(respBuff)
+	if len(respBuff) == 0 {
+		writer.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+
+	if server.compression != nil {
+		writer.Header().Add("Vary", "Accept-Encoding")
+
+		if encoding := acceptedEncoding(resq.Header.Get("Accept-Encoding")); encoding != "" && server.compression.compress(len(respBuff)) {
+			if compressed, err := encodeBody(encoding, server.compression.level(), respBuff); err != nil {
+				server.E("compress resp error {@err}", err)
+			} else {
+				writer.Header().Set("Content-Encoding", encoding)
+				respBuff = compressed
+			}
+		}
+	}
+
+	_, err = writer.Write(respBuff)
+
+	if err != nil {
+		server.E("server resp write error {@err}", err.Error())
+	}
+}
+
+func (server *HTTPServer) allowGET(method string) bool {
+	for _, pattern := range server.getMethods {
+		if matched, err := path.Match(pattern, method); err == nil && matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Shutdown reject new requests with jsonrpc.RPCShuttingDown error and wait for in-flight requests until ctx done,
+// the wrapped server is shutdown too if it implements jsonrpc.ServerShutdowner
+func (server *HTTPServer) Shutdown(ctx context.Context) error {
+	server.requests.close()
+
+	if err := shutdownServer(ctx, server.Server); err != nil {
+		return err
+	}
+
+	return server.requests.wait(ctx)
+}
+
+// errorResponse jsonrpc error response with null id, used when request id is unknown
+type errorResponse struct {
+	JSONRPC string            `json:"jsonrpc"`
+	Error   *jsonrpc.RPCError `json:"error"`
+	ID      *uint             `json:"id"`
+}
+
+func writeRPCError(writer http.ResponseWriter, status int, code jsonrpc.RPCErrorCode, message string) {
+	buff, _ := json.Marshal(&errorResponse{
+		JSONRPC: "2.0",
+		Error: &jsonrpc.RPCError{
+			Code:    code,
+			Message: message,
+		},
+	})
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	writer.Write(buff)
+}
+
+func isJSONContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+
+	if err != nil {
+		return false
+	}
+
+	switch mediaType {
+	case "application/json", "application/json-rpc", "application/jsonrequest":
+		return true
+	}
+
+	return false
+}
+
+func acceptJSON(accept string) bool {
+	if accept == "" {
+		return true
+	}
+
+	for _, item := range strings.Split(accept, ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(item))
 
 		if err != nil {
-			server.E("server resp write error {@err}", err.Error())
+			continue
+		}
+
+		switch mediaType {
+		case "*/*", "application/*", "application/json", "application/json-rpc", "application/jsonrequest":
+			return true
+		}
+	}
+
+	return false
+}
+
+// requestFromQuery build jsonrpc request from GET query: ?method=xxx&params=[...]&id=1
+func requestFromQuery(query url.Values) ([]byte, error) {
+	method := query.Get("method")
+
+	if method == "" {
+		return nil, errors.New("expect method query parameter")
+	}
+
+	request := &jsonrpc.RPCRequest{
+		JSONRPC: "2.0",
+		Method:  method,
+	}
+
+	if params := query.Get("params"); params != "" {
+		var rawParams json.RawMessage
+
+		if err := json.Unmarshal([]byte(params), &rawParams); err != nil {
+			return nil, errors.New("params query parameter must be json")
+		}
+
+		request.Params = rawParams
+	}
+
+	if id := query.Get("id"); id != "" {
+		value, err := strconv.ParseUint(id, 10, 0)
+
+		if err != nil {
+			return nil, errors.New("id query parameter must be unsigned integer")
+		}
+
+		requestID := uint(value)
+
+		request.ID = &requestID
+	}
+
+	return json.Marshal(request)
+}
+
+// maxHTTPErrorBody max response body length carried by HTTPError
+const maxHTTPErrorBody = 512
+
+// HTTPError http transport error of non-2xx status or non json response body
+type HTTPError struct {
+	StatusCode  int               // http status code
+	ContentType string            // response content type
+	Body        string            // response body, truncated to 512 bytes
+	RPCError    *jsonrpc.RPCError // jsonrpc error object carried by response body, nil if not present
+}
+
+func (err *HTTPError) Error() string {
+	if err.RPCError != nil {
+		return fmt.Sprintf("HTTPError(%d) %s", err.StatusCode, err.RPCError.Error())
+	}
+
+	return fmt.Sprintf("HTTPError(%d) %s: %s", err.StatusCode, http.StatusText(err.StatusCode), err.Body)
+}
+
+func checkHTTPResponse(resp *http.Response, body []byte) error {
+	contentType := resp.Header.Get("Content-Type")
+
+	success := resp.StatusCode >= 200 && resp.StatusCode < 300
+
+	if success && len(body) == 0 {
+		return nil
+	}
+
+	jsonBody := (contentType == "" || isJSONContentType(contentType)) && json.Valid(body)
+
+	if success && jsonBody {
+		return nil
+	}
+
+	httpErr := &HTTPError{
+		StatusCode:  resp.StatusCode,
+		ContentType: contentType,
+		Body:        string(body),
+	}
+
+	if len(body) > maxHTTPErrorBody {
+		httpErr.Body = string(body[:maxHTTPErrorBody])
+	}
+
+	if jsonBody {
+		var errResp *errorResponse
+
+		if err := json.Unmarshal(body, &errResp); err == nil && errResp != nil {
+			httpErr.RPCError = errResp.Error
 		}
 	}
+
+	return httpErr
 }
 
 // HTTP client transport
 type httpClientTransport struct {
-	u             *url.URL
-	recv          chan []byte
-	client        *http.Client
-	customHeaders map[string]string
+	slf4go.Logger
+	u               *url.URL
+	recv            chan []byte
+	client          *http.Client
+	customHeaders   map[string]string
+	headerProviders []HTTPHeaderProvider
+	tlsConfig       *tls.Config
+	certFiles       [][2]string
+	caFiles         []string
+	timeout         time.Duration
+	compression     *Compression
 }
 
 type HTTPClientOps func(*httpClientTransport)
 
+// HTTPHeaderProvider provide headers for every request, e.g. rotating access token
+type HTTPHeaderProvider func(ctx context.Context) (http.Header, error)
+
 func HTTPHeaders(headers map[string]string) HTTPClientOps {
 	return func(hct *httpClientTransport) {
 		hct.customHeaders = headers
 	}
 }
 
+// HTTPDynamicHeaders add dynamic header provider, providers are called in order for every request
+func HTTPDynamicHeaders(provider HTTPHeaderProvider) HTTPClientOps {
+	return func(hct *httpClientTransport) {
+		hct.headerProviders = append(hct.headerProviders, provider)
+	}
+}
+
+// HTTPBasicAuth set basic authorization header
+func HTTPBasicAuth(username, password string) HTTPClientOps {
+	credentials := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+
+	return HTTPDynamicHeaders(func(ctx context.Context) (http.Header, error) {
+		return http.Header{"Authorization": []string{"Basic " + credentials}}, nil
+	})
+}
+
+// HTTPBearerToken set static bearer authorization header
+func HTTPBearerToken(token string) HTTPClientOps {
+	return HTTPBearerTokenProvider(func(ctx context.Context) (string, error) {
+		return token, nil
+	})
+}
+
+// HTTPBearerTokenProvider set bearer authorization header, the token provider is called for every request
+func HTTPBearerTokenProvider(provider func(ctx context.Context) (string, error)) HTTPClientOps {
+	return HTTPDynamicHeaders(func(ctx context.Context) (http.Header, error) {
+		token, err := provider(ctx)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return http.Header{"Authorization": []string{"Bearer " + token}}, nil
+	})
+}
+
+// HTTPClient use custom http client instead of http.DefaultClient
+func HTTPClient(client *http.Client) HTTPClientOps {
+	return func(hct *httpClientTransport) {
+		hct.client = client
+	}
+}
+
+// HTTPTLSConfig set tls config of the underlying http transport
+func HTTPTLSConfig(config *tls.Config) HTTPClientOps {
+	return func(hct *httpClientTransport) {
+		hct.tlsConfig = config
+	}
+}
+
+// HTTPClientCertFile load tls client certificate from PEM encoded files
+func HTTPClientCertFile(certFile, keyFile string) HTTPClientOps {
+	return func(hct *httpClientTransport) {
+		hct.certFiles = append(hct.certFiles, [2]string{certFile, keyFile})
+	}
+}
+
+// HTTPRootCAFile load PEM encoded root CAs used to verify server certificate
+func HTTPRootCAFile(caFiles ...string) HTTPClientOps {
+	return func(hct *httpClientTransport) {
+		hct.caFiles = append(hct.caFiles, caFiles...)
+	}
+}
+
+// HTTPTimeout set per request timeout, the smaller of timeout and ctx deadline wins
+func HTTPTimeout(duration time.Duration) HTTPClientOps {
+	return func(hct *httpClientTransport) {
+		hct.timeout = duration
+	}
+}
+
+// HTTPClientCompression gzip request bodies and accept gzip or deflate encoded responses,
+// the server must support compressed requests
+func HTTPClientCompression(compression Compression) HTTPClientOps {
+	return func(hct *httpClientTransport) {
+		hct.compression = &compression
+	}
+}
+
 func NewHTTPClientTransport(serviceURL string, ops ...HTTPClientOps) (jsonrpc.ClientTransport, error) {
 	u, err := url.Parse(serviceURL)
 
@@ -76,6 +498,7 @@ func NewHTTPClientTransport(serviceURL string, ops ...HTTPClientOps) (jsonrpc.Cl
 	}
 
 	transport := &httpClientTransport{
+		Logger:        slf4go.Get("JSONRPC-TRANSPORT-HTTP-CLIENT"),
 		u:             u,
 		recv:          make(chan []byte, 100),
 		client:        http.DefaultClient,
@@ -86,16 +509,101 @@ func NewHTTPClientTransport(serviceURL string, ops ...HTTPClientOps) (jsonrpc.Cl
 		op(transport)
 	}
 
+	if err := transport.setupTLS(); err != nil {
+		return nil, err
+	}
+
 	return transport, nil
 }
 
+func (transport *httpClientTransport) setupTLS() error {
+	if transport.tlsConfig == nil && len(transport.certFiles) == 0 && len(transport.caFiles) == 0 {
+		return nil
+	}
+
+	var tlsConfig *tls.Config
+
+	if transport.tlsConfig != nil {
+		tlsConfig = transport.tlsConfig.Clone()
+	} else {
+		tlsConfig = &tls.Config{}
+	}
+
+	for _, files := range transport.certFiles {
+		cert, err := tls.LoadX509KeyPair(files[0], files[1])
+
+		if err != nil {
+			return errors.Wrap(err, "load client cert %s error", files[0])
+		}
+
+		tlsConfig.Certificates = append(tlsConfig.Certificates, cert)
+	}
+
+	if len(transport.caFiles) != 0 {
+		if tlsConfig.RootCAs == nil {
+			tlsConfig.RootCAs = x509.NewCertPool()
+		}
+
+		for _, caFile := range transport.caFiles {
+			pem, err := os.ReadFile(caFile)
+
+			if err != nil {
+				return errors.Wrap(err, "read root ca %s error", caFile)
+			}
+
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+				return errors.New(fmt.Sprintf("invalid root ca file %s", caFile))
+			}
+		}
+	}
+
+	var roundTripper *http.Transport
+
+	switch t := transport.client.Transport.(type) {
+	case nil:
+		roundTripper = http.DefaultTransport.(*http.Transport).Clone()
+	case *http.Transport:
+		roundTripper = t.Clone()
+	default:
+		return errors.New(fmt.Sprintf("can't apply tls config to http client transport %T", t))
+	}
+
+	roundTripper.TLSClientConfig = tlsConfig
+
+	client := *transport.client
+
+	client.Transport = roundTripper
+
+	transport.client = &client
+
+	return nil
+}
+
 func (transport *httpClientTransport) Close() {
 	close(transport.recv)
 }
 
 func (transport *httpClientTransport) Send(ctx context.Context, body []byte) (err error) {
 
-	request, err := http.NewRequest("POST", transport.u.String(), bytes.NewReader(body))
+	if transport.timeout > 0 {
+		var cancelF context.CancelFunc
+		ctx, cancelF = context.WithTimeout(ctx, transport.timeout)
+		defer cancelF()
+	}
+
+	contentEncoding := ""
+
+	if transport.compression.compress(len(body)) {
+		body, err = encodeBody("gzip", transport.compression.level(), body)
+
+		if err != nil {
+			return err
+		}
+
+		contentEncoding = "gzip"
+	}
+
+	request, err := http.NewRequestWithContext(ctx, "POST", transport.u.String(), bytes.NewReader(body))
 	if err != nil {
 		return errors.Wrap(err, "create post request error")
 	}
@@ -104,27 +612,73 @@ func (transport *httpClientTransport) Send(ctx context.Context, body []byte) (er
 		request.Header.Add(k, v)
 	}
 
-	request.Header.Add("Content-Type", "application/json")
-	request.Header.Add("Accept", "application/json")
+	for _, provider := range transport.headerProviders {
+		headers, err := provider(ctx)
+
+		if err != nil {
+			return errors.Wrap(err, "get dynamic headers error")
+		}
+
+		for k, values := range headers {
+			request.Header.Del(k)
+
+			for _, v := range values {
+				request.Header.Add(k, v)
+			}
+		}
+	}
+
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Accept", "application/json")
+
+	trace.Inject(ctx, request.Header.Set)
+
+	if deadline, ok := jsonrpc.CallDeadline(ctx); ok {
+		request.Header.Set(jsonrpc.TimeoutHeader, jsonrpc.FormatTimeout(time.Until(deadline)))
+	}
+
+	if transport.compression != nil {
+		// explicit Accept-Encoding disables transparent decompression of http.Transport
+		request.Header.Set("Accept-Encoding", "gzip, deflate")
+	}
+
+	if contentEncoding != "" {
+		request.Header.Set("Content-Encoding", contentEncoding)
+	}
 
 	httpResponse, err := transport.client.Do(request)
 
 	if err != nil {
-		println(err.Error())
-		return err
+		transport.D("http request {@url} error {@err}", transport.u.String(), err)
+		return errors.Wrap(err, "http request error")
 	}
 
 	defer httpResponse.Body.Close()
 
-	buff, err := io.ReadAll(httpResponse.Body)
+	respBody, err := decodeBody(httpResponse.Header.Get("Content-Encoding"), httpResponse.Body)
+
+	if err != nil {
+		return errors.Wrap(err, "decode http resp body error")
+	}
+
+	buff, err := io.ReadAll(respBody)
 
 	if err != nil {
 		return errors.Wrap(err, "read http resp body error")
 	}
 
+	if err := checkHTTPResponse(httpResponse, buff); err != nil {
+		transport.D("http request {@url} error {@err}", transport.u.String(), err)
+		return err
+	}
+
+	if len(buff) == 0 {
+		return nil
+	}
+
 	defer func() {
-		if e := recover(); err != nil {
-			err = e.(error)
+		if e := recover(); e != nil {
+			err = errors.Wrap(jsonrpc.ErrClose, "http transport closed")
 		}
 	}()
 
@@ -133,6 +687,11 @@ func (transport *httpClientTransport) Send(ctx context.Context, body []byte) (er
 	return nil
 }
 
+// HeaderMeta implement jsonrpc.HeaderTransport, trace context and timeout are sent as http headers
+func (transport *httpClientTransport) HeaderMeta() bool {
+	return true
+}
+
 func (transport *httpClientTransport) Recv() <-chan []byte {
 	return transport.recv
 }
@@ -0,0 +1,127 @@
+package transport
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/libs4go/errors"
+	"github.com/libs4go/jsonrpc"
+)
+
+// KeepAlive websocket keepalive settings
+type KeepAlive struct {
+	PingInterval time.Duration // ping interval, zero disables ping and dead peer detection
+	PongTimeout  time.Duration // max duration waiting for pong, default PingInterval
+	IdleTimeout  time.Duration // close connection if no data message received for the duration, zero disables
+}
+
+// keeper run keepalive over websocket connection
+type keeper struct {
+	sync.Mutex
+	KeepAlive
+	conn      *websocket.Conn
+	idleTimer *time.Timer
+	done      chan struct{}
+	stopOnce  sync.Once
+	reason    error
+}
+
+func startKeepAlive(conn *websocket.Conn, keepAlive KeepAlive) *keeper {
+	if keepAlive.PingInterval > 0 && keepAlive.PongTimeout <= 0 {
+		keepAlive.PongTimeout = keepAlive.PingInterval
+	}
+
+	k := &keeper{
+		KeepAlive: keepAlive,
+		conn:      conn,
+		done:      make(chan struct{}),
+	}
+
+	if k.PingInterval > 0 {
+		conn.SetReadDeadline(time.Now().Add(k.PingInterval + k.PongTimeout))
+
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(k.PingInterval + k.PongTimeout))
+		})
+
+		go k.pingLoop()
+	}
+
+	if k.IdleTimeout > 0 {
+		k.idleTimer = time.AfterFunc(k.IdleTimeout, func() {
+			k.fail(errors.Wrap(jsonrpc.ErrDisconnect, "idle timeout %s", k.IdleTimeout))
+		})
+	}
+
+	return k
+}
+
+func (k *keeper) pingLoop() {
+	ticker := time.NewTicker(k.PingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-k.done:
+			return
+		case <-ticker.C:
+			if err := k.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(k.PongTimeout)); err != nil {
+				k.fail(errors.Wrap(jsonrpc.ErrDisconnect, "send ping error, %s", err))
+				return
+			}
+		}
+	}
+}
+
+// touch record data message received from peer
+func (k *keeper) touch() {
+	if k.PingInterval > 0 {
+		k.conn.SetReadDeadline(time.Now().Add(k.PingInterval + k.PongTimeout))
+	}
+
+	if k.idleTimer != nil {
+		k.idleTimer.Reset(k.IdleTimeout)
+	}
+}
+
+// fail close connection with reason, the blocking read returns error immediately
+func (k *keeper) fail(reason error) {
+	k.Lock()
+
+	if k.reason == nil {
+		k.reason = reason
+	}
+
+	k.Unlock()
+
+	k.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "keepalive failure"), time.Now().Add(time.Second))
+
+	k.conn.Close()
+}
+
+// err returns the keepalive failure reason or the read error
+func (k *keeper) err(readErr error) error {
+	k.Lock()
+	defer k.Unlock()
+
+	if k.reason != nil {
+		return k.reason
+	}
+
+	if netErr, ok := readErr.(interface{ Timeout() bool }); ok && netErr.Timeout() {
+		return errors.Wrap(jsonrpc.ErrDisconnect, "pong timeout, %s", readErr)
+	}
+
+	return errors.Wrap(jsonrpc.ErrDisconnect, "read error, %s", readErr)
+}
+
+func (k *keeper) stop() {
+	k.stopOnce.Do(func() {
+		close(k.done)
+
+		if k.idleTimer != nil {
+			k.idleTimer.Stop()
+		}
+	})
+}
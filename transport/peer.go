@@ -0,0 +1,79 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/url"
+)
+
+type peerKey struct{}
+
+// Peer remote peer information bound to request context by transport
+type Peer struct {
+	Transport  string               // transport name, e.g. "http", "ws", "unix"
+	RemoteAddr string               // remote address
+	Cred       *PeerCred            // unix domain socket peer credentials, nil if not available
+	Header     http.Header          // http request headers, nil for non http transport
+	URL        *url.URL             // http request url, nil for non http transport
+	TLS        *tls.ConnectionState // tls connection state, nil if connection is not over tls
+}
+
+// PeerCred unix domain socket peer credentials (SO_PEERCRED)
+type PeerCred struct {
+	UID uint32
+	GID uint32
+	PID int32
+}
+
+// WithPeer bind peer information to context
+func WithPeer(ctx context.Context, peer *Peer) context.Context {
+	return context.WithValue(ctx, peerKey{}, peer)
+}
+
+// PeerFromContext get peer information bound by transport
+func PeerFromContext(ctx context.Context) (*Peer, bool) {
+	peer, ok := ctx.Value(peerKey{}).(*Peer)
+
+	return peer, ok
+}
+
+func newHTTPPeer(transport string, req *http.Request) *Peer {
+	return &Peer{
+		Transport:  transport,
+		RemoteAddr: req.RemoteAddr,
+		Header:     req.Header,
+		URL:        req.URL,
+		TLS:        req.TLS,
+	}
+}
+
+type pusherKey struct{}
+
+// Pusher push message to the remote peer of current connection
+type Pusher interface {
+	Push(ctx context.Context, buff []byte) error
+}
+
+// WithPusher bind connection pusher to context
+func WithPusher(ctx context.Context, pusher Pusher) context.Context {
+	return context.WithValue(ctx, pusherKey{}, pusher)
+}
+
+// PusherFromContext get connection pusher bound by transport,
+// returns false if the transport does not support server push, e.g. http
+func PusherFromContext(ctx context.Context) (Pusher, bool) {
+	pusher, ok := ctx.Value(pusherKey{}).(Pusher)
+
+	return pusher, ok
+}
+
+type responseHeaderKey struct{}
+
+// ResponseHeaderFromContext get http response header of current request, handlers and interceptors may set
+// headers before the response is written, returns false for non http transport
+func ResponseHeaderFromContext(ctx context.Context) (http.Header, bool) {
+	header, ok := ctx.Value(responseHeaderKey{}).(http.Header)
+
+	return header, ok
+}
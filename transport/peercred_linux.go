@@ -0,0 +1,40 @@
+//go:build linux
+// +build linux
+
+package transport
+
+import (
+	"net"
+	"syscall"
+
+	"github.com/libs4go/errors"
+)
+
+func readPeerCred(conn *net.UnixConn) (*PeerCred, error) {
+	rawConn, err := conn.SyscallConn()
+
+	if err != nil {
+		return nil, errors.Wrap(err, "get raw conn error")
+	}
+
+	var ucred *syscall.Ucred
+	var credErr error
+
+	err = rawConn.Control(func(fd uintptr) {
+		ucred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+
+	if err != nil {
+		return nil, errors.Wrap(err, "control raw conn error")
+	}
+
+	if credErr != nil {
+		return nil, errors.Wrap(credErr, "getsockopt SO_PEERCRED error")
+	}
+
+	return &PeerCred{
+		UID: ucred.Uid,
+		GID: ucred.Gid,
+		PID: ucred.Pid,
+	}, nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package transport
+
+import (
+	"net"
+
+	"github.com/libs4go/errors"
+)
+
+func readPeerCred(conn *net.UnixConn) (*PeerCred, error) {
+	return nil, errors.New("SO_PEERCRED not supported on this platform")
+}
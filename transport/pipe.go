@@ -0,0 +1,305 @@
+package transport
+
+import (
+	"context"
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"github.com/libs4go/errors"
+	"github.com/libs4go/jsonrpc"
+	"github.com/libs4go/slf4go"
+)
+
+// Pipe in-memory transport pair, connect client directly to jsonrpc server without socket.
+//
+// Pipe implements jsonrpc.ClientTransport for the client side, the server side can push
+// messages to client by calling Push.
+//
+// Requests are dispatched one at a time in send order, and drop/reorder decisions depend only on the seed
+// and message order, so a fault injected run is reproducible.
+type Pipe struct {
+	pending int64 // requests sent but not dispatched yet, first field for 64-bit atomic alignment
+	slf4go.Logger
+	jsonrpc.Server
+	recv        chan []byte
+	toServer    *pipeLink
+	toClient    *pipeLink
+	ctx         context.Context
+	cancelF     context.CancelFunc
+	sessionCtx  context.Context
+	session     *Session
+	latency     time.Duration
+	reorderRate float64
+	dropRate    float64
+	seed        int64
+	bufferSize  int
+}
+
+type PipeOps func(*Pipe)
+
+// PipeLatency inject latency for every message in both directions, counted from its own send
+func PipeLatency(duration time.Duration) PipeOps {
+	return func(pipe *Pipe) {
+		pipe.latency = duration
+	}
+}
+
+// PipeReorderRate set the probability of server to client message being delivered after the next one,
+// or alone once the server has no request left to answer
+func PipeReorderRate(rate float64) PipeOps {
+	return func(pipe *Pipe) {
+		pipe.reorderRate = rate
+	}
+}
+
+// PipeDropRate set the probability of message being dropped in both directions
+func PipeDropRate(rate float64) PipeOps {
+	return func(pipe *Pipe) {
+		pipe.dropRate = rate
+	}
+}
+
+// PipeSeed set random seed of drop/reorder decisions, default 1
+func PipeSeed(seed int64) PipeOps {
+	return func(pipe *Pipe) {
+		pipe.seed = seed
+	}
+}
+
+// PipeBufferSize set message buffer size of each direction, default 100
+func PipeBufferSize(size int) PipeOps {
+	return func(pipe *Pipe) {
+		pipe.bufferSize = size
+	}
+}
+
+// NewPipe create in-memory transport pair connected to server
+func NewPipe(server jsonrpc.Server, ops ...PipeOps) *Pipe {
+	pipe := &Pipe{
+		Logger:     slf4go.Get("JSONRPC-TRANSPORT-PIPE"),
+		Server:     server,
+		seed:       1,
+		bufferSize: 100,
+	}
+
+	for _, op := range ops {
+		op(pipe)
+	}
+
+	pipe.ctx, pipe.cancelF = context.WithCancel(context.Background())
+
+	pipe.sessionCtx, pipe.session = newSessionContext(pipe.ctx, &Peer{
+		Transport:  "pipe",
+		RemoteAddr: "pipe",
+	}, pipe)
+
+	pipe.recv = make(chan []byte, pipe.bufferSize)
+
+	idle := make(chan struct{}, 1)
+
+	pipe.toServer = &pipeLink{
+		ctx:      pipe.ctx,
+		queue:    make(chan pipeMessage, pipe.bufferSize),
+		rand:     rand.New(rand.NewSource(pipe.seed)),
+		latency:  pipe.latency,
+		dropRate: pipe.dropRate,
+		deliver:  pipe.dispatch,
+		settle: func() {
+			// wake up client link holding reordered message, no more response is coming
+			if atomic.AddInt64(&pipe.pending, -1) == 0 {
+				select {
+				case idle <- struct{}{}:
+				default:
+				}
+			}
+		},
+	}
+
+	pipe.toClient = &pipeLink{
+		ctx:         pipe.ctx,
+		queue:       make(chan pipeMessage, pipe.bufferSize),
+		rand:        rand.New(rand.NewSource(pipe.seed + 1)),
+		latency:     pipe.latency,
+		dropRate:    pipe.dropRate,
+		reorderRate: pipe.reorderRate,
+		idle:        idle,
+		busy: func() bool {
+			return atomic.LoadInt64(&pipe.pending) > 0
+		},
+		deliver: func(message []byte) {
+			select {
+			case pipe.recv <- message:
+			case <-pipe.ctx.Done():
+			}
+		},
+	}
+
+	go pipe.toServer.runLoop()
+
+	go func() {
+		defer close(pipe.recv)
+		pipe.toClient.runLoop()
+	}()
+
+	return pipe
+}
+
+func (pipe *Pipe) dispatch(message []byte) {
+	respBuff, err := pipe.Dispatch(pipe.sessionCtx, message)
+
+	if err != nil {
+		pipe.E("server internal error {@err}", err.Error())
+		return
+	}
+
+	if len(respBuff) != 0 {
+		if err := pipe.toClient.send(pipe.ctx, respBuff); err != nil {
+			pipe.E("server resp write error {@err}", err.Error())
+		}
+	}
+}
+
+// Send send message from client to server
+func (pipe *Pipe) Send(ctx context.Context, body []byte) error {
+	if pipe.ctx.Err() != nil {
+		return errors.Wrap(jsonrpc.ErrClose, "pipe closed")
+	}
+
+	atomic.AddInt64(&pipe.pending, 1)
+
+	if err := pipe.toServer.send(ctx, body); err != nil {
+		atomic.AddInt64(&pipe.pending, -1)
+		return err
+	}
+
+	return nil
+}
+
+// Recv client side recv channel
+func (pipe *Pipe) Recv() <-chan []byte {
+	return pipe.recv
+}
+
+// Push push message from server to client
+func (pipe *Pipe) Push(ctx context.Context, body []byte) error {
+	if pipe.ctx.Err() != nil {
+		return errors.Wrap(jsonrpc.ErrClose, "pipe closed")
+	}
+
+	return pipe.toClient.send(ctx, body)
+}
+
+// Close close both directions
+func (pipe *Pipe) Close() error {
+	pipe.cancelF()
+	pipe.session.close()
+	return nil
+}
+
+// pipeLink one direction of pipe, messages are delivered in order by one goroutine,
+// so drop/reorder decisions are deterministic for given seed and message order
+type pipeLink struct {
+	ctx         context.Context
+	queue       chan pipeMessage
+	rand        *rand.Rand
+	latency     time.Duration
+	reorderRate float64
+	dropRate    float64
+	deliver     func([]byte)
+	settle      func()          // called after each message is delivered or dropped, optional
+	idle        <-chan struct{} // signaled when the peer has nothing more to send, optional
+	busy        func() bool     // reports whether the peer may still send, optional
+}
+
+// pipeMessage queued message with its own delivery time
+type pipeMessage struct {
+	body []byte
+	due  time.Time
+}
+
+func (link *pipeLink) send(ctx context.Context, body []byte) error {
+	message := pipeMessage{
+		body: make([]byte, len(body)),
+		due:  time.Now().Add(link.latency),
+	}
+
+	copy(message.body, body)
+
+	select {
+	case link.queue <- message:
+		return nil
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "send message canceled")
+	case <-link.ctx.Done():
+		return errors.Wrap(jsonrpc.ErrClose, "pipe closed")
+	}
+}
+
+func (link *pipeLink) runLoop() {
+	var held []byte
+
+	for {
+		select {
+		case <-link.ctx.Done():
+			return
+		case <-link.idle:
+			held = link.release(held)
+		case message := <-link.queue:
+			if !link.handle(message, &held) {
+				return
+			}
+
+			if held != nil {
+				held = link.release(held)
+			}
+		}
+	}
+}
+
+// handle deliver or drop one message, returns false if link closed while waiting for its delivery time
+func (link *pipeLink) handle(message pipeMessage, held *[]byte) bool {
+	if link.settle != nil {
+		defer link.settle()
+	}
+
+	if link.dropRate > 0 && link.rand.Float64() < link.dropRate {
+		return true
+	}
+
+	if wait := time.Until(message.due); wait > 0 {
+		timer := time.NewTimer(wait)
+
+		select {
+		case <-link.ctx.Done():
+			timer.Stop()
+			return false
+		case <-timer.C:
+		}
+	}
+
+	if *held == nil && link.reorderRate > 0 && link.rand.Float64() < link.reorderRate {
+		*held = message.body
+		return true
+	}
+
+	link.deliver(message.body)
+
+	if *held != nil {
+		link.deliver(*held)
+		*held = nil
+	}
+
+	return true
+}
+
+// release deliver held message alone if no next message can arrive to overtake it
+func (link *pipeLink) release(held []byte) []byte {
+	if held == nil || len(link.queue) != 0 || (link.busy != nil && link.busy()) {
+		return held
+	}
+
+	link.deliver(held)
+
+	return nil
+}
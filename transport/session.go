@@ -0,0 +1,199 @@
+package transport
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+
+	"github.com/libs4go/errors"
+	"github.com/libs4go/jsonrpc"
+)
+
+type sessionKey struct{}
+
+// Session per connection session, stream transports (websocket, unix, pipe) create one session for each
+// connection, http transport creates one session for each request.
+type Session struct {
+	sync.Mutex
+	id          string
+	peer        *Peer
+	pusher      Pusher
+	values      map[interface{}]interface{}
+	closeHooks  []func()
+	closed      chan struct{}
+	closeOnce   sync.Once
+	createMutex sync.Mutex
+	cancelF     context.CancelFunc
+}
+
+func newSession(peer *Peer, pusher Pusher) *Session {
+	var buff [16]byte
+
+	// crypto/rand never fails on supported platforms
+	rand.Read(buff[:])
+
+	return &Session{
+		id:     hex.EncodeToString(buff[:]),
+		peer:   peer,
+		pusher: pusher,
+		values: make(map[interface{}]interface{}),
+		closed: make(chan struct{}),
+	}
+}
+
+// newSessionContext create session and bind session, peer and pusher to context,
+// the returned context is canceled when session closed
+func newSessionContext(ctx context.Context, peer *Peer, pusher Pusher) (context.Context, *Session) {
+	session := newSession(peer, pusher)
+
+	ctx, session.cancelF = context.WithCancel(ctx)
+
+	ctx = WithPeer(ctx, peer)
+
+	if pusher != nil {
+		ctx = WithPusher(ctx, pusher)
+	}
+
+	return context.WithValue(ctx, sessionKey{}, session), session
+}
+
+// SessionFromContext get session bound by transport
+func SessionFromContext(ctx context.Context) (*Session, bool) {
+	session, ok := ctx.Value(sessionKey{}).(*Session)
+
+	return session, ok
+}
+
+// ID session id
+func (session *Session) ID() string {
+	return session.id
+}
+
+// Peer remote peer information
+func (session *Session) Peer() *Peer {
+	return session.peer
+}
+
+// RemoteAddr remote peer address
+func (session *Session) RemoteAddr() string {
+	return session.peer.RemoteAddr
+}
+
+// Get get session value
+func (session *Session) Get(key interface{}) (interface{}, bool) {
+	session.Lock()
+	defer session.Unlock()
+
+	value, ok := session.values[key]
+
+	return value, ok
+}
+
+// Set set session value
+func (session *Session) Set(key interface{}, value interface{}) {
+	session.Lock()
+	defer session.Unlock()
+
+	session.values[key] = value
+}
+
+// Delete delete session value
+func (session *Session) Delete(key interface{}) {
+	session.Lock()
+	defer session.Unlock()
+
+	delete(session.values, key)
+}
+
+// LoadOrCreate get session value, or create and store it by calling create if not exists.
+// Calls of LoadOrCreate are serialized, so create is called at most once for each key,
+// create may use other session methods.
+func (session *Session) LoadOrCreate(key interface{}, create func() (interface{}, error)) (interface{}, error) {
+	session.createMutex.Lock()
+	defer session.createMutex.Unlock()
+
+	if value, ok := session.Get(key); ok {
+		return value, nil
+	}
+
+	value, err := create()
+
+	if err != nil {
+		return nil, err
+	}
+
+	session.Set(key, value)
+
+	return value, nil
+}
+
+// OnClose register hook called when session closed, hooks are called in reverse order of registration.
+// The hook is called immediately if session has already been closed.
+func (session *Session) OnClose(hook func()) {
+	session.Lock()
+
+	select {
+	case <-session.closed:
+		session.Unlock()
+		hook()
+		return
+	default:
+	}
+
+	session.closeHooks = append(session.closeHooks, hook)
+
+	session.Unlock()
+}
+
+// Done closed when session closed
+func (session *Session) Done() <-chan struct{} {
+	return session.closed
+}
+
+// Push push raw message to the peer
+func (session *Session) Push(ctx context.Context, buff []byte) error {
+	if session.pusher == nil {
+		return errors.Wrap(jsonrpc.ErrTransport, "%s transport not support server push", session.peer.Transport)
+	}
+
+	return session.pusher.Push(ctx, buff)
+}
+
+// Notify push jsonrpc notification to the peer
+func (session *Session) Notify(ctx context.Context, method string, args ...interface{}) error {
+	if args == nil {
+		args = make([]interface{}, 0)
+	}
+
+	buff, err := json.Marshal(&jsonrpc.RPCNotification{
+		JSONRPC: "2.0",
+		Method:  method,
+		Params:  args,
+	})
+
+	if err != nil {
+		return errors.Wrap(err, "marshal notification error")
+	}
+
+	return session.Push(ctx, buff)
+}
+
+func (session *Session) close() {
+	session.closeOnce.Do(func() {
+		session.Lock()
+		close(session.closed)
+		hooks := session.closeHooks
+		session.closeHooks = nil
+		session.Unlock()
+
+		if session.cancelF != nil {
+			session.cancelF()
+		}
+
+		for i := len(hooks) - 1; i >= 0; i-- {
+			hooks[i]()
+		}
+	})
+}
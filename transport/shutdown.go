@@ -0,0 +1,87 @@
+package transport
+
+import (
+	"context"
+	"sync"
+
+	"github.com/libs4go/errors"
+	"github.com/libs4go/jsonrpc"
+)
+
+// drain track in-flight work of server transport for graceful shutdown
+type drain struct {
+	sync.Mutex
+	closing bool
+	active  int
+	idle    chan struct{} // closed when no active work after closing
+}
+
+// enter register active work, returns false after closing
+func (d *drain) enter() bool {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.closing {
+		return false
+	}
+
+	d.active++
+
+	return true
+}
+
+func (d *drain) leave() {
+	d.Lock()
+	defer d.Unlock()
+
+	d.active--
+
+	if d.closing && d.active == 0 {
+		close(d.idle)
+	}
+}
+
+func (d *drain) isClosing() bool {
+	d.Lock()
+	defer d.Unlock()
+
+	return d.closing
+}
+
+// close reject new work, returned channel is closed after all active work left
+func (d *drain) close() <-chan struct{} {
+	d.Lock()
+	defer d.Unlock()
+
+	if !d.closing {
+		d.closing = true
+		d.idle = make(chan struct{})
+
+		if d.active == 0 {
+			close(d.idle)
+		}
+	}
+
+	return d.idle
+}
+
+// wait wait for active work left until ctx done
+func (d *drain) wait(ctx context.Context) error {
+	select {
+	case <-d.close():
+		return nil
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "wait for in-flight requests")
+	}
+}
+
+// shutdownServer shutdown wrapped jsonrpc server if it supports graceful shutdown
+func shutdownServer(ctx context.Context, server jsonrpc.Server) error {
+	shutdowner, ok := server.(jsonrpc.ServerShutdowner)
+
+	if !ok {
+		return nil
+	}
+
+	return shutdowner.Shutdown(ctx)
+}
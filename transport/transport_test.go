@@ -0,0 +1,1000 @@
+package transport_test
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/libs4go/errors"
+	"github.com/libs4go/jsonrpc"
+	"github.com/libs4go/jsonrpc/client"
+	"github.com/libs4go/jsonrpc/server"
+	"github.com/libs4go/jsonrpc/transport"
+	"github.com/libs4go/slf4go"
+	"github.com/stretchr/testify/require"
+)
+
+type rpcServer struct {
+}
+
+func (s *rpcServer) SayHello(msg string, code int) (string, error) {
+	return msg, nil
+}
+
+func (s *rpcServer) ErrorCall() (string, error) {
+	return "", fmt.Errorf("ErrorCall")
+}
+
+func (s *rpcServer) Authorization(ctx context.Context) (string, error) {
+	peer, ok := transport.PeerFromContext(ctx)
+
+	if !ok || peer.Header == nil {
+		return "", fmt.Errorf("peer header not found")
+	}
+
+	return peer.Header.Get("Authorization"), nil
+}
+
+func (s *rpcServer) Broadcast(ctx context.Context, count int) (int, error) {
+	pusher, ok := transport.PusherFromContext(ctx)
+
+	if !ok {
+		return 0, fmt.Errorf("pusher not found")
+	}
+
+	for i := 0; i < count; i++ {
+		go pusher.Push(context.Background(), []byte(`{"jsonrpc":"2.0","method":"Broadcast","params":[]}`))
+	}
+
+	return count, nil
+}
+
+func (s *rpcServer) PeerUID(ctx context.Context) (uint32, error) {
+	peer, ok := transport.PeerFromContext(ctx)
+
+	if !ok || peer.Cred == nil {
+		return 0, fmt.Errorf("peer cred not found")
+	}
+
+	return peer.Cred.UID, nil
+}
+
+type slowServer struct {
+	started  chan struct{}
+	canceled chan error
+}
+
+func (s *slowServer) Sleep(ctx context.Context, duration time.Duration) (bool, error) {
+	s.started <- struct{}{}
+
+	select {
+	case <-ctx.Done():
+		s.canceled <- ctx.Err()
+		return false, ctx.Err()
+	case <-time.After(duration):
+		return true, nil
+	}
+}
+
+type orderServer struct {
+	sync.Mutex
+	order   []int
+	release chan struct{}
+}
+
+func (s *orderServer) Append(n int, delay time.Duration) (int, error) {
+	time.Sleep(delay)
+
+	s.Lock()
+	s.order = append(s.order, n)
+	s.Unlock()
+
+	return n, nil
+}
+
+func (s *orderServer) Block() (bool, error) {
+	<-s.release
+	return true, nil
+}
+
+func TestUnix(t *testing.T) {
+
+	defer slf4go.Sync()
+
+	unixServer, err := server.ServeUnix(&rpcServer{})
+
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "jsonrpc.sock")
+
+	listener, err := net.Listen("unix", path)
+
+	require.NoError(t, err)
+
+	defer unixServer.Close()
+
+	go unixServer.Serve(listener)
+
+	client, err := client.UnixConnect(path)
+
+	require.NoError(t, err)
+
+	var echo string
+
+	err = client.Call(context.Background(), "SayHello", "Hello", 1).Join(&echo)
+
+	require.NoError(t, err)
+
+	require.Equal(t, echo, "Hello")
+
+	err = client.Call(context.Background(), "ErrorCall").Join(&echo)
+
+	require.Error(t, err)
+
+	if runtime.GOOS != "linux" {
+		return
+	}
+
+	var uid uint32
+
+	err = client.Call(context.Background(), "PeerUID").Join(&uid)
+
+	require.NoError(t, err)
+
+	require.Equal(t, uint32(os.Getuid()), uid)
+}
+
+func TestUnixListen(t *testing.T) {
+
+	defer slf4go.Sync()
+
+	unixServer, err := server.ServeUnix(&rpcServer{}, transport.UnixSocketMode(0660))
+
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+
+	path := filepath.Join(dir, "jsonrpc.sock")
+
+	go unixServer.ListenAndServe(path)
+
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}, time.Second, 5*time.Millisecond)
+
+	info, err := os.Stat(path)
+
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0660), info.Mode().Perm())
+
+	c, err := client.UnixConnect(path, client.UnixTransportOps(transport.UnixDialTimeout(time.Second)))
+
+	require.NoError(t, err)
+
+	var echo string
+
+	require.NoError(t, c.Call(context.Background(), "SayHello", "Hello", 1).Join(&echo))
+
+	require.NoError(t, unixServer.Close())
+
+	// socket file is removed, private directory is not left behind
+	entries, err := os.ReadDir(dir)
+
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
+
+func TestPipe(t *testing.T) {
+
+	defer slf4go.Sync()
+
+	pipe, err := server.ServePipe(&rpcServer{})
+
+	require.NoError(t, err)
+
+	defer pipe.Close()
+
+	pushed := make(chan string, 1)
+
+	client, err := client.New(client.ClientTrans(pipe), client.ClientNotification(func(method string, params json.RawMessage) {
+		pushed <- method
+	}))
+
+	require.NoError(t, err)
+
+	var echo string
+
+	err = client.Call(context.Background(), "SayHello", "Hello", 1).Join(&echo)
+
+	require.NoError(t, err)
+
+	require.Equal(t, echo, "Hello")
+
+	err = client.Call(context.Background(), "ErrorCall").Join(&echo)
+
+	require.Error(t, err)
+
+	err = pipe.Push(context.Background(), []byte(`{"jsonrpc":"2.0","method":"Ping","params":[]}`))
+
+	require.NoError(t, err)
+
+	require.Equal(t, "Ping", <-pushed)
+}
+
+func TestPipeDrop(t *testing.T) {
+
+	defer slf4go.Sync()
+
+	pipe, err := server.ServePipe(&rpcServer{}, transport.PipeDropRate(1))
+
+	require.NoError(t, err)
+
+	defer pipe.Close()
+
+	client, err := client.New(client.ClientTrans(pipe), client.ClientTimeout(100*time.Millisecond))
+
+	require.NoError(t, err)
+
+	var echo string
+
+	err = client.Call(context.Background(), "SayHello", "Hello", 1).Join(&echo)
+
+	require.True(t, errors.Is(err, jsonrpc.ErrTimeout))
+}
+
+func TestPipeReorder(t *testing.T) {
+
+	defer slf4go.Sync()
+
+	pipe, err := server.ServePipe(&rpcServer{}, transport.PipeReorderRate(1), transport.PipeLatency(time.Millisecond))
+
+	require.NoError(t, err)
+
+	defer pipe.Close()
+
+	client, err := client.New(client.ClientTrans(pipe))
+
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+
+	for _, msg := range []string{"first", "second"} {
+		wg.Add(1)
+
+		go func(msg string) {
+			defer wg.Done()
+
+			var echo string
+
+			err := client.Call(context.Background(), "SayHello", msg, 1).Join(&echo)
+
+			require.NoError(t, err)
+
+			require.Equal(t, msg, echo)
+		}(msg)
+	}
+
+	wg.Wait()
+
+	// held message is delivered even if no next message arrives
+	var echo string
+
+	require.NoError(t, client.Call(context.Background(), "SayHello", "alone", 1).Join(&echo))
+
+	require.Equal(t, "alone", echo)
+}
+
+func TestPipeSeed(t *testing.T) {
+
+	defer slf4go.Sync()
+
+	order := func(seed int64) []string {
+		pipe, err := server.ServePipe(&rpcServer{}, transport.PipeReorderRate(0.5), transport.PipeDropRate(0.2),
+			transport.PipeSeed(seed), transport.PipeLatency(20*time.Millisecond))
+
+		require.NoError(t, err)
+
+		defer pipe.Close()
+
+		for i := 0; i < 20; i++ {
+			require.NoError(t, pipe.Send(context.Background(), []byte(fmt.Sprintf(`{"jsonrpc":"2.0","id":%d,"method":"SayHello","params":["%d",1]}`, i, i))))
+		}
+
+		var ids []string
+
+		for {
+			select {
+			case resp := <-pipe.Recv():
+				var msg struct {
+					ID json.RawMessage `json:"id"`
+				}
+
+				require.NoError(t, json.Unmarshal(resp, &msg))
+
+				ids = append(ids, string(msg.ID))
+			case <-time.After(300 * time.Millisecond):
+				// some responses are dropped, the link stays quiet after the last one
+				require.Less(t, len(ids), 20)
+				return ids
+			}
+		}
+	}
+
+	first := order(1)
+
+	require.Equal(t, first, order(1))
+	require.NotEqual(t, first, order(2))
+}
+
+func TestHttpSpec(t *testing.T) {
+
+	defer slf4go.Sync()
+
+	handler, err := server.ServeHTPP(&rpcServer{}, transport.HTTPMaxRequestSize(128), transport.HTTPAllowGET("Say*"))
+
+	require.NoError(t, err)
+
+	httpServer := httptest.NewServer(handler)
+
+	defer httpServer.Close()
+
+	post := func(contentType string, body string) *http.Response {
+		resp, err := http.Post(httpServer.URL, contentType, strings.NewReader(body))
+
+		require.NoError(t, err)
+
+		resp.Body.Close()
+
+		return resp
+	}
+
+	resp := post("application/json", `{"jsonrpc":"2.0","method":"SayHello","params":["Hello",1],"id":1}`)
+
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	require.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+
+	resp = post("application/json", `{"jsonrpc":"2.0","method":"SayHello","params":["Hello",1]}`)
+
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	resp = post("text/plain", `{"jsonrpc":"2.0","method":"SayHello","params":["Hello",1],"id":1}`)
+
+	require.Equal(t, http.StatusUnsupportedMediaType, resp.StatusCode)
+
+	resp = post("application/json", `{"jsonrpc":"2.0","method":"SayHello","params":["`+strings.Repeat("a", 128)+`",1],"id":1}`)
+
+	require.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+
+	resp = post("application/json", `{"jsonrpc":"2.0",`)
+
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	query := url.Values{}
+	query.Set("method", "SayHello")
+	query.Set("params", `["Hello",1]`)
+	query.Set("id", "1")
+
+	resp, err = http.Get(httpServer.URL + "?" + query.Encode())
+
+	require.NoError(t, err)
+
+	var rpcResponse jsonrpc.RPCResponse
+
+	err = json.NewDecoder(resp.Body).Decode(&rpcResponse)
+
+	resp.Body.Close()
+
+	require.NoError(t, err)
+
+	require.Equal(t, "Hello", rpcResponse.Result)
+
+	// methods not in the GET allow-list must be posted
+	query.Set("method", "ErrorCall")
+	query.Del("params")
+
+	resp, err = http.Get(httpServer.URL + "?" + query.Encode())
+
+	require.NoError(t, err)
+
+	resp.Body.Close()
+
+	require.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	require.Equal(t, "POST", resp.Header.Get("Allow"))
+
+	request, err := http.NewRequest(http.MethodPut, httpServer.URL, nil)
+
+	require.NoError(t, err)
+
+	resp, err = http.DefaultClient.Do(request)
+
+	require.NoError(t, err)
+
+	resp.Body.Close()
+
+	require.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+}
+
+func TestCORS(t *testing.T) {
+
+	defer slf4go.Sync()
+
+	cors := &transport.CORS{
+		AllowedOrigins:   []string{"https://*.example.com"},
+		AllowCredentials: true,
+		MaxAge:           time.Hour,
+	}
+
+	handler, err := server.ServeHTPP(&rpcServer{}, transport.HTTPCORS(cors))
+
+	require.NoError(t, err)
+
+	httpServer := httptest.NewServer(handler)
+
+	defer httpServer.Close()
+
+	preflight := func(origin string) *http.Response {
+		request, err := http.NewRequest(http.MethodOptions, httpServer.URL, nil)
+
+		require.NoError(t, err)
+
+		request.Header.Set("Origin", origin)
+		request.Header.Set("Access-Control-Request-Method", http.MethodPost)
+
+		resp, err := http.DefaultClient.Do(request)
+
+		require.NoError(t, err)
+
+		resp.Body.Close()
+
+		return resp
+	}
+
+	resp := preflight("https://app.example.com")
+
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.Equal(t, "https://app.example.com", resp.Header.Get("Access-Control-Allow-Origin"))
+	require.Equal(t, "true", resp.Header.Get("Access-Control-Allow-Credentials"))
+	require.Equal(t, "3600", resp.Header.Get("Access-Control-Max-Age"))
+
+	resp = preflight("https://evil.com")
+
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	wsServer, err := server.ServeWebSocket(&rpcServer{}, transport.WebSocketCORS(cors))
+
+	require.NoError(t, err)
+
+	wsHTTPServer := httptest.NewServer(wsServer)
+
+	defer wsHTTPServer.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(wsHTTPServer.URL, "http")
+
+	_, err = transport.NewWebSocketClientTransport(wsURL, transport.WebSocketHeaders(map[string][]string{"Origin": {"https://evil.com"}}))
+
+	require.Error(t, err)
+
+	_, err = transport.NewWebSocketClientTransport(wsURL, transport.WebSocketHeaders(map[string][]string{"Origin": {"https://app.example.com"}}))
+
+	require.NoError(t, err)
+}
+
+func TestHttpClientOptions(t *testing.T) {
+
+	defer slf4go.Sync()
+
+	handler, err := server.ServeHTPP(&rpcServer{})
+
+	require.NoError(t, err)
+
+	httpServer := httptest.NewTLSServer(handler)
+
+	defer httpServer.Close()
+
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(httpServer.Certificate())
+
+	client, err := client.HTTPConnect(httpServer.URL, client.HTTPTransportOps(
+		transport.HTTPTLSConfig(&tls.Config{RootCAs: rootCAs}),
+		transport.HTTPBearerToken("token"),
+		transport.HTTPTimeout(time.Second),
+	))
+
+	require.NoError(t, err)
+
+	var authorization string
+
+	err = client.Call(context.Background(), "Authorization").Join(&authorization)
+
+	require.NoError(t, err)
+
+	require.Equal(t, "Bearer token", authorization)
+}
+
+func TestHttpStatus(t *testing.T) {
+
+	defer slf4go.Sync()
+
+	httpServer := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		writer.Header().Set("Content-Type", "text/html")
+		writer.WriteHeader(http.StatusBadGateway)
+		writer.Write([]byte("<html>" + strings.Repeat("bad gateway", 100) + "</html>"))
+	}))
+
+	defer httpServer.Close()
+
+	gatewayClient, err := client.HTTPConnect(httpServer.URL)
+
+	require.NoError(t, err)
+
+	var echo string
+
+	err = gatewayClient.Call(context.Background(), "SayHello", "Hello", 1).Join(&echo)
+
+	var httpErr *transport.HTTPError
+
+	require.True(t, errors.As(err, &httpErr))
+
+	require.Equal(t, http.StatusBadGateway, httpErr.StatusCode)
+
+	require.Len(t, httpErr.Body, 512)
+
+	handler, err := server.ServeHTPP(&rpcServer{}, transport.HTTPMaxRequestSize(16))
+
+	require.NoError(t, err)
+
+	rpcHTTPServer := httptest.NewServer(handler)
+
+	defer rpcHTTPServer.Close()
+
+	rpcClient, err := client.HTTPConnect(rpcHTTPServer.URL)
+
+	require.NoError(t, err)
+
+	err = rpcClient.Call(context.Background(), "SayHello", "Hello", 1).Join(&echo)
+
+	require.True(t, errors.As(err, &httpErr))
+
+	require.Equal(t, http.StatusRequestEntityTooLarge, httpErr.StatusCode)
+
+	require.NotNil(t, httpErr.RPCError)
+}
+
+func TestWebsocketPush(t *testing.T) {
+
+	defer slf4go.Sync()
+
+	handler, err := server.ServeWebSocket(&rpcServer{}, transport.WebSocketWriteQueue(8), transport.WebSocketWriteTimeout(time.Second))
+
+	require.NoError(t, err)
+
+	httpServer := httptest.NewServer(handler)
+
+	defer httpServer.Close()
+
+	pushed := make(chan string, 100)
+
+	client, err := client.WebSocketConnect("ws"+strings.TrimPrefix(httpServer.URL, "http"), client.ClientNotification(func(method string, params json.RawMessage) {
+		pushed <- method
+	}))
+
+	require.NoError(t, err)
+
+	var count int
+
+	err = client.Call(context.Background(), "Broadcast", 50).Join(&count)
+
+	require.NoError(t, err)
+
+	for i := 0; i < count; i++ {
+		require.Equal(t, "Broadcast", <-pushed)
+	}
+}
+
+func TestWebsocketKeepAlive(t *testing.T) {
+
+	defer slf4go.Sync()
+
+	upgrader := websocket.Upgrader{}
+
+	release := make(chan struct{})
+
+	// dead peer never reads, so pings are never answered
+	deadServer := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		c, err := upgrader.Upgrade(writer, req, nil)
+
+		if err != nil {
+			return
+		}
+
+		defer c.Close()
+
+		<-release
+	}))
+
+	defer deadServer.Close()
+
+	defer close(release)
+
+	disconnected := make(chan error, 1)
+
+	deadClient, err := client.WebSocketConnect("ws"+strings.TrimPrefix(deadServer.URL, "http"), client.WebSocketTransportOps(
+		transport.WebSocketKeepAlive(transport.KeepAlive{PingInterval: 50 * time.Millisecond, PongTimeout: 50 * time.Millisecond}),
+		transport.WebSocketOnDisconnect(func(err error) {
+			disconnected <- err
+		}),
+	))
+
+	require.NoError(t, err)
+
+	var echo string
+
+	err = deadClient.Call(context.Background(), "SayHello", "Hello", 1).Join(&echo)
+
+	require.True(t, errors.Is(err, jsonrpc.ErrDisconnect))
+
+	require.True(t, errors.Is(<-disconnected, jsonrpc.ErrDisconnect))
+
+	serverDisconnected := make(chan error, 1)
+
+	handler, err := server.ServeWebSocket(&rpcServer{},
+		transport.WebSocketServerKeepAlive(transport.KeepAlive{IdleTimeout: 100 * time.Millisecond}),
+		transport.WebSocketServerOnDisconnect(func(peer *transport.Peer, err error) {
+			serverDisconnected <- err
+		}),
+	)
+
+	require.NoError(t, err)
+
+	httpServer := httptest.NewServer(handler)
+
+	defer httpServer.Close()
+
+	idleClient, err := client.WebSocketConnect("ws" + strings.TrimPrefix(httpServer.URL, "http"))
+
+	require.NoError(t, err)
+
+	err = idleClient.Call(context.Background(), "SayHello", "Hello", 1).Join(&echo)
+
+	require.NoError(t, err)
+
+	require.True(t, errors.Is(<-serverDisconnected, jsonrpc.ErrDisconnect))
+}
+
+func TestWebsocketConcurrentCalls(t *testing.T) {
+
+	defer slf4go.Sync()
+
+	handler, err := server.ServeWebSocket(&rpcServer{})
+
+	require.NoError(t, err)
+
+	httpServer := httptest.NewServer(handler)
+
+	defer httpServer.Close()
+
+	c, err := client.WebSocketConnect("ws" + strings.TrimPrefix(httpServer.URL, "http"))
+
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			msg := fmt.Sprintf("Hello %d", i)
+
+			var echo string
+
+			err := c.Call(context.Background(), "SayHello", msg, i).Join(&echo)
+
+			require.NoError(t, err)
+
+			require.Equal(t, msg, echo)
+		}(i)
+	}
+
+	wg.Wait()
+
+	ctx, cancelF := context.WithCancel(context.Background())
+
+	cancelF()
+
+	var echo string
+
+	err = c.Call(ctx, "SayHello", "Hello", 1).Join(&echo)
+
+	require.True(t, errors.Is(err, context.Canceled))
+
+	start := time.Now()
+
+	require.NoError(t, c.(*client.Client).Close())
+
+	err = c.Call(context.Background(), "SayHello", "Hello", 1).Join(&echo)
+
+	require.True(t, errors.Is(err, jsonrpc.ErrClose))
+
+	require.Less(t, int64(time.Since(start)), int64(time.Second))
+}
+
+func TestCancelOnClose(t *testing.T) {
+
+	defer slf4go.Sync()
+
+	slow := &slowServer{started: make(chan struct{}, 1), canceled: make(chan error, 1)}
+
+	rpcServer, err := server.New(slow)
+
+	require.NoError(t, err)
+
+	httpServer := httptest.NewServer(transport.ServeWebSocket(rpcServer))
+
+	defer httpServer.Close()
+
+	c, err := client.WebSocketConnect("ws" + strings.TrimPrefix(httpServer.URL, "http"))
+
+	require.NoError(t, err)
+
+	called := make(chan error, 1)
+
+	go func() {
+		var ok bool
+		called <- c.Call(context.Background(), "Sleep", time.Minute).Join(&ok)
+	}()
+
+	<-slow.started
+
+	require.NoError(t, c.(*client.Client).Close())
+
+	require.Error(t, <-called)
+
+	require.Equal(t, context.Canceled, <-slow.canceled)
+
+	require.Eventually(t, func() bool {
+		return server.GetStats(rpcServer).Canceled == 1
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestDispatchLimit(t *testing.T) {
+
+	defer slf4go.Sync()
+
+	order := &orderServer{release: make(chan struct{})}
+
+	rpcServer, err := server.New(order)
+
+	require.NoError(t, err)
+
+	httpServer := httptest.NewServer(transport.ServeWebSocket(rpcServer, transport.WebSocketDispatchLimit(transport.DispatchLimit{
+		MaxConnConcurrent: 1,
+		QueueSize:         1,
+	})))
+
+	defer httpServer.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(httpServer.URL, "http"), nil)
+
+	require.NoError(t, err)
+
+	defer conn.Close()
+
+	for i := 1; i <= 3; i++ {
+		require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf(`{"jsonrpc":"2.0","method":"Block","id":%d}`, i))))
+	}
+
+	var resp jsonrpc.RPCResponse
+
+	require.NoError(t, conn.ReadJSON(&resp))
+	require.NotNil(t, resp.Error)
+	require.Equal(t, jsonrpc.RPCServerBusy, resp.Error.Code)
+	require.Equal(t, uint(3), resp.ID)
+
+	close(order.release)
+
+	for i := 1; i <= 2; i++ {
+		resp = jsonrpc.RPCResponse{}
+		require.NoError(t, conn.ReadJSON(&resp))
+		require.Nil(t, resp.Error)
+		require.Equal(t, uint(i), resp.ID)
+	}
+
+	// zero fields of limit are filled from DefaultDispatchLimit, requests are queued rather than rejected
+	order = &orderServer{release: make(chan struct{})}
+
+	rpcServer, err = server.New(order)
+
+	require.NoError(t, err)
+
+	defaultServer := httptest.NewServer(transport.ServeWebSocket(rpcServer, transport.WebSocketDispatchLimit(transport.DispatchLimit{
+		MaxConnConcurrent: 1,
+	})))
+
+	defer defaultServer.Close()
+
+	defaultConn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(defaultServer.URL, "http"), nil)
+
+	require.NoError(t, err)
+
+	defer defaultConn.Close()
+
+	for i := 1; i <= 3; i++ {
+		require.NoError(t, defaultConn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf(`{"jsonrpc":"2.0","method":"Block","id":%d}`, i))))
+	}
+
+	close(order.release)
+
+	for i := 1; i <= 3; i++ {
+		resp = jsonrpc.RPCResponse{}
+		require.NoError(t, defaultConn.ReadJSON(&resp))
+		require.Nil(t, resp.Error)
+		require.Equal(t, uint(i), resp.ID)
+	}
+}
+
+func TestDispatchSequential(t *testing.T) {
+
+	defer slf4go.Sync()
+
+	order := &orderServer{}
+
+	rpcServer, err := server.New(order)
+
+	require.NoError(t, err)
+
+	httpServer := httptest.NewServer(transport.ServeWebSocket(rpcServer, transport.WebSocketDispatchLimit(transport.DispatchLimit{
+		MaxConcurrent: 4,
+		QueueSize:     16,
+		Sequential:    true,
+	})))
+
+	defer httpServer.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(httpServer.URL, "http"), nil)
+
+	require.NoError(t, err)
+
+	defer conn.Close()
+
+	for i := 0; i < 10; i++ {
+		delay := time.Duration(10-i) * time.Millisecond
+		require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf(`{"jsonrpc":"2.0","method":"Append","params":[%d,%d],"id":%d}`, i, delay, i+1))))
+	}
+
+	for i := 0; i < 10; i++ {
+		var resp jsonrpc.RPCResponse
+		require.NoError(t, conn.ReadJSON(&resp))
+		require.Equal(t, uint(i+1), resp.ID)
+	}
+
+	order.Lock()
+	defer order.Unlock()
+
+	require.Equal(t, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, order.order)
+}
+
+func TestCompression(t *testing.T) {
+
+	defer slf4go.Sync()
+
+	compression := transport.Compression{Level: flate.BestSpeed, Threshold: 16}
+
+	handler, err := server.ServeHTPP(&rpcServer{}, transport.HTTPCompression(compression))
+
+	require.NoError(t, err)
+
+	httpServer := httptest.NewServer(handler)
+
+	defer httpServer.Close()
+
+	httpClient, err := client.HTTPConnect(httpServer.URL, client.HTTPTransportOps(transport.HTTPClientCompression(compression)))
+
+	require.NoError(t, err)
+
+	hello := strings.Repeat("Hello", 100)
+
+	var echo string
+
+	require.NoError(t, httpClient.Call(context.Background(), "SayHello", hello, 1).Join(&echo))
+
+	require.Equal(t, hello, echo)
+
+	var body bytes.Buffer
+
+	gzipWriter := gzip.NewWriter(&body)
+	gzipWriter.Write([]byte(fmt.Sprintf(`{"jsonrpc":"2.0","method":"SayHello","params":["%s",1],"id":1}`, hello)))
+	gzipWriter.Close()
+
+	req, err := http.NewRequest(http.MethodPost, httpServer.URL, &body)
+
+	require.NoError(t, err)
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+	req.Header.Set("Accept-Encoding", "deflate, gzip;q=0")
+
+	resp, err := http.DefaultClient.Do(req)
+
+	require.NoError(t, err)
+
+	defer resp.Body.Close()
+
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "deflate", resp.Header.Get("Content-Encoding"))
+
+	zlibReader, err := zlib.NewReader(resp.Body)
+
+	require.NoError(t, err)
+
+	var rpcResp jsonrpc.RPCResponse
+
+	require.NoError(t, json.NewDecoder(zlibReader).Decode(&rpcResp))
+
+	require.Equal(t, hello, rpcResp.Result)
+
+	req, err = http.NewRequest(http.MethodPost, httpServer.URL, strings.NewReader("{}"))
+
+	require.NoError(t, err)
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "br")
+
+	resp, err = http.DefaultClient.Do(req)
+
+	require.NoError(t, err)
+
+	resp.Body.Close()
+
+	require.Equal(t, http.StatusUnsupportedMediaType, resp.StatusCode)
+
+	wsServer, err := server.ServeWebSocket(&rpcServer{}, transport.WebSocketServerCompression(compression))
+
+	require.NoError(t, err)
+
+	wsHTTPServer := httptest.NewServer(wsServer)
+
+	defer wsHTTPServer.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(wsHTTPServer.URL, "http")
+
+	dialer := *websocket.DefaultDialer
+	dialer.EnableCompression = true
+
+	conn, wsResp, err := dialer.Dial(wsURL, nil)
+
+	require.NoError(t, err)
+
+	conn.Close()
+
+	require.Contains(t, wsResp.Header.Get("Sec-WebSocket-Extensions"), "permessage-deflate")
+
+	wsClient, err := client.WebSocketConnect(wsURL, client.WebSocketTransportOps(transport.WebSocketCompression(compression)))
+
+	require.NoError(t, err)
+
+	require.NoError(t, wsClient.Call(context.Background(), "SayHello", hello, 1).Join(&echo))
+
+	require.Equal(t, hello, echo)
+}
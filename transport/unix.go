@@ -0,0 +1,366 @@
+package transport
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/libs4go/errors"
+	"github.com/libs4go/jsonrpc"
+	"github.com/libs4go/slf4go"
+)
+
+// UnixServer jsonrpc server over unix domain socket
+type UnixServer struct {
+	sync.Mutex
+	slf4go.Logger
+	jsonrpc.Server
+	mode      os.FileMode
+	listeners map[net.Listener]struct{}
+	sockets   map[net.Listener]string // socket files created by ListenAndServe, removed by Close
+	conns     map[net.Conn]struct{}
+	limit     DispatchLimit
+	global    chan struct{}
+}
+
+type UnixServerOps func(*UnixServer)
+
+// UnixSocketMode set socket file mode, default 0600
+func UnixSocketMode(mode os.FileMode) UnixServerOps {
+	return func(server *UnixServer) {
+		server.mode = mode
+	}
+}
+
+// UnixDispatchLimit set concurrency limits of request dispatching, default DefaultDispatchLimit
+func UnixDispatchLimit(limit DispatchLimit) UnixServerOps {
+	return func(server *UnixServer) {
+		server.limit = limit
+	}
+}
+
+// ServeUnix create unix domain socket server
+func ServeUnix(server jsonrpc.Server, ops ...UnixServerOps) *UnixServer {
+	unixServer := &UnixServer{
+		Logger:    slf4go.Get("JSONRPC-TRANSPORT-UNIX-SERVER"),
+		Server:    server,
+		mode:      0600,
+		listeners: make(map[net.Listener]struct{}),
+		sockets:   make(map[net.Listener]string),
+		conns:     make(map[net.Conn]struct{}),
+		limit:     DefaultDispatchLimit,
+	}
+
+	for _, op := range ops {
+		op(unixServer)
+	}
+
+	unixServer.global = newGlobalLimiter(unixServer.limit)
+
+	return unixServer
+}
+
+// ListenAndServe listen on unix socket path and serve incoming connections, the socket file is removed by Close
+func (server *UnixServer) ListenAndServe(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "remove stale socket file %s error", path)
+	}
+
+	listener, err := server.listen(path)
+
+	if err != nil {
+		return err
+	}
+
+	return server.Serve(listener)
+}
+
+// listen create socket in private 0700 directory beside path, so it is never reachable with umask default
+// permissions, then chmod it and rename it into place
+func (server *UnixServer) listen(path string) (net.Listener, error) {
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".jsonrpc-")
+
+	if err != nil {
+		return nil, errors.Wrap(err, "create socket directory of %s error", path)
+	}
+
+	defer os.RemoveAll(dir)
+
+	tempPath := filepath.Join(dir, "socket")
+
+	listener, err := net.Listen("unix", tempPath)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "listen on %s error", path)
+	}
+
+	// the socket file is renamed, so it is removed by Close rather than by the listener
+	if unixListener, ok := listener.(*net.UnixListener); ok {
+		unixListener.SetUnlinkOnClose(false)
+	}
+
+	if err := os.Chmod(tempPath, server.mode); err != nil {
+		listener.Close()
+		return nil, errors.Wrap(err, "chmod socket file %s error", path)
+	}
+
+	// registered with the socket file becoming visible, so Close never misses it
+	server.Lock()
+	defer server.Unlock()
+
+	if err := os.Rename(tempPath, path); err != nil {
+		listener.Close()
+		return nil, errors.Wrap(err, "move socket file to %s error", path)
+	}
+
+	server.listeners[listener] = struct{}{}
+	server.sockets[listener] = path
+
+	return listener, nil
+}
+
+// Serve accept and serve incoming connections on listener
+func (server *UnixServer) Serve(listener net.Listener) error {
+	server.Lock()
+	server.listeners[listener] = struct{}{}
+	server.Unlock()
+
+	defer func() {
+		server.Lock()
+		delete(server.listeners, listener)
+		server.Unlock()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+
+		if err != nil {
+			return errors.Wrap(err, "accept error")
+		}
+
+		go server.serveConn(conn)
+	}
+}
+
+// Close close listeners and active connections
+func (server *UnixServer) Close() error {
+	server.Lock()
+	defer server.Unlock()
+
+	for listener := range server.listeners {
+		listener.Close()
+	}
+
+	for listener, path := range server.sockets {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			server.W("remove socket file {@path} error {@err}", path, err)
+		}
+
+		delete(server.sockets, listener)
+	}
+
+	for conn := range server.conns {
+		conn.Close()
+	}
+
+	return nil
+}
+
+func (server *UnixServer) serveConn(conn net.Conn) {
+	server.Lock()
+	server.conns[conn] = struct{}{}
+	server.Unlock()
+
+	defer func() {
+		server.Lock()
+		delete(server.conns, conn)
+		server.Unlock()
+		conn.Close()
+	}()
+
+	peer := &Peer{
+		Transport:  "unix",
+		RemoteAddr: conn.RemoteAddr().String(),
+	}
+
+	if unixConn, ok := conn.(*net.UnixConn); ok {
+		cred, err := readPeerCred(unixConn)
+
+		if err != nil {
+			server.W("read peer cred error {@err}", err)
+		} else {
+			peer.Cred = cred
+		}
+	}
+
+	stream := newStreamConn(conn)
+
+	ctx, session := newSessionContext(context.Background(), peer, stream)
+
+	defer session.close()
+
+	reply := func(buff []byte) {
+		if err := stream.Write(ctx, buff); err != nil {
+			server.E("server resp write error {@err}", err.Error())
+		}
+	}
+
+	dispatcher := newConnDispatcher(ctx, server.Logger, server.limit, server.global, func(message []byte) {
+		requestCtx, waitHold := withHold(ctx)
+
+		defer waitHold()
+
+		respBuff, err := server.Dispatch(requestCtx, message)
+
+		if ctx.Err() != nil {
+			server.D("drop resp of canceled request, connection {@addr} closed", peer.RemoteAddr)
+			return
+		}
+
+		if err != nil {
+			server.E("server internal error {@err}", err.Error())
+			return
+		}
+
+		if len(respBuff) != 0 {
+			reply(respBuff)
+		}
+	}, reply)
+
+	for {
+		message, err := stream.Read()
+
+		if err != nil {
+			server.D("read error {@err}", err)
+			return
+		}
+
+		dispatcher.Dispatch(message)
+	}
+}
+
+// streamConn json message stream over net.Conn, messages are separated by newline
+type streamConn struct {
+	sync.Mutex
+	conn    net.Conn
+	decoder *json.Decoder
+}
+
+func newStreamConn(conn net.Conn) *streamConn {
+	return &streamConn{
+		conn:    conn,
+		decoder: json.NewDecoder(conn),
+	}
+}
+
+func (stream *streamConn) Read() ([]byte, error) {
+	var message json.RawMessage
+
+	if err := stream.decoder.Decode(&message); err != nil {
+		return nil, err
+	}
+
+	return message, nil
+}
+
+func (stream *streamConn) Write(ctx context.Context, buff []byte) error {
+	stream.Lock()
+	defer stream.Unlock()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		stream.conn.SetWriteDeadline(deadline)
+		defer stream.conn.SetWriteDeadline(time.Time{})
+	}
+
+	message := make([]byte, len(buff)+1)
+	copy(message, buff)
+	message[len(buff)] = '\n'
+
+	_, err := stream.conn.Write(message)
+
+	return err
+}
+
+// Push push message to the peer
+func (stream *streamConn) Push(ctx context.Context, buff []byte) error {
+	return stream.Write(ctx, buff)
+}
+
+// Unix domain socket client transport
+type unixClientTransport struct {
+	slf4go.Logger
+	path        string
+	recv        chan []byte
+	stream      *streamConn
+	dialTimeout time.Duration
+}
+
+type UnixClientOps func(*unixClientTransport)
+
+// UnixDialTimeout set unix socket dial timeout
+func UnixDialTimeout(duration time.Duration) UnixClientOps {
+	return func(transport *unixClientTransport) {
+		transport.dialTimeout = duration
+	}
+}
+
+func NewUnixClientTransport(path string, ops ...UnixClientOps) (jsonrpc.ClientTransport, error) {
+	transport := &unixClientTransport{
+		Logger:      slf4go.Get("JSONRPC-TRANSPORT-UNIX-CLIENT"),
+		path:        path,
+		recv:        make(chan []byte, 100),
+		dialTimeout: time.Second * 10,
+	}
+
+	for _, op := range ops {
+		op(transport)
+	}
+
+	conn, err := net.DialTimeout("unix", path, transport.dialTimeout)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "dial unix socket %s error", path)
+	}
+
+	transport.stream = newStreamConn(conn)
+
+	go transport.runLoop()
+
+	return transport, nil
+}
+
+func (transport *unixClientTransport) runLoop() {
+	defer close(transport.recv)
+
+	for {
+		message, err := transport.stream.Read()
+
+		if err != nil {
+			transport.D("recv message error {@err}", err)
+			return
+		}
+
+		transport.recv <- message
+	}
+}
+
+func (transport *unixClientTransport) Close() error {
+	return transport.stream.conn.Close()
+}
+
+func (transport *unixClientTransport) Send(ctx context.Context, body []byte) error {
+
+	if err := transport.stream.Write(ctx, body); err != nil {
+		return errors.Wrap(err, "send message error")
+	}
+
+	return nil
+}
+
+func (transport *unixClientTransport) Recv() <-chan []byte {
+	return transport.recv
+}
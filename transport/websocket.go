@@ -2,44 +2,225 @@ package transport
 
 import (
 	"context"
+	"math"
+	"math/rand"
 	"net/http"
 	"net/url"
+	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/libs4go/errors"
 	"github.com/libs4go/jsonrpc"
+	"github.com/libs4go/jsonrpc/metrics"
 	"github.com/libs4go/slf4go"
 )
 
+// SlowConsumerPolicy policy applied when the outbound queue of websocket peer is full
+type SlowConsumerPolicy int
+
+const (
+	SlowConsumerBlock      SlowConsumerPolicy = iota // block writer until queue has room
+	SlowConsumerDrop                                 // drop message
+	SlowConsumerDisconnect                           // close peer connection
+)
+
 type WebSocketServer struct {
 	slf4go.Logger
 	jsonrpc.Server
+	upgrader     websocket.Upgrader
+	writeQueue   int
+	writeTimeout time.Duration
+	slowConsumer SlowConsumerPolicy
+	keepAlive    KeepAlive
+	onDisconnect func(peer *Peer, err error)
+	limit        DispatchLimit
+	global       chan struct{}
+	compression  *Compression
+	metrics      metrics.Sink
+	connections  drain // open connections, including handshaking ones
+	requests     drain // in-flight requests
+	connMutex    sync.Mutex
+	conns        map[*wsConn]struct{}
+	killed       bool // connections force closed by Shutdown
+}
+
+type WebSocketServerOps func(*WebSocketServer)
+
+// WebSocketCORS check handshake Origin header against the origins of CORS policy,
+// by default only same origin handshake is accepted
+func WebSocketCORS(cors *CORS) WebSocketServerOps {
+	return func(server *WebSocketServer) {
+		server.upgrader.CheckOrigin = cors.checkOrigin
+	}
+}
+
+// WebSocketWriteQueue set outbound queue size of each connection, default 256
+func WebSocketWriteQueue(size int) WebSocketServerOps {
+	return func(server *WebSocketServer) {
+		server.writeQueue = size
+	}
 }
 
-var upgrader = websocket.Upgrader{}
+// WebSocketWriteTimeout set write deadline of each message, default 10s
+func WebSocketWriteTimeout(duration time.Duration) WebSocketServerOps {
+	return func(server *WebSocketServer) {
+		server.writeTimeout = duration
+	}
+}
+
+// WebSocketSlowConsumer set policy applied when outbound queue is full, default SlowConsumerBlock
+func WebSocketSlowConsumer(policy SlowConsumerPolicy) WebSocketServerOps {
+	return func(server *WebSocketServer) {
+		server.slowConsumer = policy
+	}
+}
 
-func ServeWebSocket(server jsonrpc.Server) *WebSocketServer {
-	return &WebSocketServer{
-		Logger: slf4go.Get("JSONRPC-TRANSPORT-WEBSOCKET-SERVER"),
-		Server: server,
+// WebSocketServerKeepAlive set keepalive settings of server connections
+func WebSocketServerKeepAlive(keepAlive KeepAlive) WebSocketServerOps {
+	return func(server *WebSocketServer) {
+		server.keepAlive = keepAlive
 	}
 }
 
+// WebSocketServerOnDisconnect set callback fired when peer connection closed
+func WebSocketServerOnDisconnect(callback func(peer *Peer, err error)) WebSocketServerOps {
+	return func(server *WebSocketServer) {
+		server.onDisconnect = callback
+	}
+}
+
+// WebSocketDispatchLimit set concurrency limits of request dispatching, default DefaultDispatchLimit
+func WebSocketDispatchLimit(limit DispatchLimit) WebSocketServerOps {
+	return func(server *WebSocketServer) {
+		server.limit = limit
+	}
+}
+
+// WebSocketServerCompression negotiate permessage-deflate with clients
+func WebSocketServerCompression(compression Compression) WebSocketServerOps {
+	return func(server *WebSocketServer) {
+		server.upgrader.EnableCompression = true
+		server.compression = &compression
+	}
+}
+
+// WebSocketServerMetrics record open connections gauge to sink
+func WebSocketServerMetrics(sink metrics.Sink) WebSocketServerOps {
+	return func(server *WebSocketServer) {
+		server.metrics = sink
+	}
+}
+
+func ServeWebSocket(server jsonrpc.Server, ops ...WebSocketServerOps) *WebSocketServer {
+	webSocketServer := &WebSocketServer{
+		Logger:       slf4go.Get("JSONRPC-TRANSPORT-WEBSOCKET-SERVER"),
+		Server:       server,
+		writeQueue:   256,
+		writeTimeout: time.Second * 10,
+		slowConsumer: SlowConsumerBlock,
+		limit:        DefaultDispatchLimit,
+		metrics:      metrics.Discard,
+		conns:        make(map[*wsConn]struct{}),
+	}
+
+	for _, op := range ops {
+		op(webSocketServer)
+	}
+
+	webSocketServer.global = newGlobalLimiter(webSocketServer.limit)
+
+	return webSocketServer
+}
+
 func (server *WebSocketServer) ServeHTTP(writer http.ResponseWriter, req *http.Request) {
-	c, err := upgrader.Upgrade(writer, req, nil)
+	if !server.connections.enter() {
+		writeRPCError(writer, http.StatusServiceUnavailable, jsonrpc.RPCShuttingDown, "server shutting down")
+		return
+	}
+
+	defer server.connections.leave()
+
+	c, err := server.upgrader.Upgrade(writer, req, nil)
 
 	if err != nil {
 		server.E("upgrader error {@err}", err)
 		return
 	}
 
-	defer c.Close()
+	if server.compression != nil {
+		if err := c.SetCompressionLevel(server.compression.level()); err != nil {
+			server.W("set compression level error {@err}", err)
+		}
+	}
+
+	conn := newWSConn(server, c)
+
+	defer conn.Close()
+
+	server.track(conn)
+
+	defer server.untrack(conn)
+
+	server.metrics.AddGauge(metrics.WebSocketConnections, nil, 1)
+
+	defer server.metrics.AddGauge(metrics.WebSocketConnections, nil, -1)
+
+	peer := newHTTPPeer("ws", req)
+
+	ctx, session := newSessionContext(context.Background(), peer, conn)
+
+	defer session.close()
+
+	keeper := startKeepAlive(c, server.keepAlive)
+
+	defer keeper.stop()
+
+	reply := func(buff []byte) {
+		if err := conn.Push(ctx, buff); err != nil {
+			server.E("server resp write error {@err}", err.Error())
+		}
+	}
+
+	dispatcher := newConnDispatcher(ctx, server.Logger, server.limit, server.global, func(message []byte) {
+		// requests received after shutdown are not waited, the wrapped server rejects them
+		if server.requests.enter() {
+			defer server.requests.leave()
+		}
+
+		requestCtx, waitHold := withHold(ctx)
+
+		defer waitHold()
+
+		respBuff, err := server.Dispatch(requestCtx, message)
+
+		if ctx.Err() != nil {
+			server.D("drop resp of canceled request, connection {@addr} closed", peer.RemoteAddr)
+			return
+		}
+
+		if err != nil {
+			server.E("server internal error {@err}", err.Error())
+			return
+		}
+
+		if len(respBuff) != 0 {
+			reply(respBuff)
+		}
+	}, reply)
 
 	for {
 		mt, message, err := c.ReadMessage()
 
 		if err != nil {
-			server.E("read error {@err}", err)
+			err = keeper.err(err)
+
+			server.D("read error {@err}", err)
+
+			if server.onDisconnect != nil {
+				server.onDisconnect(peer, err)
+			}
+
 			break
 		}
 
@@ -47,35 +228,260 @@ func (server *WebSocketServer) ServeHTTP(writer http.ResponseWriter, req *http.R
 			continue
 		}
 
-		go func() {
-			respBuff, err := server.Dispatch(context.Background(), message)
+		keeper.touch()
+
+		dispatcher.Dispatch(message)
+	}
+}
+
+func (server *WebSocketServer) track(conn *wsConn) {
+	server.connMutex.Lock()
+	server.conns[conn] = struct{}{}
+	killed := server.killed
+	server.connMutex.Unlock()
+
+	// connection upgraded while shutting down
+	if killed {
+		conn.Close()
+	} else if server.connections.isClosing() {
+		conn.goAway(context.Background())
+	}
+}
+
+func (server *WebSocketServer) untrack(conn *wsConn) {
+	server.connMutex.Lock()
+	defer server.connMutex.Unlock()
+
+	delete(server.conns, conn)
+}
+
+func (server *WebSocketServer) snapshot(kill bool) []*wsConn {
+	server.connMutex.Lock()
+	defer server.connMutex.Unlock()
+
+	server.killed = server.killed || kill
+
+	conns := make([]*wsConn, 0, len(server.conns))
+
+	for conn := range server.conns {
+		conns = append(conns, conn)
+	}
+
+	return conns
+}
+
+// Shutdown reject new connections, shutdown the wrapped server if it implements jsonrpc.ServerShutdowner
+// (which rejects new requests and ends subscriptions), wait for in-flight requests, then send close frame
+// to all peers after their queued messages and wait for connections closed until ctx done.
+// Connections still open when ctx done are closed immediately.
+func (server *WebSocketServer) Shutdown(ctx context.Context) error {
+	connections := server.connections.close()
+
+	err := shutdownServer(ctx, server.Server)
+
+	if err == nil {
+		err = server.requests.wait(ctx)
+	}
+
+	for _, conn := range server.snapshot(false) {
+		conn.goAway(ctx)
+	}
+
+	select {
+	case <-connections:
+	case <-ctx.Done():
+		for _, conn := range server.snapshot(true) {
+			conn.Close()
+		}
+
+		if err == nil {
+			err = errors.Wrap(ctx.Err(), "wait for websocket connections closed")
+		}
+	}
+
+	return err
+}
 
-			if err != nil {
-				writer.WriteHeader(http.StatusInternalServerError)
-				server.E("server internal error %s", err.Error())
+// wsConn websocket server connection, all writes are serialized by one writer goroutine
+type wsConn struct {
+	slf4go.Logger
+	conn         *websocket.Conn
+	queue        chan []byte
+	writeTimeout time.Duration
+	slowConsumer SlowConsumerPolicy
+	compression  *Compression
+	closed       chan struct{}
+	closeOnce    sync.Once
+	goAwayOnce   sync.Once
+}
+
+func newWSConn(server *WebSocketServer, conn *websocket.Conn) *wsConn {
+	c := &wsConn{
+		Logger:       server.Logger,
+		conn:         conn,
+		queue:        make(chan []byte, server.writeQueue),
+		writeTimeout: server.writeTimeout,
+		slowConsumer: server.slowConsumer,
+		compression:  server.compression,
+		closed:       make(chan struct{}),
+	}
+
+	go c.runLoop()
+
+	return c
+}
+
+func (c *wsConn) runLoop() {
+	defer c.Close()
+
+	for {
+		select {
+		case <-c.closed:
+			return
+		case buff := <-c.queue:
+			if buff == nil {
+				c.writeClose()
+				// wait for peer close handshake, Close is called by the read loop or Shutdown
+				<-c.closed
 				return
 			}
 
-			if len(respBuff) != 0 {
+			if c.writeTimeout > 0 {
+				c.conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+			}
 
-				err = c.WriteMessage(websocket.TextMessage, respBuff)
+			if c.compression != nil {
+				c.conn.EnableWriteCompression(c.compression.compress(len(buff)))
+			}
 
-				if err != nil {
-					server.E("server resp write error %s", err.Error())
-				}
+			if err := c.conn.WriteMessage(websocket.TextMessage, buff); err != nil {
+				c.E("write message error {@err}", err)
+				return
 			}
-		}()
+		}
+	}
+}
+
+// writeClose send going away close frame
+func (c *wsConn) writeClose() {
+	deadline := time.Now().Add(time.Second)
+
+	if c.writeTimeout > 0 {
+		deadline = time.Now().Add(c.writeTimeout)
+	}
+
+	message := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+
+	if err := c.conn.WriteControl(websocket.CloseMessage, message, deadline); err != nil {
+		c.D("write close frame error {@err}", err)
+	}
+}
+
+// goAway queue close frame after queued messages
+func (c *wsConn) goAway(ctx context.Context) {
+	c.goAwayOnce.Do(func() {
+		select {
+		case c.queue <- nil:
+		case <-c.closed:
+		case <-ctx.Done():
+			c.Close()
+		}
+	})
+}
+
+// Push queue message to the peer
+func (c *wsConn) Push(ctx context.Context, buff []byte) error {
+	select {
+	case <-c.closed:
+		return errors.Wrap(jsonrpc.ErrClose, "websocket connection closed")
+	default:
+	}
+
+	select {
+	case c.queue <- buff:
+		return nil
+	default:
+	}
 
+	switch c.slowConsumer {
+	case SlowConsumerDrop:
+		c.W("drop message, outbound queue of {@addr} is full", c.conn.RemoteAddr().String())
+		return errors.Wrap(jsonrpc.ErrOverflow, "outbound queue full, message dropped")
+	case SlowConsumerDisconnect:
+		c.W("disconnect slow consumer {@addr}", c.conn.RemoteAddr().String())
+		c.Close()
+		return errors.Wrap(jsonrpc.ErrOverflow, "outbound queue full, connection closed")
 	}
+
+	select {
+	case c.queue <- buff:
+		return nil
+	case <-c.closed:
+		return errors.Wrap(jsonrpc.ErrClose, "websocket connection closed")
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "push message canceled")
+	}
+}
+
+func (c *wsConn) Close() {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.conn.Close()
+	})
+}
+
+// OfflinePolicy policy applied to sends while reconnecting websocket client is disconnected
+type OfflinePolicy int
+
+const (
+	OfflineFail  OfflinePolicy = iota // fail send immediately with jsonrpc.ErrDisconnect
+	OfflineQueue                      // queue send until reconnected
+)
+
+// ReconnectPolicy websocket client reconnect settings
+type ReconnectPolicy struct {
+	MinBackoff  time.Duration // first redial backoff, default 100ms
+	MaxBackoff  time.Duration // max redial backoff, default 30s
+	Multiplier  float64       // backoff multiplier, default 2
+	Jitter      float64       // backoff randomization factor in [0, 1], default 0.2
+	MaxAttempts int           // max redial attempts of one disconnection, zero means unlimited
+	Offline     OfflinePolicy // policy applied to sends while disconnected
+	QueueSize   int           // max queued sends of OfflineQueue policy, default 100
+}
+
+func (policy *ReconnectPolicy) backoff(attempt int, rand *rand.Rand) time.Duration {
+	backoff := float64(policy.MinBackoff) * math.Pow(policy.Multiplier, float64(attempt))
+
+	if backoff > float64(policy.MaxBackoff) {
+		backoff = float64(policy.MaxBackoff)
+	}
+
+	backoff = backoff * (1 + policy.Jitter*(rand.Float64()*2-1))
+
+	return time.Duration(backoff)
 }
 
 // WebSocket client transport
 type websocketClientTransport struct {
+	sync.Mutex
 	slf4go.Logger
 	u             *url.URL
 	recv          chan []byte
-	client        *websocket.Conn
+	client        *websocket.Conn // current connection, nil while disconnected
 	customHeaders map[string][]string
+	keepAlive     KeepAlive
+	onDisconnect  func(err error)
+	reconnect     *ReconnectPolicy
+	listeners     []func(state jsonrpc.ConnState, err error)
+	offlineQ      [][]byte
+	closed        chan struct{}
+	closeOnce     sync.Once
+	done          chan struct{} // closed when runLoop exits
+	writeLock     chan struct{} // single writer semaphore
+	closeTimeout  time.Duration
+	sendTimeout   time.Duration // write deadline of messages sent without ctx deadline
+	rand          *rand.Rand
+	compression   *Compression
 }
 
 type WebSocketOps func(*websocketClientTransport)
@@ -86,6 +492,75 @@ func WebSocketHeaders(headers map[string][]string) WebSocketOps {
 	}
 }
 
+// WebSocketKeepAlive set keepalive settings of client connection
+func WebSocketKeepAlive(keepAlive KeepAlive) WebSocketOps {
+	return func(hct *websocketClientTransport) {
+		hct.keepAlive = keepAlive
+	}
+}
+
+// WebSocketOnDisconnect set callback fired when connection closed
+func WebSocketOnDisconnect(callback func(err error)) WebSocketOps {
+	return func(hct *websocketClientTransport) {
+		hct.onDisconnect = callback
+	}
+}
+
+// WebSocketReconnect redial with backoff when connection lost
+func WebSocketReconnect(policy ReconnectPolicy) WebSocketOps {
+	return func(hct *websocketClientTransport) {
+		if policy.MinBackoff <= 0 {
+			policy.MinBackoff = time.Millisecond * 100
+		}
+
+		if policy.MaxBackoff <= 0 {
+			policy.MaxBackoff = time.Second * 30
+		}
+
+		if policy.Multiplier < 1 {
+			policy.Multiplier = 2
+		}
+
+		if policy.Jitter <= 0 || policy.Jitter > 1 {
+			policy.Jitter = 0.2
+		}
+
+		if policy.QueueSize <= 0 {
+			policy.QueueSize = 100
+		}
+
+		hct.reconnect = &policy
+	}
+}
+
+// WebSocketCloseTimeout set max duration Close waits for the close handshake, default 1s
+func WebSocketCloseTimeout(duration time.Duration) WebSocketOps {
+	return func(hct *websocketClientTransport) {
+		hct.closeTimeout = duration
+	}
+}
+
+// WebSocketSendTimeout set write deadline of messages sent with ctx without deadline, default 10s
+func WebSocketSendTimeout(duration time.Duration) WebSocketOps {
+	return func(hct *websocketClientTransport) {
+		hct.sendTimeout = duration
+	}
+}
+
+// WebSocketOnStateChange set callback fired when connection state changed
+func WebSocketOnStateChange(callback func(state jsonrpc.ConnState, err error)) WebSocketOps {
+	return func(hct *websocketClientTransport) {
+		hct.listeners = append(hct.listeners, callback)
+	}
+}
+
+// WebSocketCompression negotiate permessage-deflate with server
+func WebSocketCompression(compression Compression) WebSocketOps {
+	return func(hct *websocketClientTransport) {
+		hct.compression = &compression
+	}
+}
+
 func NewWebSocketClientTransport(serviceURL string, ops ...WebSocketOps) (jsonrpc.ClientTransport, error) {
 	u, err := url.Parse(serviceURL)
 
@@ -98,13 +573,19 @@ func NewWebSocketClientTransport(serviceURL string, ops ...WebSocketOps) (jsonrp
 		u:             u,
 		recv:          make(chan []byte, 100),
 		customHeaders: make(map[string][]string),
+		closed:        make(chan struct{}),
+		done:          make(chan struct{}),
+		writeLock:     make(chan struct{}, 1),
+		closeTimeout:  time.Second,
+		sendTimeout:   time.Second * 10,
+		rand:          rand.New(rand.NewSource(time.Now().UnixNano())),
 	}
 
 	for _, op := range ops {
 		op(transport)
 	}
 
-	c, _, err := websocket.DefaultDialer.Dial(serviceURL, http.Header(transport.customHeaders))
+	c, err := transport.dial()
 
 	if err != nil {
 		return nil, err
@@ -112,40 +593,308 @@ func NewWebSocketClientTransport(serviceURL string, ops ...WebSocketOps) (jsonrp
 
 	transport.client = c
 
-	go transport.runLoop()
+	go transport.runLoop(c)
 
 	return transport, nil
 }
 
-func (transport *websocketClientTransport) runLoop() {
+func (transport *websocketClientTransport) dial() (*websocket.Conn, error) {
+	dialer := *websocket.DefaultDialer
+
+	dialer.EnableCompression = transport.compression != nil
+
+	c, _, err := dialer.Dial(transport.u.String(), http.Header(transport.customHeaders))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if transport.compression != nil {
+		if err := c.SetCompressionLevel(transport.compression.level()); err != nil {
+			transport.W("set compression level error {@err}", err)
+		}
+	}
+
+	return c, nil
+}
+
+// AddConnStateListener implement jsonrpc.ConnStateNotifier
+func (transport *websocketClientTransport) AddConnStateListener(listener func(state jsonrpc.ConnState, err error)) {
+	transport.Lock()
+	defer transport.Unlock()
+
+	transport.listeners = append(transport.listeners, listener)
+}
+
+func (transport *websocketClientTransport) setState(state jsonrpc.ConnState, err error) {
+	transport.Lock()
+	listeners := transport.listeners
+	transport.Unlock()
+
+	transport.D("connection {@url} state {@state}", transport.u.String(), state.String())
+
+	for _, listener := range listeners {
+		listener(state, err)
+	}
+}
+
+func (transport *websocketClientTransport) isClosed() bool {
+	select {
+	case <-transport.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (transport *websocketClientTransport) runLoop(c *websocket.Conn) {
+	defer close(transport.done)
 	defer close(transport.recv)
 
 	for {
-		mt, message, err := transport.client.ReadMessage()
+		err := transport.readLoop(c)
+
+		transport.Lock()
+		transport.client = nil
+		transport.Unlock()
+
+		if transport.onDisconnect != nil {
+			transport.onDisconnect(err)
+		}
+
+		if transport.reconnect == nil || transport.isClosed() {
+			transport.failOffline()
+			transport.setState(jsonrpc.ConnClosed, err)
+			return
+		}
+
+		transport.setState(jsonrpc.ConnDisconnected, err)
+
+		c, err = transport.redial()
 
 		if err != nil {
-			transport.E("recv message error {@err}", err)
+			transport.failOffline()
+			transport.setState(jsonrpc.ConnClosed, err)
 			return
 		}
 
+		transport.setState(jsonrpc.ConnConnected, nil)
+	}
+}
+
+func (transport *websocketClientTransport) readLoop(c *websocket.Conn) error {
+	keeper := startKeepAlive(c, transport.keepAlive)
+
+	defer keeper.stop()
+
+	for {
+		mt, message, err := c.ReadMessage()
+
+		if err != nil {
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				transport.D("connection closed {@err}", err)
+			} else {
+				transport.E("recv message error {@err}", keeper.err(err))
+			}
+
+			return keeper.err(err)
+		}
+
 		if mt != websocket.TextMessage {
 			transport.W("skip recv message({@t}) {@msg}", mt, message)
 			continue
 		}
 
-		transport.recv <- message
+		keeper.touch()
+
+		select {
+		case transport.recv <- message:
+		case <-transport.closed:
+		}
+	}
+}
+
+// redial dial with backoff until connected, closed or max attempts exceeded,
+// the queued offline sends are flushed before the new connection becomes visible to Send
+func (transport *websocketClientTransport) redial() (*websocket.Conn, error) {
+	for attempt := 0; transport.reconnect.MaxAttempts == 0 || attempt < transport.reconnect.MaxAttempts; attempt++ {
+		timer := time.NewTimer(transport.reconnect.backoff(attempt, transport.rand))
+
+		select {
+		case <-transport.closed:
+			timer.Stop()
+			return nil, errors.Wrap(jsonrpc.ErrClose, "transport closed")
+		case <-timer.C:
+		}
+
+		transport.setState(jsonrpc.ConnConnecting, nil)
+
+		c, err := transport.dial()
+
+		if err != nil {
+			transport.W("redial {@url} attempt {@attempt} error {@err}", transport.u.String(), attempt+1, err)
+			continue
+		}
+
+		if err = transport.flushOffline(c); err != nil {
+			c.Close()
+			transport.W("flush offline queue to {@url} error {@err}", transport.u.String(), err)
+			continue
+		}
+
+		if transport.isClosed() {
+			c.Close()
+			return nil, errors.Wrap(jsonrpc.ErrClose, "transport closed")
+		}
+
+		return c, nil
+	}
+
+	return nil, errors.Wrap(jsonrpc.ErrDisconnect, "redial %s exceeded max attempts %d", transport.u.String(), transport.reconnect.MaxAttempts)
+}
+
+// flushOffline write queued offline sends to c, then make c visible to Send. The queue is written without
+// holding the lock, sends arriving meanwhile are queued and flushed in order by the next round
+func (transport *websocketClientTransport) flushOffline(c *websocket.Conn) error {
+	for {
+		transport.Lock()
+
+		queued := transport.offlineQ
+
+		if len(queued) == 0 {
+			transport.client = c
+			transport.Unlock()
+			return nil
+		}
+
+		transport.offlineQ = nil
+
+		transport.Unlock()
+
+		for i, buff := range queued {
+			if err := transport.write(context.Background(), c, buff); err != nil {
+				// keep unsent messages for the next connection
+				transport.Lock()
+				transport.offlineQ = append(queued[i:], transport.offlineQ...)
+				transport.Unlock()
+
+				return err
+			}
+		}
+	}
+}
+
+func (transport *websocketClientTransport) failOffline() {
+	transport.Lock()
+	defer transport.Unlock()
+
+	if len(transport.offlineQ) != 0 {
+		transport.W("drop {@count} queued messages", len(transport.offlineQ))
+	}
+
+	transport.offlineQ = nil
+}
+
+// Close send close frame and wait for the close handshake or close timeout
+func (transport *websocketClientTransport) Close() error {
+	closing := false
+
+	transport.closeOnce.Do(func() {
+		close(transport.closed)
+		closing = true
+	})
+
+	if !closing {
+		<-transport.done
+		return nil
+	}
+
+	transport.Lock()
+	c := transport.client
+	transport.Unlock()
+
+	if c != nil {
+		message := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+
+		if err := c.WriteControl(websocket.CloseMessage, message, time.Now().Add(transport.closeTimeout)); err != nil {
+			transport.D("send close frame error {@err}", err)
+		}
+	}
+
+	timer := time.NewTimer(transport.closeTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-transport.done:
+	case <-timer.C:
+		transport.W("wait close handshake timeout")
+	}
+
+	if c != nil {
+		return c.Close()
 	}
+
+	return nil
 }
 
-func (transport *websocketClientTransport) Close() {
-	transport.client.Close()
+// write write message with single writer, ctx deadline is applied as write deadline, or send timeout
+// if ctx has no deadline
+func (transport *websocketClientTransport) write(ctx context.Context, c *websocket.Conn, body []byte) error {
+	select {
+	case transport.writeLock <- struct{}{}:
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "wait for writer canceled")
+	}
+
+	defer func() {
+		<-transport.writeLock
+	}()
+
+	if err := ctx.Err(); err != nil {
+		return errors.Wrap(err, "send message canceled")
+	}
+
+	deadline, ok := ctx.Deadline()
+
+	if !ok && transport.sendTimeout > 0 {
+		deadline = time.Now().Add(transport.sendTimeout)
+	}
+
+	c.SetWriteDeadline(deadline)
+
+	if transport.compression != nil {
+		c.EnableWriteCompression(transport.compression.compress(len(body)))
+	}
+
+	return c.WriteMessage(websocket.TextMessage, body)
 }
 
 func (transport *websocketClientTransport) Send(ctx context.Context, body []byte) error {
 
-	err := transport.client.WriteMessage(websocket.TextMessage, body)
+	transport.Lock()
 
-	if err != nil {
+	c := transport.client
+
+	if c == nil {
+		defer transport.Unlock()
+
+		if transport.isClosed() || transport.reconnect == nil {
+			return errors.Wrap(jsonrpc.ErrClose, "transport closed")
+		}
+
+		if transport.reconnect.Offline == OfflineQueue && len(transport.offlineQ) < transport.reconnect.QueueSize {
+			buff := make([]byte, len(body))
+			copy(buff, body)
+			transport.offlineQ = append(transport.offlineQ, buff)
+			return nil
+		}
+
+		return errors.Wrap(jsonrpc.ErrDisconnect, "websocket disconnected")
+	}
+
+	transport.Unlock()
+
+	if err := transport.write(ctx, c, body); err != nil {
 		return errors.Wrap(err, "send message error")
 	}
 